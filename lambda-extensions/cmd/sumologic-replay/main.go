@@ -0,0 +1,66 @@
+// Command sumologic-replay sends the objects the extension wrote to its failover S3 bucket
+// back to a Sumo Logic HTTP source.
+//
+// Usage:
+//
+//	sumologic-replay -bucket my-bucket -prefix sumologic-extension/us-east-1/my-function/ \
+//		-endpoint https://endpoint.sumologic.com/receiver/v1/http/XXX -rate 2 -checkpoint replay.checkpoint
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/replay"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	var config replay.Config
+	var region, s3Endpoint string
+	flag.StringVar(&config.Bucket, "bucket", "", "failover S3 bucket (required)")
+	flag.StringVar(&config.Prefix, "prefix", "sumologic-extension/", "key prefix to replay")
+	flag.StringVar(&config.Endpoint, "endpoint", os.Getenv("SUMO_HTTP_ENDPOINT"), "Sumo Logic HTTP source URL, defaults to SUMO_HTTP_ENDPOINT")
+	flag.Float64Var(&config.Rate, "rate", 1, "maximum posts per second, 0 for no limit")
+	flag.StringVar(&config.CheckpointPath, "checkpoint", "", "file listing the replayed keys, replays skip them")
+	flag.StringVar(&region, "region", os.Getenv("AWS_REGION"), "region of the bucket")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "custom S3 endpoint URL")
+	flag.Parse()
+
+	logger := logrus.New().WithField("Name", "sumologic-replay")
+	if config.Bucket == "" || config.Endpoint == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		logger.Fatalf("unable to load AWS SDK config: %v", err)
+	}
+	store := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if s3Endpoint != "" {
+			o.BaseEndpoint = aws.String(s3Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	replayer := replay.NewReplayer(store, &http.Client{Timeout: 30 * time.Second}, config, logger)
+	stats, err := replayer.Run(ctx)
+	fmt.Printf("objects=%d chunks=%d records=%d skipped=%d\n", stats.Objects, stats.Chunks, stats.Records, stats.Skipped)
+	if err != nil {
+		logger.Fatalf("replay stopped: %v", err)
+	}
+}
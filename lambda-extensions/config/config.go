@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/lambdaapi"
 	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
 
 	"github.com/sirupsen/logrus"
@@ -32,19 +34,175 @@ type LambdaExtensionConfig struct {
 	MaxRetryAttempts       int
 	RetrySleepTime         time.Duration
 	ConnectionTimeoutValue time.Duration
+	HTTPConnectTimeout     time.Duration
+	HTTPHeaderTimeout      time.Duration
+	HTTPCABundle           string
+	EnableHTTP2            bool
+	PrewarmConnections     bool
+	PreflightMode          string
+	PreflightValidate      bool
+	PreflightTimeout       time.Duration
+	RateLimitBytes         int64
+	RateLimitRecords       int64
+	IngestBudgetBytes      int64
+	IngestBudgetPeriod     string
+	OverBudgetAction       string
+	OverBudgetSampleRate   int
+	MetricRules            []MetricRule
+	MetricsFormat          string
+	EnableEMFMetrics       bool
+	StripEMFMetadata       bool
+	ErrorDetection         bool
+	OrderedDelivery        bool
+	DeliveryIDs            bool
+	FailureDetection       bool
+	MemoryWarningPercent   int
+	TimeoutWarningPercent  int
+	EstimateCost           bool
+	PriceTable             PriceTable
 	MaxDataPayloadSize     int
+	MaxMessageSize         int
+	OversizedRecords       string
+	Compression            string
+	CompressionLevel       int
+	CompressionMinBytes    int
 	LambdaRegion           string
 	SourceCategoryOverride string
+	SourceNameTemplate     string
+	SourceHostTemplate     string
+	SourceCategoryRoutes   map[string]string
+	SumoFields             []SumoField
+	EnableEnrichment       bool
+	EnrichWithTags         bool
+	EnrichmentTagKeys      []string
+	ExtensionLogFormat     string
+	ForwardExtensionLogs   bool
+	ForwardLogLevel        logrus.Level
 	EnhanceJsonLogs        bool
 	EnableSpanDrops        bool
 	KmsCacheSeconds        int64
 	TelemetryTimeoutMs     int
 	TelemetryMaxBytes      int64
 	TelemetryMaxItems      int
+	TelemetryProtocol      string
+	TelemetryReceiverPort  int
+	TelemetrySchema        string
+	ShutdownTimeout        time.Duration
+	FlushInterval          time.Duration
+	MaxRecordAge           time.Duration
+	BufferBytes            int64
+	BufferRecords          int
+	BufferMaxAge           time.Duration
+	BufferSpool            bool
+	BufferSpoolFile        string
+	FlushMode              string
+	PostInvokeWait         time.Duration
+	RequestReportTimeout   time.Duration
+	S3PartitionLayout      string
+	S3KMSKeyId             string
+	S3Endpoint             string
+	DeadLetterTarget       string
+	DeadLetterMaxAttempts  int
+	DeadLetterFile         string
+	// S3Uploader is used for failover, the S3 client behind it is only created on the first upload
+	S3Uploader utils.S3Uploader
+	// TagsReader reads the function tags when EnrichWithTags is set
+	TagsReader utils.FunctionTagsReader
+	// IdentityReader reads the account in managed instance mode, where invocations do not tell the function ARN
+	IdentityReader utils.CallerIdentityReader
 }
 
+const (
+	// S3PartitionLayoutDefault keys failover objects by <region>/<function>/<version>/yyyy/mm/dd/hh/min
+	S3PartitionLayoutDefault = "default"
+	// S3PartitionLayoutHive keys failover objects by region=/function=/version=/year=/month=/day=/hour= partitions
+	S3PartitionLayoutHive = "hive"
+)
+
+const (
+	// DeadLetterTargetSumo sends dead letter records to the Sumo Logic HTTP source as text
+	DeadLetterTargetSumo = "sumo"
+	// DeadLetterTargetS3 uploads dead letter records to the failover bucket
+	DeadLetterTargetS3 = "s3"
+	// DeadLetterTargetFile appends dead letter records to DeadLetterFile
+	DeadLetterTargetFile = "file"
+)
+
+const (
+	// PreflightOff skips the init time checks of the endpoint
+	PreflightOff = "off"
+	// PreflightLenient logs failed init time checks and keeps going
+	PreflightLenient = "lenient"
+	// PreflightStrict reports failed init time checks to /init/error, failing the function init
+	PreflightStrict = "strict"
+)
+
+const (
+	// FlushModeSync sends the queued telemetry after every invocation, before asking for the next event
+	FlushModeSync = "sync"
+	// FlushModeDeferred buffers telemetry after invocations, it is sent while the next invocation runs once a buffer target is reached
+	FlushModeDeferred = "deferred"
+	// FlushModePostInvoke waits up to PostInvokeWait for the runtimeDone of each invocation then sends its
+	// telemetry, after the response is returned. It needs platform events.
+	FlushModePostInvoke = "post_invoke"
+)
+
+// defaultDeferredBufferBytes is the buffer target of FlushModeDeferred when none is configured
+const defaultDeferredBufferBytes = 1024 * 1024
+
+const (
+	// OversizedTruncate cuts records over MaxMessageSize, marking them truncated with their original size
+	OversizedTruncate = "truncate"
+	// OversizedSplit splits records over MaxMessageSize into numbered fragments sharing a fragment id
+	OversizedSplit = "split"
+)
+
+// ManagedInstancesInitType is AWS_LAMBDA_INITIALIZATION_TYPE in Lambda Managed Instances mode
+const ManagedInstancesInitType = "lambda-managed-instances"
+
+// minMaxMessageSize leaves room for the fields every record carries besides its message
+const minMaxMessageSize = 1024
+
+const (
+	// IngestBudgetDaily resets the ingest budget at midnight UTC. Each execution environment has its own
+	// budget, which also starts over when the environment is created.
+	IngestBudgetDaily = "daily"
+	// IngestBudgetInvocation resets the ingest budget when an invocation starts, in standard mode only
+	IngestBudgetInvocation = "invocation"
+)
+
+const (
+	// OverBudgetSample keeps one in OverBudgetSampleRate records over the limits
+	OverBudgetSample = "sample"
+	// OverBudgetSummarize drops records over the limits, sending how many were dropped per level
+	OverBudgetSummarize = "summarize"
+	// OverBudgetS3 uploads records over the limits to the failover bucket
+	OverBudgetS3 = "s3"
+)
+
+// SumoField is a key=value pair sent in the X-Sumo-Fields header, Value may contain placeholders
+type SumoField struct {
+	Key   string
+	Value string
+}
+
+// validPlaceholders can be used in source category, name, host and field values
+var validPlaceholders = []string{"{function}", "{version}", "{region}", "{alias}", "{account}", "{logType}"}
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+var fieldKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
 var defaultLogTypes = []string{"platform", "function"}
 var validLogTypes = []string{"platform", "function", "extension"}
+var validTelemetryProtocols = []string{"HTTP", "TCP"}
+var validIngestBudgetPeriods = []string{IngestBudgetDaily, IngestBudgetInvocation}
+var validOverBudgetActions = []string{OverBudgetSample, OverBudgetSummarize, OverBudgetS3}
+var validOversizedRecords = []string{OversizedTruncate, OversizedSplit}
+var validPreflightModes = []string{PreflightOff, PreflightLenient, PreflightStrict}
+var validFlushModes = []string{FlushModeSync, FlushModeDeferred, FlushModePostInvoke}
+var validDeadLetterTargets = []string{DeadLetterTargetSumo, DeadLetterTargetS3, DeadLetterTargetFile}
+var validCompressions = []string{utils.EncodingGzip, utils.EncodingDeflate, utils.EncodingNone}
 
 // GetConfig to get config instance
 func GetConfig() (*LambdaExtensionConfig, error) {
@@ -54,11 +212,19 @@ func GetConfig() (*LambdaExtensionConfig, error) {
 		KMSKeyId:               os.Getenv("KMS_KEY_ID"),
 		S3BucketName:           os.Getenv("SUMO_S3_BUCKET_NAME"),
 		S3BucketRegion:         os.Getenv("SUMO_S3_BUCKET_REGION"),
+		S3KMSKeyId:             os.Getenv("SUMO_S3_SSE_KMS_KEY_ID"),
+		S3Endpoint:             os.Getenv("SUMO_S3_ENDPOINT"),
+		DeadLetterFile:         os.Getenv("SUMO_DEAD_LETTER_FILE"),
+		BufferSpoolFile:        os.Getenv("SUMO_BUFFER_SPOOL_FILE"),
+		HTTPCABundle:           os.Getenv("SUMO_CA_BUNDLE"),
 		AWSLambdaRuntimeAPI:    os.Getenv("AWS_LAMBDA_RUNTIME_API"),
 		FunctionName:           os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
 		FunctionVersion:        os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
 		LambdaRegion:           os.Getenv("AWS_REGION"),
 		SourceCategoryOverride: os.Getenv("SOURCE_CATEGORY_OVERRIDE"),
+		SourceNameTemplate:     os.Getenv("SUMO_SOURCE_NAME"),
+		SourceHostTemplate:     os.Getenv("SUMO_SOURCE_HOST"),
+		TelemetrySchema:        strings.TrimSpace(os.Getenv("SUMO_TELEMETRY_SCHEMA")),
 		MaxRetryAttempts:       5,
 		ConnectionTimeoutValue: 10000 * time.Millisecond,
 		MaxDataPayloadSize:     1024 * 1024, // 1 MB
@@ -68,6 +234,14 @@ func GetConfig() (*LambdaExtensionConfig, error) {
 
 	err := (*config).validateConfig()
 
+	s3Region := config.S3BucketRegion
+	if s3Region == "" {
+		s3Region = config.LambdaRegion
+	}
+	config.S3Uploader = utils.NewS3Uploader(s3Region, config.S3Endpoint)
+	config.TagsReader = utils.NewFunctionTagsReader(config.LambdaRegion)
+	config.IdentityReader = utils.NewCallerIdentityReader(config.LambdaRegion)
+
 	if err != nil {
 		return config, err
 	}
@@ -88,6 +262,38 @@ func (cfg *LambdaExtensionConfig) setDefaults() {
 	telemetryTimeoutMs := os.Getenv("TELEMETRY_TIMEOUT_MS")
 	telemetryMaxBytes := os.Getenv("TELEMETRY_MAX_BYTES")
 	telemetryMaxItems := os.Getenv("TELEMETRY_MAX_ITEMS")
+	telemetryProtocol := os.Getenv("TELEMETRY_PROTOCOL")
+	telemetryReceiverPort := os.Getenv("TELEMETRY_RECEIVER_PORT")
+	shutdownTimeout := os.Getenv("SUMO_SHUTDOWN_TIMEOUT_MS")
+	flushInterval := os.Getenv("SUMO_FLUSH_INTERVAL_MS")
+	maxRecordAge := os.Getenv("SUMO_MAX_RECORD_AGE_MS")
+	bufferMaxAge := os.Getenv("SUMO_BUFFER_MAX_AGE_MS")
+	bufferSpool := os.Getenv("SUMO_BUFFER_SPOOL")
+	flushMode := os.Getenv("SUMO_FLUSH_MODE")
+	postInvokeWait := os.Getenv("SUMO_POST_INVOKE_WAIT_MS")
+	requestReportTimeout := os.Getenv("SUMO_REQUEST_REPORT_TIMEOUT_MS")
+	s3PartitionLayout := os.Getenv("SUMO_S3_PARTITION_LAYOUT")
+	deadLetterTarget := os.Getenv("SUMO_DEAD_LETTER_TARGET")
+	extensionLogFormat := os.Getenv("SUMO_EXTENSION_LOG_FORMAT")
+	compression := os.Getenv("SUMO_COMPRESSION")
+	httpConnectTimeout := os.Getenv("SUMO_HTTP_CONNECT_TIMEOUT_MS")
+	enableHTTP2 := os.Getenv("SUMO_HTTP2")
+	prewarmConnections := os.Getenv("SUMO_PREWARM_CONNECTIONS")
+	preflightMode := os.Getenv("SUMO_PREFLIGHT")
+	preflightTimeout := os.Getenv("SUMO_PREFLIGHT_TIMEOUT_MS")
+	ingestBudgetPeriod := os.Getenv("SUMO_INGEST_BUDGET_PERIOD")
+	overBudgetAction := os.Getenv("SUMO_OVER_BUDGET_ACTION")
+	maxMessageSize := os.Getenv("SUMO_MAX_MESSAGE_SIZE")
+	oversizedRecords := os.Getenv("SUMO_OVERSIZED_RECORDS")
+	overBudgetSampleRate := os.Getenv("SUMO_OVER_BUDGET_SAMPLE_RATE")
+	metricsFormat := os.Getenv("SUMO_METRICS_FORMAT")
+	errorDetection := os.Getenv("SUMO_ERROR_DETECTION")
+	orderedDelivery := os.Getenv("SUMO_ORDERED_DELIVERY")
+	failureDetection := os.Getenv("SUMO_FAILURE_DETECTION")
+	memoryWarningPercent := os.Getenv("SUMO_MEMORY_WARNING_PERCENT")
+	timeoutWarningPercent := os.Getenv("SUMO_TIMEOUT_WARNING_PERCENT")
+	forwardLogLevel := os.Getenv("SUMO_FORWARD_EXTENSION_LOGS_LEVEL")
+	deadLetterMaxAttempts := os.Getenv("SUMO_DEAD_LETTER_MAX_ATTEMPTS")
 
 	if telemetryTimeoutMs == "" {
 		cfg.TelemetryTimeoutMs = 1000
@@ -101,6 +307,22 @@ func (cfg *LambdaExtensionConfig) setDefaults() {
 		cfg.TelemetryMaxItems = 10000
 	}
 
+	if telemetryProtocol == "" {
+		cfg.TelemetryProtocol = "HTTP"
+	} else {
+		cfg.TelemetryProtocol = strings.ToUpper(strings.TrimSpace(telemetryProtocol))
+	}
+
+	if telemetryReceiverPort == "" {
+		cfg.TelemetryReceiverPort = 4243
+	}
+
+	if s3PartitionLayout == "" {
+		cfg.S3PartitionLayout = S3PartitionLayoutDefault
+	} else {
+		cfg.S3PartitionLayout = strings.ToLower(strings.TrimSpace(s3PartitionLayout))
+	}
+
 	if numRetry == "" {
 		cfg.NumRetry = 3
 	}
@@ -135,6 +357,158 @@ func (cfg *LambdaExtensionConfig) setDefaults() {
 		cfg.RetrySleepTime = 300 * time.Millisecond
 	}
 
+	if shutdownTimeout == "" {
+		// used when the shutdown is not triggered by a SHUTDOWN event carrying its own deadline
+		cfg.ShutdownTimeout = 1500 * time.Millisecond
+	}
+
+	// flush triggers of the managed instance consumer, 0 disables them
+	if flushInterval == "" {
+		cfg.FlushInterval = 10000 * time.Millisecond
+	}
+
+	if maxRecordAge == "" {
+		cfg.MaxRecordAge = 5000 * time.Millisecond
+	}
+
+	// buffering across invocations is enabled by SUMO_BUFFER_BYTES or SUMO_BUFFER_RECORDS
+	if bufferMaxAge == "" {
+		cfg.BufferMaxAge = 60000 * time.Millisecond
+	}
+
+	if bufferSpool == "" {
+		cfg.BufferSpool = true
+	}
+
+	if cfg.BufferSpoolFile == "" {
+		cfg.BufferSpoolFile = "/tmp/sumologic-extension-spool.json"
+	}
+
+	if flushMode == "" {
+		cfg.FlushMode = FlushModeSync
+	} else {
+		cfg.FlushMode = strings.ToLower(strings.TrimSpace(flushMode))
+	}
+
+	// functions running longer have their telemetry sent after the next invocation, as in sync mode
+	if postInvokeWait == "" {
+		cfg.PostInvokeWait = 1000 * time.Millisecond
+	}
+
+	if requestReportTimeout == "" {
+		// longer than the maximum function timeout of 900 seconds
+		cfg.RequestReportTimeout = 960000 * time.Millisecond
+	}
+
+	if deadLetterTarget == "" {
+		cfg.DeadLetterTarget = DeadLetterTargetSumo
+	} else {
+		cfg.DeadLetterTarget = strings.ToLower(strings.TrimSpace(deadLetterTarget))
+	}
+
+	if deadLetterMaxAttempts == "" {
+		cfg.DeadLetterMaxAttempts = 5
+	}
+
+	if httpConnectTimeout == "" {
+		cfg.HTTPConnectTimeout = 3000 * time.Millisecond
+	}
+
+	if enableHTTP2 == "" {
+		cfg.EnableHTTP2 = true
+	}
+
+	if prewarmConnections == "" {
+		cfg.PrewarmConnections = true
+	}
+
+	if preflightMode == "" {
+		cfg.PreflightMode = PreflightOff
+	} else {
+		cfg.PreflightMode = strings.ToLower(strings.TrimSpace(preflightMode))
+	}
+
+	if preflightTimeout == "" {
+		// init of the function and all extensions has to complete in 10 seconds
+		cfg.PreflightTimeout = 3000 * time.Millisecond
+	}
+
+	if ingestBudgetPeriod == "" {
+		cfg.IngestBudgetPeriod = IngestBudgetDaily
+	} else {
+		cfg.IngestBudgetPeriod = strings.ToLower(strings.TrimSpace(ingestBudgetPeriod))
+	}
+
+	if overBudgetAction == "" {
+		cfg.OverBudgetAction = OverBudgetSummarize
+	} else {
+		cfg.OverBudgetAction = strings.ToLower(strings.TrimSpace(overBudgetAction))
+	}
+
+	// Sumo Logic truncates messages over 64 KB
+	if maxMessageSize == "" {
+		cfg.MaxMessageSize = 65536
+	}
+
+	if oversizedRecords == "" {
+		cfg.OversizedRecords = OversizedTruncate
+	} else {
+		cfg.OversizedRecords = strings.ToLower(strings.TrimSpace(oversizedRecords))
+	}
+
+	if overBudgetSampleRate == "" {
+		cfg.OverBudgetSampleRate = 10
+	}
+
+	if metricsFormat == "" {
+		cfg.MetricsFormat = MetricsFormatCarbon2
+	} else {
+		cfg.MetricsFormat = strings.ToLower(strings.TrimSpace(metricsFormat))
+	}
+
+	if errorDetection == "" {
+		cfg.ErrorDetection = true
+	}
+
+	if orderedDelivery == "" {
+		cfg.OrderedDelivery = true
+	}
+
+	if failureDetection == "" {
+		cfg.FailureDetection = true
+	}
+
+	cfg.PriceTable = DefaultPriceTable()
+
+	if memoryWarningPercent == "" {
+		cfg.MemoryWarningPercent = 90
+	}
+
+	if timeoutWarningPercent == "" {
+		cfg.TimeoutWarningPercent = 80
+	}
+
+	if compression == "" {
+		cfg.Compression = utils.EncodingGzip
+	} else {
+		cfg.Compression = strings.ToLower(strings.TrimSpace(compression))
+	}
+
+	if extensionLogFormat == "" {
+		cfg.ExtensionLogFormat = utils.LogFormatText
+	} else {
+		cfg.ExtensionLogFormat = strings.ToLower(strings.TrimSpace(extensionLogFormat))
+	}
+
+	if forwardLogLevel == "" {
+		// forwarding info logs would forward the logs of sending forwarded logs, on every flush
+		cfg.ForwardLogLevel = logrus.WarnLevel
+	}
+
+	if cfg.DeadLetterFile == "" {
+		cfg.DeadLetterFile = "/tmp/sumologic-extension-dlq.ndjson"
+	}
+
 	if enhanceJsonLogs == "" {
 		cfg.EnhanceJsonLogs = true
 	}
@@ -162,6 +536,50 @@ func (cfg *LambdaExtensionConfig) validateConfig() error {
 	telemetryTimeoutMs := os.Getenv("TELEMETRY_TIMEOUT_MS")
 	telemetryMaxBytes := os.Getenv("TELEMETRY_MAX_BYTES")
 	telemetryMaxItems := os.Getenv("TELEMETRY_MAX_ITEMS")
+	telemetryReceiverPort := os.Getenv("TELEMETRY_RECEIVER_PORT")
+	shutdownTimeout := os.Getenv("SUMO_SHUTDOWN_TIMEOUT_MS")
+	flushInterval := os.Getenv("SUMO_FLUSH_INTERVAL_MS")
+	maxRecordAge := os.Getenv("SUMO_MAX_RECORD_AGE_MS")
+	bufferBytes := os.Getenv("SUMO_BUFFER_BYTES")
+	bufferRecords := os.Getenv("SUMO_BUFFER_RECORDS")
+	bufferMaxAge := os.Getenv("SUMO_BUFFER_MAX_AGE_MS")
+	bufferSpool := os.Getenv("SUMO_BUFFER_SPOOL")
+	postInvokeWait := os.Getenv("SUMO_POST_INVOKE_WAIT_MS")
+	requestReportTimeout := os.Getenv("SUMO_REQUEST_REPORT_TIMEOUT_MS")
+	deadLetterMaxAttempts := os.Getenv("SUMO_DEAD_LETTER_MAX_ATTEMPTS")
+	compressionLevel := os.Getenv("SUMO_COMPRESSION_LEVEL")
+	maxRetryAttempts := os.Getenv("SUMO_MAX_RETRY_ATTEMPTS")
+	httpTimeout := os.Getenv("SUMO_HTTP_TIMEOUT_MS")
+	httpConnectTimeout := os.Getenv("SUMO_HTTP_CONNECT_TIMEOUT_MS")
+	httpHeaderTimeout := os.Getenv("SUMO_HTTP_RESPONSE_HEADER_TIMEOUT_MS")
+	enableHTTP2 := os.Getenv("SUMO_HTTP2")
+	prewarmConnections := os.Getenv("SUMO_PREWARM_CONNECTIONS")
+	preflightValidate := os.Getenv("SUMO_PREFLIGHT_VALIDATE")
+	preflightTimeout := os.Getenv("SUMO_PREFLIGHT_TIMEOUT_MS")
+	rateLimitBytes := os.Getenv("SUMO_RATE_LIMIT_BYTES_PER_SEC")
+	rateLimitRecords := os.Getenv("SUMO_RATE_LIMIT_RECORDS_PER_SEC")
+	ingestBudgetBytes := os.Getenv("SUMO_INGEST_BUDGET_BYTES")
+	overBudgetSampleRate := os.Getenv("SUMO_OVER_BUDGET_SAMPLE_RATE")
+	maxMessageSize := os.Getenv("SUMO_MAX_MESSAGE_SIZE")
+	compressionMinBytes := os.Getenv("SUMO_COMPRESSION_MIN_BYTES")
+	sumoFields := os.Getenv("SUMO_FIELDS")
+	enableEnrichment := os.Getenv("SUMO_ENRICHMENT")
+	forwardExtensionLogs := os.Getenv("SUMO_FORWARD_EXTENSION_LOGS")
+	forwardLogLevel := os.Getenv("SUMO_FORWARD_EXTENSION_LOGS_LEVEL")
+	enrichWithTags := os.Getenv("SUMO_ENRICHMENT_TAGS")
+	enrichmentTagKeys := os.Getenv("SUMO_ENRICHMENT_TAG_KEYS")
+	sourceCategoryRoutes := os.Getenv("SUMO_SOURCE_CATEGORY_ROUTES")
+	metricRules := os.Getenv("SUMO_METRIC_RULES")
+	estimateCost := os.Getenv("SUMO_COST_ESTIMATION")
+	priceTable := os.Getenv("SUMO_LAMBDA_PRICE_TABLE")
+	enableEMFMetrics := os.Getenv("SUMO_EMF_METRICS")
+	stripEMFMetadata := os.Getenv("SUMO_EMF_STRIP_METADATA")
+	errorDetection := os.Getenv("SUMO_ERROR_DETECTION")
+	orderedDelivery := os.Getenv("SUMO_ORDERED_DELIVERY")
+	deliveryIDs := os.Getenv("SUMO_DELIVERY_IDS")
+	failureDetection := os.Getenv("SUMO_FAILURE_DETECTION")
+	memoryWarningPercent := os.Getenv("SUMO_MEMORY_WARNING_PERCENT")
+	timeoutWarningPercent := os.Getenv("SUMO_TIMEOUT_WARNING_PERCENT")
 
 	var allErrors []string
 	var err error
@@ -185,6 +603,10 @@ func (cfg *LambdaExtensionConfig) validateConfig() error {
 		}
 	}
 
+	if cfg.S3PartitionLayout != S3PartitionLayoutDefault && cfg.S3PartitionLayout != S3PartitionLayoutHive {
+		allErrors = append(allErrors, fmt.Sprintf("SUMO_S3_PARTITION_LAYOUT %s is unsupported", cfg.S3PartitionLayout))
+	}
+
 	if cfg.EnableFailover {
 		if cfg.S3BucketName == "" {
 			allErrors = append(allErrors, "SUMO_S3_BUCKET_NAME not set in environment variable")
@@ -212,6 +634,347 @@ func (cfg *LambdaExtensionConfig) validateConfig() error {
 		}
 	}
 
+	if maxRetryAttempts != "" {
+		customMaxRetryAttempts, err := strconv.ParseInt(maxRetryAttempts, 10, 32)
+		if err != nil || customMaxRetryAttempts < 1 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_MAX_RETRY_ATTEMPTS: %v", maxRetryAttempts))
+		} else {
+			cfg.MaxRetryAttempts = int(customMaxRetryAttempts)
+		}
+	}
+
+	if httpTimeout != "" {
+		customHTTPTimeout, err := strconv.ParseInt(httpTimeout, 10, 32)
+		if err != nil || customHTTPTimeout < 1 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_HTTP_TIMEOUT_MS: %v", httpTimeout))
+		} else {
+			cfg.ConnectionTimeoutValue = time.Duration(customHTTPTimeout) * time.Millisecond
+		}
+	}
+
+	if httpConnectTimeout != "" {
+		customHTTPConnectTimeout, err := strconv.ParseInt(httpConnectTimeout, 10, 32)
+		if err != nil || customHTTPConnectTimeout < 1 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_HTTP_CONNECT_TIMEOUT_MS: %v", httpConnectTimeout))
+		} else {
+			cfg.HTTPConnectTimeout = time.Duration(customHTTPConnectTimeout) * time.Millisecond
+		}
+	}
+
+	if httpHeaderTimeout != "" {
+		customHTTPHeaderTimeout, err := strconv.ParseInt(httpHeaderTimeout, 10, 32)
+		if err != nil || customHTTPHeaderTimeout < 0 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_HTTP_RESPONSE_HEADER_TIMEOUT_MS: %v", httpHeaderTimeout))
+		} else {
+			cfg.HTTPHeaderTimeout = time.Duration(customHTTPHeaderTimeout) * time.Millisecond
+		}
+	}
+
+	if enableHTTP2 != "" {
+		cfg.EnableHTTP2, err = strconv.ParseBool(enableHTTP2)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_HTTP2: %v", err))
+		}
+	}
+
+	if prewarmConnections != "" {
+		cfg.PrewarmConnections, err = strconv.ParseBool(prewarmConnections)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_PREWARM_CONNECTIONS: %v", err))
+		}
+	}
+
+	if preflightValidate != "" {
+		cfg.PreflightValidate, err = strconv.ParseBool(preflightValidate)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_PREFLIGHT_VALIDATE: %v", err))
+		}
+	}
+
+	if preflightTimeout != "" {
+		customPreflightTimeout, err := strconv.ParseInt(preflightTimeout, 10, 32)
+		if err != nil || customPreflightTimeout < 1 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_PREFLIGHT_TIMEOUT_MS: %v", preflightTimeout))
+		} else {
+			cfg.PreflightTimeout = time.Duration(customPreflightTimeout) * time.Millisecond
+		}
+	}
+
+	if rateLimitBytes != "" {
+		cfg.RateLimitBytes, err = strconv.ParseInt(rateLimitBytes, 10, 64)
+		if err != nil || cfg.RateLimitBytes < 0 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_RATE_LIMIT_BYTES_PER_SEC: %v", rateLimitBytes))
+		}
+	}
+
+	if rateLimitRecords != "" {
+		cfg.RateLimitRecords, err = strconv.ParseInt(rateLimitRecords, 10, 64)
+		if err != nil || cfg.RateLimitRecords < 0 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_RATE_LIMIT_RECORDS_PER_SEC: %v", rateLimitRecords))
+		}
+	}
+
+	if ingestBudgetBytes != "" {
+		cfg.IngestBudgetBytes, err = strconv.ParseInt(ingestBudgetBytes, 10, 64)
+		if err != nil || cfg.IngestBudgetBytes < 0 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_INGEST_BUDGET_BYTES: %v", ingestBudgetBytes))
+		}
+	}
+
+	if overBudgetSampleRate != "" {
+		customOverBudgetSampleRate, err := strconv.ParseInt(overBudgetSampleRate, 10, 32)
+		if err != nil || customOverBudgetSampleRate < 1 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_OVER_BUDGET_SAMPLE_RATE: %v", overBudgetSampleRate))
+		} else {
+			cfg.OverBudgetSampleRate = int(customOverBudgetSampleRate)
+		}
+	}
+
+	if !utils.StringInSlice(cfg.IngestBudgetPeriod, validIngestBudgetPeriods) {
+		allErrors = append(allErrors, fmt.Sprintf("SUMO_INGEST_BUDGET_PERIOD %s is unsupported", cfg.IngestBudgetPeriod))
+	} else if cfg.IngestBudgetPeriod == IngestBudgetInvocation && os.Getenv("AWS_LAMBDA_INITIALIZATION_TYPE") == ManagedInstancesInitType {
+		// concurrent invocations of a managed instance would reset the budget of each other
+		allErrors = append(allErrors, "SUMO_INGEST_BUDGET_PERIOD invocation is unsupported in Managed Instance mode, use daily")
+	}
+
+	if maxMessageSize != "" {
+		customMaxMessageSize, err := strconv.ParseInt(maxMessageSize, 10, 32)
+		if err != nil || (customMaxMessageSize != 0 && customMaxMessageSize < minMaxMessageSize) || customMaxMessageSize > int64(cfg.MaxDataPayloadSize) {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_MAX_MESSAGE_SIZE: %v, 0 or %d to %d bytes are expected", maxMessageSize, minMaxMessageSize, cfg.MaxDataPayloadSize))
+		} else {
+			cfg.MaxMessageSize = int(customMaxMessageSize)
+		}
+	}
+
+	if !utils.StringInSlice(cfg.OversizedRecords, validOversizedRecords) {
+		allErrors = append(allErrors, fmt.Sprintf("SUMO_OVERSIZED_RECORDS %s is unsupported", cfg.OversizedRecords))
+	}
+
+	if !utils.StringInSlice(cfg.OverBudgetAction, validOverBudgetActions) {
+		allErrors = append(allErrors, fmt.Sprintf("SUMO_OVER_BUDGET_ACTION %s is unsupported", cfg.OverBudgetAction))
+	} else if cfg.OverBudgetAction == OverBudgetS3 && cfg.S3BucketName == "" {
+		allErrors = append(allErrors, "SUMO_S3_BUCKET_NAME not set in environment variable, it is required by SUMO_OVER_BUDGET_ACTION s3")
+	}
+
+	if metricRules != "" {
+		var ruleErrors []string
+		cfg.MetricRules, ruleErrors = ParseMetricRules(metricRules)
+		allErrors = append(allErrors, ruleErrors...)
+	}
+
+	if !utils.StringInSlice(cfg.MetricsFormat, validMetricsFormats) {
+		allErrors = append(allErrors, fmt.Sprintf("SUMO_METRICS_FORMAT %s is unsupported", cfg.MetricsFormat))
+	}
+
+	if enableEMFMetrics != "" {
+		cfg.EnableEMFMetrics, err = strconv.ParseBool(enableEMFMetrics)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_EMF_METRICS: %v", err))
+		} else if cfg.EnableEMFMetrics && cfg.MetricsFormat == MetricsFormatEMF {
+			// the documents would be sent back as they came
+			allErrors = append(allErrors, "SUMO_EMF_METRICS needs SUMO_METRICS_FORMAT carbon2 or prometheus")
+		}
+	}
+
+	if failureDetection != "" {
+		cfg.FailureDetection, err = strconv.ParseBool(failureDetection)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_FAILURE_DETECTION: %v", err))
+		}
+	}
+
+	if memoryWarningPercent != "" {
+		customMemoryWarningPercent, err := strconv.ParseInt(memoryWarningPercent, 10, 32)
+		if err != nil || customMemoryWarningPercent < 0 || customMemoryWarningPercent > 100 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_MEMORY_WARNING_PERCENT, 0 to 100 is expected: %v", memoryWarningPercent))
+		} else {
+			cfg.MemoryWarningPercent = int(customMemoryWarningPercent)
+		}
+	}
+
+	if timeoutWarningPercent != "" {
+		customTimeoutWarningPercent, err := strconv.ParseInt(timeoutWarningPercent, 10, 32)
+		if err != nil || customTimeoutWarningPercent < 0 || customTimeoutWarningPercent > 100 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_TIMEOUT_WARNING_PERCENT, 0 to 100 is expected: %v", timeoutWarningPercent))
+		} else {
+			cfg.TimeoutWarningPercent = int(customTimeoutWarningPercent)
+		}
+	}
+
+	if estimateCost != "" {
+		cfg.EstimateCost, err = strconv.ParseBool(estimateCost)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_COST_ESTIMATION: %v", err))
+		}
+	}
+
+	// managed instances are billed for their instances, the bundled prices are per on-demand invocation
+	onDemandPrices := os.Getenv("AWS_LAMBDA_INITIALIZATION_TYPE") != ManagedInstancesInitType
+	if priceTable != "" {
+		cfg.PriceTable, err = ParsePriceTable(priceTable, onDemandPrices)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_LAMBDA_PRICE_TABLE, %v", err))
+		}
+	} else if !onDemandPrices {
+		cfg.PriceTable = nil
+		if cfg.EstimateCost {
+			allErrors = append(allErrors, "SUMO_COST_ESTIMATION needs SUMO_LAMBDA_PRICE_TABLE in Managed Instance mode, the bundled on-demand prices do not apply")
+		}
+	}
+
+	if errorDetection != "" {
+		cfg.ErrorDetection, err = strconv.ParseBool(errorDetection)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_ERROR_DETECTION: %v", err))
+		}
+	}
+
+	if orderedDelivery != "" {
+		cfg.OrderedDelivery, err = strconv.ParseBool(orderedDelivery)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_ORDERED_DELIVERY: %v", err))
+		}
+	}
+
+	if deliveryIDs != "" {
+		cfg.DeliveryIDs, err = strconv.ParseBool(deliveryIDs)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_DELIVERY_IDS: %v", err))
+		}
+	}
+
+	if stripEMFMetadata != "" {
+		cfg.StripEMFMetadata, err = strconv.ParseBool(stripEMFMetadata)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_EMF_STRIP_METADATA: %v", err))
+		}
+	}
+
+	if !utils.StringInSlice(cfg.PreflightMode, validPreflightModes) {
+		allErrors = append(allErrors, fmt.Sprintf("SUMO_PREFLIGHT %s is unsupported", cfg.PreflightMode))
+	}
+
+	if cfg.HTTPCABundle != "" {
+		if _, err := os.Stat(cfg.HTTPCABundle); err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("SUMO_CA_BUNDLE %s is not readable: %v", cfg.HTTPCABundle, err))
+		}
+	}
+
+	if shutdownTimeout != "" {
+		customShutdownTimeout, err := strconv.ParseInt(shutdownTimeout, 10, 32)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_SHUTDOWN_TIMEOUT_MS: %v", err))
+		} else {
+			cfg.ShutdownTimeout = time.Duration(customShutdownTimeout) * time.Millisecond
+		}
+	}
+
+	if flushInterval != "" {
+		customFlushInterval, err := strconv.ParseInt(flushInterval, 10, 32)
+		if err != nil || customFlushInterval < 0 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_FLUSH_INTERVAL_MS: %v", flushInterval))
+		} else {
+			cfg.FlushInterval = time.Duration(customFlushInterval) * time.Millisecond
+		}
+	}
+
+	if maxRecordAge != "" {
+		customMaxRecordAge, err := strconv.ParseInt(maxRecordAge, 10, 32)
+		if err != nil || customMaxRecordAge < 0 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_MAX_RECORD_AGE_MS: %v", maxRecordAge))
+		} else {
+			cfg.MaxRecordAge = time.Duration(customMaxRecordAge) * time.Millisecond
+		}
+	}
+
+	if bufferBytes != "" {
+		customBufferBytes, err := strconv.ParseInt(bufferBytes, 10, 64)
+		if err != nil || customBufferBytes < 0 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_BUFFER_BYTES: %v", bufferBytes))
+		} else {
+			cfg.BufferBytes = customBufferBytes
+		}
+	}
+
+	if bufferRecords != "" {
+		customBufferRecords, err := strconv.ParseInt(bufferRecords, 10, 32)
+		if err != nil || customBufferRecords < 0 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_BUFFER_RECORDS: %v", bufferRecords))
+		} else {
+			cfg.BufferRecords = int(customBufferRecords)
+		}
+	}
+
+	if !utils.StringInSlice(cfg.FlushMode, validFlushModes) {
+		allErrors = append(allErrors, fmt.Sprintf("SUMO_FLUSH_MODE %s is unsupported", cfg.FlushMode))
+	} else if cfg.FlushMode == FlushModeDeferred && cfg.BufferBytes == 0 && cfg.BufferRecords == 0 {
+		// deferring needs a buffer to hold telemetry until it is worth a post
+		cfg.BufferBytes = defaultDeferredBufferBytes
+	} else if cfg.FlushMode == FlushModePostInvoke && !cfg.subscribesTo("platform") {
+		allErrors = append(allErrors, "SUMO_FLUSH_MODE post_invoke needs platform in SUMO_LOG_TYPES to receive runtimeDone")
+	}
+
+	if postInvokeWait != "" {
+		customPostInvokeWait, err := strconv.ParseInt(postInvokeWait, 10, 32)
+		if err != nil || customPostInvokeWait <= 0 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_POST_INVOKE_WAIT_MS: %v", postInvokeWait))
+		} else {
+			cfg.PostInvokeWait = time.Duration(customPostInvokeWait) * time.Millisecond
+		}
+	}
+
+	if bufferMaxAge != "" {
+		customBufferMaxAge, err := strconv.ParseInt(bufferMaxAge, 10, 32)
+		if err != nil || customBufferMaxAge <= 0 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_BUFFER_MAX_AGE_MS: %v", bufferMaxAge))
+		} else {
+			cfg.BufferMaxAge = time.Duration(customBufferMaxAge) * time.Millisecond
+		}
+	}
+
+	if bufferSpool != "" {
+		cfg.BufferSpool, err = strconv.ParseBool(bufferSpool)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_BUFFER_SPOOL: %v", err))
+		}
+	}
+
+	if requestReportTimeout != "" {
+		customRequestReportTimeout, err := strconv.ParseInt(requestReportTimeout, 10, 32)
+		if err != nil || customRequestReportTimeout < 0 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_REQUEST_REPORT_TIMEOUT_MS: %v", requestReportTimeout))
+		} else {
+			cfg.RequestReportTimeout = time.Duration(customRequestReportTimeout) * time.Millisecond
+		}
+	}
+
+	if deadLetterMaxAttempts != "" {
+		customDeadLetterMaxAttempts, err := strconv.ParseInt(deadLetterMaxAttempts, 10, 32)
+		if err != nil || customDeadLetterMaxAttempts < 1 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_DEAD_LETTER_MAX_ATTEMPTS: %v", deadLetterMaxAttempts))
+		} else {
+			cfg.DeadLetterMaxAttempts = int(customDeadLetterMaxAttempts)
+		}
+	}
+
+	if compressionLevel != "" {
+		customCompressionLevel, err := strconv.ParseInt(compressionLevel, 10, 32)
+		if err != nil || customCompressionLevel < 1 || customCompressionLevel > 9 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_COMPRESSION_LEVEL, it has to be between 1 and 9: %v", compressionLevel))
+		} else {
+			cfg.CompressionLevel = int(customCompressionLevel)
+		}
+	}
+
+	if compressionMinBytes != "" {
+		customCompressionMinBytes, err := strconv.ParseInt(compressionMinBytes, 10, 32)
+		if err != nil || customCompressionMinBytes < 0 {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_COMPRESSION_MIN_BYTES: %v", compressionMinBytes))
+		} else {
+			cfg.CompressionMinBytes = int(customCompressionMinBytes)
+		}
+	}
+
 	if maxDataQueueLength != "" {
 		customMaxDataQueueLength, err := strconv.ParseInt(maxDataQueueLength, 10, 32)
 		if err != nil {
@@ -253,6 +1016,46 @@ func (cfg *LambdaExtensionConfig) validateConfig() error {
 		}
 	}
 
+	if enableEnrichment != "" {
+		cfg.EnableEnrichment, err = strconv.ParseBool(enableEnrichment)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_ENRICHMENT: %v", err))
+		}
+	}
+
+	if forwardExtensionLogs != "" {
+		cfg.ForwardExtensionLogs, err = strconv.ParseBool(forwardExtensionLogs)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_FORWARD_EXTENSION_LOGS: %v", err))
+		}
+	}
+
+	if forwardLogLevel != "" {
+		cfg.ForwardLogLevel, err = logrus.ParseLevel(forwardLogLevel)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_FORWARD_EXTENSION_LOGS_LEVEL: %v", err))
+		}
+	}
+
+	if cfg.ExtensionLogFormat != utils.LogFormatText && cfg.ExtensionLogFormat != utils.LogFormatJSON {
+		allErrors = append(allErrors, fmt.Sprintf("SUMO_EXTENSION_LOG_FORMAT %s is unsupported", cfg.ExtensionLogFormat))
+	}
+
+	if enrichWithTags != "" {
+		cfg.EnrichWithTags, err = strconv.ParseBool(enrichWithTags)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse SUMO_ENRICHMENT_TAGS: %v", err))
+		}
+	}
+
+	if enrichmentTagKeys != "" {
+		for _, key := range strings.Split(enrichmentTagKeys, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				cfg.EnrichmentTagKeys = append(cfg.EnrichmentTagKeys, key)
+			}
+		}
+	}
+
 	if kmsCacheSeconds != "" {
 		cfg.KmsCacheSeconds, err = strconv.ParseInt(kmsCacheSeconds, 10, 32)
 		if err != nil {
@@ -291,6 +1094,75 @@ func (cfg *LambdaExtensionConfig) validateConfig() error {
 		cfg.TelemetryMaxItems = min(cfg.TelemetryMaxItems, 10000)
 	}
 
+	if telemetryReceiverPort != "" {
+		customTelemetryReceiverPort, err := strconv.ParseInt(telemetryReceiverPort, 10, 32)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Sprintf("Unable to parse TELEMETRY_RECEIVER_PORT: %v", err))
+		} else if customTelemetryReceiverPort < 1 || customTelemetryReceiverPort > 65535 {
+			allErrors = append(allErrors, fmt.Sprintf("TELEMETRY_RECEIVER_PORT %d is out of range", customTelemetryReceiverPort))
+		} else {
+			cfg.TelemetryReceiverPort = int(customTelemetryReceiverPort)
+		}
+	}
+
+	if cfg.TelemetrySchema != "" && !lambdaapi.IsSupportedSchema(cfg.TelemetrySchema) {
+		allErrors = append(allErrors, fmt.Sprintf("SUMO_TELEMETRY_SCHEMA %s is unsupported", cfg.TelemetrySchema))
+	}
+
+	if !utils.StringInSlice(cfg.TelemetryProtocol, validTelemetryProtocols) {
+		allErrors = append(allErrors, fmt.Sprintf("TELEMETRY_PROTOCOL %s is unsupported", cfg.TelemetryProtocol))
+	}
+
+	if !utils.StringInSlice(cfg.DeadLetterTarget, validDeadLetterTargets) {
+		allErrors = append(allErrors, fmt.Sprintf("SUMO_DEAD_LETTER_TARGET %s is unsupported", cfg.DeadLetterTarget))
+	} else if cfg.DeadLetterTarget == DeadLetterTargetS3 && cfg.S3BucketName == "" {
+		allErrors = append(allErrors, "SUMO_S3_BUCKET_NAME not set in environment variable, it is required by SUMO_DEAD_LETTER_TARGET s3")
+	}
+
+	if !utils.StringInSlice(cfg.Compression, validCompressions) {
+		allErrors = append(allErrors, fmt.Sprintf("SUMO_COMPRESSION %s is unsupported", cfg.Compression))
+	}
+
+	if sumoFields != "" {
+		for _, pair := range strings.Split(sumoFields, ",") {
+			key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			key = strings.TrimSpace(key)
+			if !found || !fieldKeyPattern.MatchString(key) {
+				allErrors = append(allErrors, fmt.Sprintf("SUMO_FIELDS entry %s is not a valid key=value pair", pair))
+				continue
+			}
+			cfg.SumoFields = append(cfg.SumoFields, SumoField{Key: key, Value: strings.TrimSpace(value)})
+		}
+	}
+
+	if sourceCategoryRoutes != "" {
+		cfg.SourceCategoryRoutes = make(map[string]string)
+		for _, pair := range strings.Split(sourceCategoryRoutes, ",") {
+			logType, category, found := strings.Cut(strings.TrimSpace(pair), "=")
+			logType = strings.TrimSpace(logType)
+			if !found || logType == "" || strings.TrimSpace(category) == "" {
+				allErrors = append(allErrors, fmt.Sprintf("SUMO_SOURCE_CATEGORY_ROUTES entry %s is not a valid logType=category pair", pair))
+				continue
+			}
+			cfg.SourceCategoryRoutes[logType] = strings.TrimSpace(category)
+		}
+	}
+
+	templates := []struct{ name, value string }{
+		{"SOURCE_CATEGORY_OVERRIDE", cfg.SourceCategoryOverride},
+		{"SUMO_SOURCE_NAME", cfg.SourceNameTemplate},
+		{"SUMO_SOURCE_HOST", cfg.SourceHostTemplate},
+		{"SUMO_FIELDS", sumoFields},
+		{"SUMO_SOURCE_CATEGORY_ROUTES", sourceCategoryRoutes},
+	}
+	for _, template := range templates {
+		for _, placeholder := range placeholderPattern.FindAllString(template.value, -1) {
+			if !utils.StringInSlice(placeholder, validPlaceholders) {
+				allErrors = append(allErrors, fmt.Sprintf("%s placeholder %s is unsupported", template.name, placeholder))
+			}
+		}
+	}
+
 	// test valid log format type
 	for _, logType := range cfg.LogTypes {
 		if !utils.StringInSlice(strings.TrimSpace(logType), validLogTypes) {
@@ -304,3 +1176,13 @@ func (cfg *LambdaExtensionConfig) validateConfig() error {
 
 	return err
 }
+
+// subscribesTo returns whether logType is one of the subscribed log types
+func (cfg *LambdaExtensionConfig) subscribesTo(logType string) bool {
+	for _, subscribed := range cfg.LogTypes {
+		if strings.TrimSpace(subscribed) == logType {
+			return true
+		}
+	}
+	return false
+}
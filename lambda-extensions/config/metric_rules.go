@@ -0,0 +1,104 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
+)
+
+// Metric types produced by extraction rules
+const (
+	// MetricCounter sums the values extracted during an invocation, 1 per match without a value
+	MetricCounter = "counter"
+	// MetricGauge keeps the last value extracted
+	MetricGauge = "gauge"
+	// MetricHistogram keeps the count, sum, min and max of the values extracted
+	MetricHistogram = "histogram"
+)
+
+// Formats extracted metrics are sent in
+const (
+	// MetricsFormatCarbon2 posts Carbon 2.0 lines to the HTTP source
+	MetricsFormatCarbon2 = "carbon2"
+	// MetricsFormatPrometheus posts Prometheus exposition lines to the HTTP source
+	MetricsFormatPrometheus = "prometheus"
+	// MetricsFormatEMF sends CloudWatch embedded metric format records with the logs
+	MetricsFormatEMF = "emf"
+)
+
+// metricValueGroup is the regex group holding the value, other named groups become dimensions
+const metricValueGroup = "value"
+
+var validMetricTypes = []string{MetricCounter, MetricGauge, MetricHistogram}
+var validMetricsFormats = []string{MetricsFormatCarbon2, MetricsFormatPrometheus, MetricsFormatEMF}
+
+var metricNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.:]*$`)
+
+// MetricRule extracts a metric from function log lines, matched either with Regex against the line
+// or with JSONPath, a dotted path, against JSON logs
+type MetricRule struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Regex    string `json:"regex,omitempty"`
+	JSONPath string `json:"jsonPath,omitempty"`
+	// Dimensions are dotted paths read from JSON logs, named regex groups are used for regex rules
+	Dimensions []string `json:"dimensions,omitempty"`
+	// Drop removes the log line once the metric is extracted
+	Drop bool `json:"drop,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Pattern returns the compiled Regex, nil for JSON path rules
+func (r *MetricRule) Pattern() *regexp.Regexp {
+	return r.pattern
+}
+
+// ValueGroup returns the index of the value group of Regex, -1 when values are counted
+func (r *MetricRule) ValueGroup() int {
+	if r.pattern == nil {
+		return -1
+	}
+	return r.pattern.SubexpIndex(metricValueGroup)
+}
+
+// ParseMetricRules reads a JSON array of rules like SUMO_METRIC_RULES, returning a message per invalid rule
+func ParseMetricRules(raw string) ([]MetricRule, []string) {
+	var rules []MetricRule
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		return nil, []string{fmt.Sprintf("Unable to parse SUMO_METRIC_RULES, a JSON array of rules is expected: %v", err)}
+	}
+	var errors []string
+	valid := rules[:0]
+	for _, rule := range rules {
+		rule.Type = strings.ToLower(strings.TrimSpace(rule.Type))
+		switch {
+		case !metricNamePattern.MatchString(rule.Name):
+			errors = append(errors, fmt.Sprintf("SUMO_METRIC_RULES name %q is not a valid metric name", rule.Name))
+			continue
+		case !utils.StringInSlice(rule.Type, validMetricTypes):
+			errors = append(errors, fmt.Sprintf("SUMO_METRIC_RULES %s type %q is unsupported", rule.Name, rule.Type))
+			continue
+		case (rule.Regex == "") == (rule.JSONPath == ""):
+			errors = append(errors, fmt.Sprintf("SUMO_METRIC_RULES %s needs either a regex or a jsonPath", rule.Name))
+			continue
+		}
+		if rule.Regex != "" {
+			pattern, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("SUMO_METRIC_RULES %s regex is invalid: %v", rule.Name, err))
+				continue
+			}
+			rule.pattern = pattern
+			if rule.Type != MetricCounter && rule.ValueGroup() < 0 {
+				errors = append(errors, fmt.Sprintf("SUMO_METRIC_RULES %s regex needs a (?P<value>...) group for a %s", rule.Name, rule.Type))
+				continue
+			}
+		}
+		valid = append(valid, rule)
+	}
+	return valid, errors
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Architectures as Lambda names them
+const (
+	ArchitectureX86   = "x86_64"
+	ArchitectureARM64 = "arm64"
+)
+
+// defaultPriceRegion holds the prices of the regions missing from a price table
+const defaultPriceRegion = "*"
+
+// LambdaPrice is the on-demand price of invocations, in USD
+type LambdaPrice struct {
+	GBSecond float64 `json:"gbSecond"`
+	Request  float64 `json:"request"`
+}
+
+// PriceTable holds prices per region then architecture, "*" stands for the regions not listed
+type PriceTable map[string]map[string]LambdaPrice
+
+// DefaultPriceTable returns the bundled prices: the first duration tier in us-east-1, which most regions
+// share. Regions priced differently and volume discounts are set with SUMO_LAMBDA_PRICE_TABLE.
+func DefaultPriceTable() PriceTable {
+	return PriceTable{
+		defaultPriceRegion: {
+			ArchitectureX86:   {GBSecond: 0.0000166667, Request: 0.0000002},
+			ArchitectureARM64: {GBSecond: 0.0000133334, Request: 0.0000002},
+		},
+	}
+}
+
+// ParsePriceTable reads a JSON price table like SUMO_LAMBDA_PRICE_TABLE, its prices replace the bundled ones.
+// Without withDefaults only its own prices are kept, so regions and architectures it does not list have no price.
+func ParsePriceTable(raw string, withDefaults bool) (PriceTable, error) {
+	var custom PriceTable
+	if err := json.Unmarshal([]byte(raw), &custom); err != nil {
+		return nil, fmt.Errorf(`a JSON object like {"<region>":{"arm64":{"gbSecond":0.0000133334,"request":0.0000002}}} is expected: %v`, err)
+	}
+	table := PriceTable{}
+	if withDefaults {
+		table = DefaultPriceTable()
+	}
+	for region, prices := range custom {
+		if table[region] == nil {
+			table[region] = make(map[string]LambdaPrice)
+		}
+		for architecture, price := range prices {
+			if architecture != ArchitectureX86 && architecture != ArchitectureARM64 {
+				return nil, fmt.Errorf("architecture %q of region %s is unsupported", architecture, region)
+			}
+			if price.GBSecond < 0 || price.Request < 0 {
+				return nil, fmt.Errorf("prices of %s %s can not be negative", region, architecture)
+			}
+			table[region][architecture] = price
+		}
+	}
+	return table, nil
+}
+
+// Lookup returns the price of an architecture in a region, falling back to the default region
+func (t PriceTable) Lookup(region, architecture string) (LambdaPrice, bool) {
+	if price, ok := t[region][architecture]; ok {
+		return price, true
+	}
+	price, ok := t[defaultPriceRegion][architecture]
+	return price, ok
+}
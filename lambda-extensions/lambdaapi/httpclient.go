@@ -15,6 +15,17 @@ const (
 	extensionErrorType       = "Lambda-Extension-Function-Error-Type"
 )
 
+// RequestError is returned when the Lambda Extensions API responds with a non 200 status
+type RequestError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("request failed with status %s and response %s", e.Status, e.Body)
+}
+
 // Client is a simple client for the Lambda Extensions API
 type Client struct {
 	baseURL       string
@@ -60,7 +71,7 @@ func (client *Client) MakeRequestWithContext(ctx context.Context, headers map[st
 		return nil, err
 	}
 	if httpRes.StatusCode != 200 {
-		return nil, fmt.Errorf("request failed with status %s and response %s", httpRes.Status, string(body))
+		return nil, &RequestError{StatusCode: httpRes.StatusCode, Status: httpRes.Status, Body: string(body)}
 	}
 	// Get the Extension ID from the headers
 	id := httpRes.Header.Get(extensionIdentiferHeader)
@@ -97,7 +108,7 @@ func (client *Client) MakeRequest(headers map[string]string, request *bytes.Buff
 		return nil, err
 	}
 	if httpRes.StatusCode != 200 {
-		return nil, fmt.Errorf("request failed with status %s and response %s", httpRes.Status, string(body))
+		return nil, &RequestError{StatusCode: httpRes.StatusCode, Status: httpRes.Status, Body: string(body)}
 	}
 	// Get the Extension ID from the headers
 	id := httpRes.Header.Get(extensionIdentiferHeader)
@@ -0,0 +1,179 @@
+package lambdaapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Base URL for telemetry api extension
+	telemetryURL = "2022-07-01/telemetry"
+	// Base URL for logs api extension, superseded by the Telemetry API
+	logsURL = "2020-08-15/logs"
+	// HTTPProtocol delivers batches as a JSON array in the body of a POST request
+	HTTPProtocol = "HTTP"
+	// TCPProtocol delivers events as newline delimited JSON over a TCP connection
+	TCPProtocol = "TCP"
+)
+
+// API names the Lambda API a subscription is made against
+type API string
+
+const (
+	// TelemetryAPI is the Lambda Telemetry API
+	TelemetryAPI API = "telemetry"
+	// LogsAPI is the deprecated Lambda Logs API, only used on runtimes without the Telemetry API
+	LogsAPI API = "logs"
+)
+
+// Schema is an event schema version together with the API serving it
+type Schema struct {
+	API     API
+	Version string
+}
+
+func (s Schema) String() string {
+	return fmt.Sprintf("%s/%s", s.API, s.Version)
+}
+
+// ReportsRuntimeDone returns whether platform.runtimeDone events are sent with the schema, the Logs API
+// added them with 2021-03-18
+func (s Schema) ReportsRuntimeDone() bool {
+	return s.API == TelemetryAPI || s.Version >= "2021-03-18"
+}
+
+// supportedSchemas lists every schema the extension can consume, newest first. Events are forwarded as
+// received, so fields added by a newer schema than the one listed here pass through untouched.
+var supportedSchemas = []Schema{
+	{API: TelemetryAPI, Version: "2025-01-29"},
+	{API: TelemetryAPI, Version: "2022-12-13"},
+	{API: TelemetryAPI, Version: "2022-07-01"},
+	{API: LogsAPI, Version: "2021-03-18"},
+}
+
+// managedInstanceSchemas lists the schemas accepted in lambda-managed-instances mode, newest first
+var managedInstanceSchemas = []Schema{
+	{API: TelemetryAPI, Version: "2025-01-29"},
+}
+
+// IsSupportedSchema reports whether version is a schema version the extension can subscribe with
+func IsSupportedSchema(version string) bool {
+	for _, schema := range supportedSchemas {
+		if schema.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// SchemaCandidates returns the schemas to try during negotiation, newest first.
+// A pinned version returns only that schema so a failing subscription is not masked by a fallback.
+func SchemaCandidates(pinnedVersion string, isManagedInstance bool) ([]Schema, error) {
+	if pinnedVersion != "" {
+		for _, schema := range supportedSchemas {
+			if schema.Version == pinnedVersion {
+				return []Schema{schema}, nil
+			}
+		}
+		return nil, fmt.Errorf("schema version %s is unsupported", pinnedVersion)
+	}
+	if isManagedInstance {
+		return managedInstanceSchemas, nil
+	}
+	return supportedSchemas, nil
+}
+
+// Destination is where the Lambda platform delivers the subscribed events, always on the sandbox host.
+type Destination struct {
+	Protocol string
+	Port     int
+}
+
+// toRequest returns the destination in the shape expected by the subscription request body
+func (d Destination) toRequest() map[string]interface{} {
+	if d.Protocol == TCPProtocol {
+		return map[string]interface{}{"protocol": TCPProtocol, "URI": fmt.Sprintf("sandbox:%v", d.Port)}
+	}
+	return map[string]interface{}{"protocol": HTTPProtocol, "URI": fmt.Sprintf("http://sandbox:%v", d.Port)}
+}
+
+// SubscribeRequest holds the subscription parameters shared by the Telemetry API and the Logs API
+type SubscribeRequest struct {
+	Destination Destination
+	Types       []string
+	TimeoutMs   int
+	MaxBytes    int64
+	MaxItems    int
+}
+
+// Subscribe is - Subscribe with the newest of the candidate schemas accepted by the runtime.
+// A schema the runtime does not support moves on to the next candidate, any other failure, like a
+// rejected buffering or log type, is returned straight away.
+func (client *Client) Subscribe(ctx context.Context, request SubscribeRequest, candidates []Schema) (Schema, []byte, error) {
+	if len(candidates) == 0 {
+		return Schema{}, nil, errors.New("no schema candidates to subscribe with")
+	}
+	var errs []error
+	for _, schema := range candidates {
+		response, err := client.subscribe(ctx, schema, request)
+		if err == nil {
+			return schema, response, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", schema, err))
+		if !schemaUnsupported(err) {
+			break
+		}
+	}
+	return Schema{}, nil, fmt.Errorf("subscription failed: %w", errors.Join(errs...))
+}
+
+// schemaUnsupported tells whether a subscription was rejected for its schema: 404 when the runtime has
+// no Telemetry API, 400 naming the schema version when the runtime does not know it
+func schemaUnsupported(err error) bool {
+	var requestErr *RequestError
+	if !errors.As(err, &requestErr) {
+		return false
+	}
+	switch requestErr.StatusCode {
+	case http.StatusNotFound:
+		return true
+	case http.StatusBadRequest:
+		body := strings.ToLower(requestErr.Body)
+		return strings.Contains(body, "schemaversion") || strings.Contains(body, "schema version")
+	}
+	return false
+}
+
+func (client *Client) subscribe(ctx context.Context, schema Schema, request SubscribeRequest) ([]byte, error) {
+	URL := client.baseURL + telemetryURL
+	if schema.API == LogsAPI {
+		URL = client.baseURL + logsURL
+	}
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"destination":   request.Destination.toRequest(),
+		"types":         request.Types,
+		"buffering":     map[string]interface{}{"timeoutMs": request.TimeoutMs, "maxBytes": request.MaxBytes, "maxItems": request.MaxItems},
+		"schemaVersion": schema.Version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{
+		extensionIdentiferHeader: client.extensionID,
+	}
+	var response []byte
+	if ctx != nil {
+		response, err = client.MakeRequestWithContext(ctx, headers, bytes.NewBuffer(reqBody), "PUT", URL)
+	} else {
+		response, err = client.MakeRequest(headers, bytes.NewBuffer(reqBody), "PUT", URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
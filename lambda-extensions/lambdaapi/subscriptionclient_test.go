@@ -0,0 +1,249 @@
+package lambdaapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	ioutil "io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertEqual(t, r.Method, http.MethodPut, "Method is not PUT")
+		assertNotEmpty(t, r.Header.Get(extensionNameHeader), "Extension Name Header not present")
+
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		assertNoError(t, err, "Received error")
+		defer func() {
+			if err := r.Body.Close(); err != nil {
+				log.Printf("failed to close body: %v", err)
+			}
+		}()
+		assertNotEmpty(t, reqBytes, "Received error in request")
+
+		w.Header().Add(extensionIdentiferHeader, "test-sumo-id")
+		w.WriteHeader(200)
+	}))
+
+	defer srv.Close()
+	client := NewClient(srv.URL[7:], extensionName)
+
+	candidates, err := SchemaCandidates("", false)
+	assertNoError(t, err, "SchemaCandidates should not generate error")
+
+	// Without Context
+	schema, response, err := client.Subscribe(context.TODO(), newSubscribeRequest(HTTPProtocol), candidates)
+	commonAsserts(t, client, response, err)
+	assertEqual(t, schema, supportedSchemas[0], "Expected the newest schema to be negotiated")
+
+	// With Context
+	schema, response, err = client.Subscribe(context.Background(), newSubscribeRequest(HTTPProtocol), candidates)
+	commonAsserts(t, client, response, err)
+	assertEqual(t, schema, supportedSchemas[0], "Expected the newest schema to be negotiated")
+}
+
+func newSubscribeRequest(protocol string) SubscribeRequest {
+	return SubscribeRequest{
+		Destination: Destination{Protocol: protocol, Port: 4243},
+		Types:       []string{"platform", "function", "extension"},
+		TimeoutMs:   1000,
+		MaxBytes:    262144,
+		MaxItems:    10000,
+	}
+}
+
+// TestSubscribe_ManagedInstanceMode tests telemetry API subscription in managed instance mode
+// In managed instance mode, schema version should be "2025-01-29"
+func TestSubscribe_ManagedInstanceMode(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertEqual(t, r.Method, http.MethodPut, "Method is not PUT")
+		assertNotEmpty(t, r.Header.Get(extensionNameHeader), "Extension Name Header not present")
+
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		assertNoError(t, err, "Received error")
+		defer func() {
+			if err := r.Body.Close(); err != nil {
+				log.Printf("failed to close body: %v", err)
+			}
+		}()
+		assertNotEmpty(t, reqBytes, "Received error in request")
+
+		// Verify the request body contains managed instance mode schema version
+		var reqBody map[string]interface{}
+		err = json.Unmarshal(reqBytes, &reqBody)
+		assertNoError(t, err, "Failed to unmarshal request body")
+
+		schemaVersion, ok := reqBody["schemaVersion"].(string)
+		if !ok {
+			t.Error("schemaVersion field not found or not a string")
+		}
+		assertEqual(t, schemaVersion, "2025-01-29", "Expected managed instance mode schema version '2025-01-29'")
+
+		// Verify other required fields are present
+		_, destinationExists := reqBody["destination"]
+		if !destinationExists {
+			t.Error("destination field not found")
+		}
+
+		_, typesExists := reqBody["types"]
+		if !typesExists {
+			t.Error("types field not found")
+		}
+
+		_, bufferingExists := reqBody["buffering"]
+		if !bufferingExists {
+			t.Error("buffering field not found")
+		}
+
+		w.Header().Add(extensionIdentiferHeader, "test-sumo-id")
+		w.WriteHeader(200)
+	}))
+
+	defer srv.Close()
+	client := NewClient(srv.URL[7:], extensionName)
+
+	candidates, err := SchemaCandidates("", true)
+	assertNoError(t, err, "SchemaCandidates should not generate error")
+
+	// Test with isManagedInstance = true (context)
+	_, response, err := client.Subscribe(context.Background(), newSubscribeRequest(HTTPProtocol), candidates)
+	commonAsserts(t, client, response, err)
+
+	// Test with isManagedInstance = true (without context)
+	_, response, err = client.Subscribe(context.TODO(), newSubscribeRequest(HTTPProtocol), candidates)
+	commonAsserts(t, client, response, err)
+}
+
+// TestSubscribe_TCPDestination tests that a TCP destination is sent as host:port without a scheme
+func TestSubscribe_TCPDestination(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		assertNoError(t, err, "Received error")
+		defer func() {
+			if err := r.Body.Close(); err != nil {
+				log.Printf("failed to close body: %v", err)
+			}
+		}()
+
+		var reqBody map[string]interface{}
+		err = json.Unmarshal(reqBytes, &reqBody)
+		assertNoError(t, err, "Failed to unmarshal request body")
+
+		destination, ok := reqBody["destination"].(map[string]interface{})
+		if !ok {
+			t.Error("destination field not found")
+		}
+		assertEqual(t, destination["protocol"], "TCP", "Expected TCP protocol in destination")
+		assertEqual(t, destination["URI"], "sandbox:4250", "Expected host:port URI for TCP destination")
+
+		w.Header().Add(extensionIdentiferHeader, "test-sumo-id")
+		w.WriteHeader(200)
+	}))
+
+	defer srv.Close()
+	client := NewClient(srv.URL[7:], extensionName)
+
+	request := newSubscribeRequest(TCPProtocol)
+	request.Destination.Port = 4250
+	_, response, err := client.Subscribe(context.Background(), request, supportedSchemas)
+	commonAsserts(t, client, response, err)
+}
+
+// TestSubscribe_FallbackToLogsAPI tests that rejected schemas are skipped until the Logs API accepts the subscription
+func TestSubscribe_FallbackToLogsAPI(t *testing.T) {
+	var attempted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		assertNoError(t, err, "Received error")
+		defer func() {
+			if err := r.Body.Close(); err != nil {
+				log.Printf("failed to close body: %v", err)
+			}
+		}()
+		var reqBody map[string]interface{}
+		err = json.Unmarshal(reqBytes, &reqBody)
+		assertNoError(t, err, "Failed to unmarshal request body")
+		attempted = append(attempted, fmt.Sprintf("%s %v", r.URL.Path, reqBody["schemaVersion"]))
+
+		if r.URL.Path == "/"+telemetryURL {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Add(extensionIdentiferHeader, "test-sumo-id")
+		w.WriteHeader(200)
+	}))
+
+	defer srv.Close()
+	client := NewClient(srv.URL[7:], extensionName)
+
+	schema, response, err := client.Subscribe(context.Background(), newSubscribeRequest(HTTPProtocol), supportedSchemas)
+	commonAsserts(t, client, response, err)
+	assertEqual(t, schema.API, LogsAPI, "Expected fallback to Logs API")
+	assertEqual(t, len(attempted), len(supportedSchemas), "Expected every schema to be attempted")
+	assertEqual(t, attempted[len(attempted)-1], "/"+logsURL+" 2021-03-18", "Expected Logs API to be attempted last")
+}
+
+// TestSubscribe_NoFallbackOnServerError tests that a server error is returned without trying older schemas
+func TestSubscribe_NoFallbackOnServerError(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	defer srv.Close()
+	client := NewClient(srv.URL[7:], extensionName)
+
+	_, _, err := client.Subscribe(context.Background(), newSubscribeRequest(HTTPProtocol), supportedSchemas)
+	if err == nil {
+		t.Error("Expected subscription to fail")
+	}
+	assertEqual(t, attempts, 1, "Expected no fallback after a server error")
+}
+
+// TestSubscribe_FallbackOnlyForUnsupportedSchemas tests that only rejections of the schema version move on to older schemas
+func TestSubscribe_FallbackOnlyForUnsupportedSchemas(t *testing.T) {
+	for _, test := range []struct {
+		status   int
+		body     string
+		attempts int
+	}{
+		{http.StatusBadRequest, `{"errorType":"ValidationError","errorMessage":"Unsupported schemaVersion 2025-01-29"}`, len(supportedSchemas)},
+		{http.StatusBadRequest, `{"errorType":"ValidationError","errorMessage":"buffering.timeoutMs must be at least 25"}`, 1},
+		{http.StatusForbidden, `{"errorType":"AccessDenied"}`, 1},
+	} {
+		attempts := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(test.status)
+			_, _ = w.Write([]byte(test.body))
+		}))
+		client := NewClient(srv.URL[7:], extensionName)
+		_, _, err := client.Subscribe(context.Background(), newSubscribeRequest(HTTPProtocol), supportedSchemas)
+		srv.Close()
+		if err == nil {
+			t.Error("Expected subscription to fail")
+		}
+		assertEqual(t, attempts, test.attempts, test.body)
+	}
+}
+
+func TestSchemaCandidates(t *testing.T) {
+	candidates, err := SchemaCandidates("2022-07-01", false)
+	assertNoError(t, err, "Pinned supported schema should not generate error")
+	assertEqual(t, len(candidates), 1, "Expected only the pinned schema")
+	assertEqual(t, candidates[0], Schema{API: TelemetryAPI, Version: "2022-07-01"}, "Expected the pinned schema")
+
+	candidates, err = SchemaCandidates("2021-03-18", true)
+	assertNoError(t, err, "Pinned supported schema should not generate error")
+	assertEqual(t, candidates[0].API, LogsAPI, "Expected pinned Logs API schema")
+
+	_, err = SchemaCandidates("2019-01-01", false)
+	if err == nil {
+		t.Error("Expected unsupported pinned schema to generate error")
+	}
+}
@@ -0,0 +1,307 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxChunkSize is the largest payload posted to Sumo Logic, the same limit the extension uses
+	maxChunkSize = 1024 * 1024
+	// maxPostAttempts is how many times a chunk is posted before the replay stops
+	maxPostAttempts = 5
+	// retryBackoff is the wait before the first retry, doubled on each attempt
+	retryBackoff = time.Second
+)
+
+// ObjectStore is the part of the S3 API used to read failover objects
+type ObjectStore interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// Config holds the options of a replay
+type Config struct {
+	Bucket   string
+	Prefix   string
+	Endpoint string
+	// Rate is the number of posts per second, 0 disables rate limiting
+	Rate float64
+	// CheckpointPath is the file listing the replayed keys, empty disables checkpointing
+	CheckpointPath string
+}
+
+// Stats summarises a replay
+type Stats struct {
+	Objects int
+	Chunks  int
+	Records int
+	Skipped int
+}
+
+// Replayer posts failover objects written by the extension back to a Sumo Logic HTTP source.
+// Objects are replayed in the order they were written to the bucket. Keys do not tell that order:
+// objects of the same minute end with a random part and the default layout does not pad minutes.
+// The key of each replayed object is appended to the checkpoint, so a replay run again skips the
+// objects already sent whatever their keys.
+type Replayer struct {
+	store      ObjectStore
+	httpClient *http.Client
+	config     Config
+	logger     *logrus.Entry
+	lastPost   time.Time
+	sleep      func(context.Context, time.Duration) error
+}
+
+// NewReplayer returns a replayer reading from store
+func NewReplayer(store ObjectStore, httpClient *http.Client, config Config, logger *logrus.Entry) *Replayer {
+	return &Replayer{
+		store:      store,
+		httpClient: httpClient,
+		config:     config,
+		logger:     logger,
+		sleep:      sleep,
+	}
+}
+
+// Run replays every object under the prefix that is not in the checkpoint
+func (r *Replayer) Run(ctx context.Context) (Stats, error) {
+	var stats Stats
+	replayed, err := r.readCheckpoint()
+	if err != nil {
+		return stats, err
+	}
+	keys, err := r.listKeys(ctx)
+	if err != nil {
+		return stats, err
+	}
+	for _, key := range keys {
+		if replayed[key] {
+			stats.Skipped++
+			continue
+		}
+		chunks, records, err := r.replayObject(ctx, key)
+		stats.Chunks += chunks
+		stats.Records += records
+		if err != nil {
+			return stats, fmt.Errorf("failed to replay %s: %w", key, err)
+		}
+		stats.Objects++
+		if err := r.writeCheckpoint(key); err != nil {
+			return stats, err
+		}
+		r.logger.Infof("Replayed %s: %d records in %d chunks", key, records, chunks)
+	}
+	return stats, nil
+}
+
+// listKeys returns the keys under the prefix, oldest object first
+func (r *Replayer) listKeys(ctx context.Context) ([]string, error) {
+	var objects []types.Object
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(r.config.Bucket), Prefix: aws.String(r.config.Prefix)}
+	for {
+		output, err := r.store.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list s3 bucket %s prefix %s: %w", r.config.Bucket, r.config.Prefix, err)
+		}
+		objects = append(objects, output.Contents...)
+		if !aws.ToBool(output.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		left, right := aws.ToTime(objects[i].LastModified), aws.ToTime(objects[j].LastModified)
+		if !left.Equal(right) {
+			return left.Before(right)
+		}
+		return aws.ToString(objects[i].Key) < aws.ToString(objects[j].Key)
+	})
+	keys := make([]string, 0, len(objects))
+	for _, object := range objects {
+		keys = append(keys, aws.ToString(object.Key))
+	}
+	return keys, nil
+}
+
+// replayObject reads an object line by line and posts the lines in chunks of up to maxChunkSize, a
+// longer line is posted alone as the extension does
+func (r *Replayer) replayObject(ctx context.Context, key string) (int, int, error) {
+	output, err := r.store.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(r.config.Bucket), Key: aws.String(key)})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer output.Body.Close()
+	reader, err := gzip.NewReader(output.Body)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read gzip object: %w", err)
+	}
+	defer reader.Close()
+
+	var chunk bytes.Buffer
+	var chunks, records int
+	post := func() error {
+		if chunk.Len() == 0 {
+			return nil
+		}
+		if err := r.post(ctx, chunk.Bytes()); err != nil {
+			return err
+		}
+		chunks++
+		chunk.Reset()
+		return nil
+	}
+	lines := bufio.NewReader(reader)
+	for {
+		line, readErr := lines.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return chunks, records, fmt.Errorf("failed to read object: %w", readErr)
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if chunk.Len()+len(line)+1 > maxChunkSize {
+				if err := post(); err != nil {
+					return chunks, records, err
+				}
+			}
+			chunk.Write(line)
+			chunk.WriteByte('\n')
+			records++
+		}
+		if readErr == io.EOF {
+			return chunks, records, post()
+		}
+	}
+}
+
+// post sends a chunk, retrying on throttling and server errors
+func (r *Replayer) post(ctx context.Context, chunk []byte) error {
+	payload := string(chunk)
+	compressed, err := utils.Compress(&payload)
+	if err != nil {
+		return err
+	}
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		if err := r.wait(ctx); err != nil {
+			return err
+		}
+		retry, err := r.send(ctx, compressed)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= maxPostAttempts {
+			return err
+		}
+		r.logger.Warnf("Post attempt %d failed, retrying in %v: %v", attempt, backoff, err)
+		if err := r.sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+func (r *Replayer) send(ctx context.Context, compressed []byte) (bool, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, r.config.Endpoint, bytes.NewReader(compressed))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Add("Content-Encoding", "gzip")
+	response, err := r.httpClient.Do(request)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+	if response.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	retry := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= http.StatusInternalServerError
+	return retry, fmt.Errorf("sumo logic returned %s", response.Status)
+}
+
+// wait spaces posts by 1/Rate seconds
+func (r *Replayer) wait(ctx context.Context) error {
+	if r.config.Rate <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / r.config.Rate)
+	if !r.lastPost.IsZero() {
+		if err := r.sleep(ctx, interval-time.Since(r.lastPost)); err != nil {
+			return err
+		}
+	}
+	r.lastPost = time.Now()
+	return nil
+}
+
+// readCheckpoint returns the keys already replayed, one per line of the checkpoint file
+func (r *Replayer) readCheckpoint() (map[string]bool, error) {
+	replayed := make(map[string]bool)
+	if r.config.CheckpointPath == "" {
+		return replayed, nil
+	}
+	data, err := os.ReadFile(r.config.CheckpointPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return replayed, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	for _, key := range strings.Split(string(data), "\n") {
+		if key = strings.TrimSpace(key); key != "" {
+			replayed[key] = true
+		}
+	}
+	return replayed, nil
+}
+
+// writeCheckpoint appends a replayed key to the checkpoint file. A line cut by an interruption matches
+// no key, so the object is replayed again rather than lost.
+func (r *Replayer) writeCheckpoint(key string) error {
+	if r.config.CheckpointPath == "" {
+		return nil
+	}
+	file, err := os.OpenFile(r.config.CheckpointPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if _, err := file.WriteString(key + "\n"); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
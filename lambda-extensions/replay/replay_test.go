@@ -0,0 +1,230 @@
+package replay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeStore serves gzipped objects from memory, listing them in pages of one key
+type fakeStore struct {
+	objects  map[string][]byte
+	keys     []string
+	modified map[string]time.Time
+}
+
+func newFakeStore(objects map[string]string) *fakeStore {
+	store := &fakeStore{objects: make(map[string][]byte)}
+	for key, content := range objects {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		_, _ = writer.Write([]byte(content))
+		_ = writer.Close()
+		store.objects[key] = buf.Bytes()
+		// listed out of order, the replayer sorts keys
+		store.keys = append([]string{key}, store.keys...)
+	}
+	return store
+}
+
+func (f *fakeStore) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	start := 0
+	if params.ContinuationToken != nil {
+		fmt.Sscanf(*params.ContinuationToken, "%d", &start)
+	}
+	output := &s3.ListObjectsV2Output{}
+	for i := start; i < len(f.keys); i++ {
+		if !strings.HasPrefix(f.keys[i], aws.ToString(params.Prefix)) {
+			continue
+		}
+		output.Contents = []types.Object{{Key: aws.String(f.keys[i])}}
+		if modified, ok := f.modified[f.keys[i]]; ok {
+			output.Contents[0].LastModified = aws.Time(modified)
+		}
+		if i+1 < len(f.keys) {
+			output.IsTruncated = aws.Bool(true)
+			output.NextContinuationToken = aws.String(fmt.Sprint(i + 1))
+		}
+		return output, nil
+	}
+	return output, nil
+}
+
+func (f *fakeStore) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	data, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, fmt.Errorf("no such key %s", aws.ToString(params.Key))
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+// sumoServer records decompressed posts and fails the first failures ones with 503
+type sumoServer struct {
+	mu       sync.Mutex
+	posts    []string
+	failures int
+}
+
+func (s *sumoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	reader, err := gzip.NewReader(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	body, _ := io.ReadAll(reader)
+	s.posts = append(s.posts, string(body))
+}
+
+func newTestReplayer(store ObjectStore, url string, config Config) *Replayer {
+	config.Endpoint = url
+	replayer := NewReplayer(store, http.DefaultClient, config, logrus.NewEntry(logrus.New()))
+	replayer.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+	return replayer
+}
+
+func TestReplayInKeyOrderWithCheckpoint(t *testing.T) {
+	store := newFakeStore(map[string]string{
+		"sumologic-extension/a/1.gz": "{\"n\":1}\n{\"n\":2}\n",
+		"sumologic-extension/a/2.gz": "{\"n\":3}\n",
+		"other/3.gz":                 "{\"n\":4}\n",
+	})
+	server := &sumoServer{failures: 1}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+
+	stats, err := newTestReplayer(store, ts.URL, Config{Bucket: "b", Prefix: "sumologic-extension/", CheckpointPath: checkpoint}).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.Objects != 2 || stats.Records != 3 || stats.Chunks != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if len(server.posts) != 2 || server.posts[0] != "{\"n\":1}\n{\"n\":2}\n" || server.posts[1] != "{\"n\":3}\n" {
+		t.Fatalf("unexpected posts %q", server.posts)
+	}
+	data, _ := os.ReadFile(checkpoint)
+	if string(data) != "sumologic-extension/a/1.gz\nsumologic-extension/a/2.gz\n" {
+		t.Fatalf("unexpected checkpoint %q", data)
+	}
+
+	// a second run resumes after the checkpoint
+	stats, err = newTestReplayer(store, ts.URL, Config{Bucket: "b", Prefix: "sumologic-extension/", CheckpointPath: checkpoint}).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.Objects != 0 || stats.Skipped != 2 || len(server.posts) != 2 {
+		t.Fatalf("expected everything to be skipped, got %+v", stats)
+	}
+}
+
+func TestReplayResumesInWriteOrder(t *testing.T) {
+	// written 12:09 then 12:10, the unpadded minutes of the default layout sort the other way
+	store := newFakeStore(map[string]string{
+		"p/12/9/f.gz":  "{\"n\":1}\n",
+		"p/12/10/a.gz": "{\"n\":2}\n",
+		"p/12/10/b.gz": "{\"n\":3}\n",
+	})
+	now := time.Now()
+	store.modified = map[string]time.Time{"p/12/9/f.gz": now, "p/12/10/b.gz": now.Add(time.Minute), "p/12/10/a.gz": now.Add(2 * time.Minute)}
+	server := &sumoServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	// an earlier run replayed the newest object only
+	_ = os.WriteFile(checkpoint, []byte("p/12/10/a.gz\n"), 0o644)
+
+	stats, err := newTestReplayer(store, ts.URL, Config{Bucket: "b", CheckpointPath: checkpoint}).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.Objects != 2 || stats.Skipped != 1 {
+		t.Fatalf("objects not in the checkpoint should be replayed whatever their keys, got %+v", stats)
+	}
+	if len(server.posts) != 2 || server.posts[0] != "{\"n\":1}\n" || server.posts[1] != "{\"n\":3}\n" {
+		t.Fatalf("objects should be replayed in write order, got %q", server.posts)
+	}
+}
+
+func TestReplaySplitsLargeObjects(t *testing.T) {
+	line := "{\"log\":\"" + strings.Repeat("x", 100*1024) + "\"}\n"
+	store := newFakeStore(map[string]string{"k.gz": strings.Repeat(line, 25)})
+	server := &sumoServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	stats, err := newTestReplayer(store, ts.URL, Config{Bucket: "b"}).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.Records != 25 || stats.Chunks != 3 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	for _, post := range server.posts {
+		if len(post) > maxChunkSize {
+			t.Fatalf("chunk of %d bytes exceeds %d", len(post), maxChunkSize)
+		}
+	}
+}
+
+func TestReplayPostsLongLinesAlone(t *testing.T) {
+	long := "{\"log\":\"" + strings.Repeat("x", maxChunkSize+1024) + "\"}"
+	store := newFakeStore(map[string]string{"k.gz": "{\"n\":1}\n" + long + "\n{\"n\":2}"})
+	server := &sumoServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	stats, err := newTestReplayer(store, ts.URL, Config{Bucket: "b"}).Run(context.Background())
+	if err != nil {
+		t.Fatalf("a line over %d bytes should not stop the replay: %v", maxChunkSize, err)
+	}
+	if stats.Records != 3 || len(server.posts) != 3 || server.posts[1] != long+"\n" {
+		t.Fatalf("the long line should be posted alone, got %+v", stats)
+	}
+}
+
+func TestReplayStopsOnClientError(t *testing.T) {
+	store := newFakeStore(map[string]string{"a.gz": "{}\n", "b.gz": "{}\n"})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+
+	stats, err := newTestReplayer(store, ts.URL, Config{Bucket: "b", CheckpointPath: checkpoint}).Run(context.Background())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if stats.Objects != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Fatal("checkpoint should not be written for a failed object")
+	}
+}
@@ -0,0 +1,321 @@
+package sumoclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
+)
+
+const (
+	// IngestWarningRecordType is sent once per budget period, the first time records go over the limits
+	IngestWarningRecordType = "sumo.ingest.warning"
+	// IngestSummaryRecordType counts the records dropped by a send, per level
+	IngestSummaryRecordType = "sumo.ingest.summary"
+	// failoverReasonOverBudget is recorded on objects holding records over the limits
+	failoverReasonOverBudget = "over_budget"
+	// limitReasonRate and limitReasonBudget tell which limit a record went over
+	limitReasonRate   = "rate_limit"
+	limitReasonBudget = "ingest_budget"
+	// unknownLevel is counted for records without a recognisable level
+	unknownLevel = "unknown"
+)
+
+// logLevels are looked up, in this order, in the first fields of text log lines
+var logLevels = []string{"FATAL", "ERROR", "WARN", "INFO", "DEBUG", "TRACE"}
+
+// tokenBucket allows rate units per second with bursts of a second worth of units
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// fits reports whether n units can be taken at now. More units than the bucket holds fit once it is
+// full, taking them leaves the bucket in debt so the rate still holds on average.
+func (b *tokenBucket) fits(n float64, now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	return n <= b.tokens || b.tokens >= b.rate
+}
+
+// take removes n units, fits must have been checked first
+func (b *tokenBucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+// ingestLimiter enforces the rate limits and ingest budget on function and extension logs. Platform
+// records are always sent, there are only a few per invocation and reports are needed for billing.
+// Limits apply per execution environment, each holding its own limiter: a function running in ten
+// environments sends up to ten times the rate, a daily budget is spent once per environment and starts
+// over when an environment is created.
+type ingestLimiter struct {
+	mu         sync.Mutex
+	cfg        *config.LambdaExtensionConfig
+	bytes      *tokenBucket
+	records    *tokenBucket
+	used       int64
+	period     string
+	warned     bool
+	sampleSeen int
+	now        func() time.Time
+}
+
+// newIngestLimiter returns nil when no limit is configured
+func newIngestLimiter(cfg *config.LambdaExtensionConfig) *ingestLimiter {
+	if cfg.RateLimitBytes <= 0 && cfg.RateLimitRecords <= 0 && cfg.IngestBudgetBytes <= 0 {
+		return nil
+	}
+	now := time.Now()
+	return &ingestLimiter{
+		cfg:     cfg,
+		bytes:   newTokenBucket(cfg.RateLimitBytes, now),
+		records: newTokenBucket(cfg.RateLimitRecords, now),
+		period:  now.UTC().Format("2006-01-02"),
+		now:     time.Now,
+	}
+}
+
+// limitedRecords are the records a send went over the limits with
+type limitedRecords struct {
+	// reason is the first limit records went over
+	reason  string
+	dropped map[string]int
+	bytes   int64
+	// overflow is what the action applies to: every record over the limits for s3, none for sample and summarize
+	overflow responseBody
+}
+
+func (l *limitedRecords) drop(level string, size int) {
+	if l.dropped == nil {
+		l.dropped = make(map[string]int)
+	}
+	l.dropped[level]++
+	l.bytes += int64(size)
+}
+
+// admit returns the records to send and the ones over the limits. The budget counts the bytes of
+// the records as received, before enhancement.
+func (l *ingestLimiter) admit(msgArr responseBody) (responseBody, *limitedRecords, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if l.cfg.IngestBudgetPeriod == config.IngestBudgetDaily {
+		if day := now.UTC().Format("2006-01-02"); day != l.period {
+			l.resetPeriod(day)
+		}
+	}
+	var admitted responseBody
+	var limited limitedRecords
+	for _, item := range msgArr {
+		logType, _ := item["type"].(string)
+		if logType == "platform.start" && l.cfg.IngestBudgetPeriod == config.IngestBudgetInvocation {
+			l.resetPeriod(l.period)
+		}
+		if logType != "function" && logType != "extension" {
+			admitted = append(admitted, item)
+			continue
+		}
+		size := recordSize(item)
+		reason := ""
+		if l.cfg.IngestBudgetBytes > 0 && l.used+int64(size) > l.cfg.IngestBudgetBytes {
+			reason = limitReasonBudget
+		} else if !l.records.fits(1, now) || !l.bytes.fits(float64(size), now) {
+			reason = limitReasonRate
+		} else {
+			// taken from both buckets only once it fits in both, a record over one limit costs nothing
+			l.records.take(1)
+			l.bytes.take(float64(size))
+		}
+		if reason == "" {
+			l.used += int64(size)
+			admitted = append(admitted, item)
+			continue
+		}
+		if limited.reason == "" {
+			limited.reason = reason
+		}
+		switch l.cfg.OverBudgetAction {
+		case config.OverBudgetSample:
+			l.sampleSeen++
+			if (l.sampleSeen-1)%l.cfg.OverBudgetSampleRate == 0 {
+				// samples are sent over the limits, they are few by design
+				admitted = append(admitted, item)
+				continue
+			}
+		case config.OverBudgetS3:
+			limited.overflow = append(limited.overflow, item)
+		}
+		limited.drop(recordLevel(item), size)
+	}
+	if limited.reason == "" {
+		return admitted, nil, false
+	}
+	warn := !l.warned
+	l.warned = true
+	return admitted, &limited, warn
+}
+
+func (l *ingestLimiter) resetPeriod(period string) {
+	l.period = period
+	l.used = 0
+	l.warned = false
+	l.sampleSeen = 0
+}
+
+// recordSize is the size of a record as JSON, the size of the line for text logs
+func recordSize(item map[string]interface{}) int {
+	if record, ok := item["record"].(string); ok {
+		return len(record)
+	}
+	b, err := json.Marshal(item)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+// recordLevel returns the level of a log record, read from the level field of JSON logs or from
+// the first fields of text logs like "2024-01-01T00:00:00.000Z	<request id>	ERROR	message"
+func recordLevel(item map[string]interface{}) string {
+	switch record := item["record"].(type) {
+	case map[string]interface{}:
+		if level, ok := record["level"].(string); ok && level != "" {
+			return strings.ToLower(level)
+		}
+	case string:
+		trimmed := strings.TrimSpace(record)
+		if strings.HasPrefix(trimmed, "{") {
+			var parsed struct {
+				Level string `json:"level"`
+			}
+			if json.Unmarshal([]byte(trimmed), &parsed) == nil && parsed.Level != "" {
+				return strings.ToLower(parsed.Level)
+			}
+		}
+		return lineLevel(trimmed)
+	}
+	return unknownLevel
+}
+
+// lineLevel returns the level of a text log line, looked up in its first fields
+func lineLevel(line string) string {
+	fields := strings.FieldsFunc(line, func(r rune) bool { return r == '\t' || r == ' ' })
+	if len(fields) > 4 {
+		fields = fields[:4]
+	}
+	for _, field := range fields {
+		field = strings.ToUpper(strings.Trim(field, "[]:"))
+		for _, level := range logLevels {
+			if field == level || (level == "WARN" && field == "WARNING") {
+				return strings.ToLower(level)
+			}
+		}
+	}
+	return unknownLevel
+}
+
+// limitIngest applies the rate limits and ingest budget to records, before they are enhanced. Records over
+// the limits are sampled, counted or uploaded to S3 depending on OverBudgetAction, and the records describing
+// what happened are added to the returned ones so it shows in Sumo Logic.
+func (s *sumoLogicClient) limitIngest(msgArr responseBody) responseBody {
+	if s.limiter == nil {
+		return msgArr
+	}
+	admitted, limited, warn := s.limiter.admit(msgArr)
+	if limited == nil {
+		return admitted
+	}
+	timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+	if warn {
+		s.logger.Warnf("limitIngest: Records over the %s, applying %s", limited.reason, s.config.OverBudgetAction)
+		admitted = append(admitted, map[string]interface{}{
+			"time": timestamp,
+			"type": IngestWarningRecordType,
+			"record": map[string]interface{}{
+				"reason":              limited.reason,
+				"action":              s.config.OverBudgetAction,
+				"budgetBytes":         s.config.IngestBudgetBytes,
+				"budgetPeriod":        s.config.IngestBudgetPeriod,
+				"rateLimitBytesSec":   s.config.RateLimitBytes,
+				"rateLimitRecordsSec": s.config.RateLimitRecords,
+			},
+		})
+	}
+	if len(limited.overflow) > 0 {
+		if err := s.uploadOverflow(limited.overflow); err != nil {
+			s.logger.Errorf("limitIngest: Dropping %d records over the limits as upload to S3 failed: %v", len(limited.overflow), err)
+		} else {
+			return admitted
+		}
+	}
+	if len(limited.dropped) > 0 {
+		total := 0
+		for _, count := range limited.dropped {
+			total += count
+		}
+		admitted = append(admitted, map[string]interface{}{
+			"time": timestamp,
+			"type": IngestSummaryRecordType,
+			"record": map[string]interface{}{
+				"reason":            limited.reason,
+				"action":            s.config.OverBudgetAction,
+				"suppressedRecords": total,
+				"suppressedBytes":   limited.bytes,
+				"suppressedLevels":  limited.dropped,
+			},
+		})
+	}
+	return admitted
+}
+
+// uploadOverflow writes records over the limits to the failover bucket, where they can be replayed later.
+// The records are only formatted like sent ones: they were not delivered, so they add no metrics, error
+// summaries or delivery ids.
+func (s *sumoLogicClient) uploadOverflow(records responseBody) error {
+	var payload bytes.Buffer
+	for _, item := range records {
+		if item == nil {
+			continue
+		}
+		s.addSourceFields(item)
+		if logType, _ := item["type"].(string); logType == "function" {
+			message, parsed, err := functionLogLine(item)
+			if err != nil {
+				parsed = nil
+			}
+			item = s.formatFunctionLog(item, message, parsed)
+		}
+		b, err := json.Marshal(item)
+		if err != nil {
+			continue
+		}
+		payload.Write(b)
+		payload.WriteByte('\n')
+	}
+	info := describeChunk(payload.String(), failoverReasonOverBudget)
+	gzippedBuffer, err := utils.CompressBuffer(&payload)
+	if err != nil {
+		return err
+	}
+	return s.uploadToS3(gzippedBuffer, info)
+}
@@ -0,0 +1,50 @@
+package sumoclient
+
+import (
+	"math"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+)
+
+// EstimatedCostField is set on platform.report records with the estimated cost of the invocation
+const EstimatedCostField = "estimatedCostUSD"
+
+// costMetricRule sums the estimated cost of the invocations flushed together, when metrics are sent
+var costMetricRule = config.MetricRule{Name: "lambda.estimatedCostUSD", Type: config.MetricCounter}
+
+// invocationCost returns the cost of an invocation billed for billedDurationMs with memorySizeMB, as
+// GB-seconds at the duration price plus the request price. Ephemeral storage and free tier are not counted.
+func invocationCost(price config.LambdaPrice, billedDurationMs, memorySizeMB float64) float64 {
+	gbSeconds := billedDurationMs / 1000 * memorySizeMB / 1024
+	cost := gbSeconds*price.GBSecond + price.Request
+	// prices have ten decimals, further ones are rounding noise
+	return math.Round(cost*1e10) / 1e10
+}
+
+// estimateCost adds the estimated cost to a platform.report record and to the metrics. Records are left
+// alone when the price table has no price for the region and architecture.
+func (s *sumoLogicClient) estimateCost(item map[string]interface{}) {
+	record, _ := item["record"].(map[string]interface{})
+	metrics, ok := record["metrics"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	billedDurationMs, ok := metrics["billedDurationMs"].(float64)
+	if !ok {
+		return
+	}
+	memorySizeMB, ok := metrics["memorySizeMB"].(float64)
+	if !ok {
+		return
+	}
+	price, ok := s.config.PriceTable.Lookup(s.config.LambdaRegion, functionMetadata.Load().Architecture)
+	if !ok {
+		s.logger.Debugf("estimateCost: No price for %s %s", s.config.LambdaRegion, functionMetadata.Load().Architecture)
+		return
+	}
+	cost := invocationCost(price, billedDurationMs, memorySizeMB)
+	item[EstimatedCostField] = cost
+	if s.metrics != nil {
+		s.metrics.add(&costMetricRule, cost, nil)
+	}
+}
@@ -0,0 +1,107 @@
+package sumoclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
+)
+
+const (
+	// DeadLetterRecordType is the type of the record wrapping a dead letter payload
+	DeadLetterRecordType = "sumo.deadletter"
+	// DeadLetterReasonParseError is used for payloads which are not a JSON array of records, retrying never helps
+	DeadLetterReasonParseError = "parse_error"
+	// DeadLetterReasonMaxAttempts is used for payloads which failed to be sent DeadLetterMaxAttempts times
+	DeadLetterReasonMaxAttempts = "max_attempts"
+	// failoverReasonDeadLetter is recorded on dead letter objects uploaded to S3
+	failoverReasonDeadLetter = "dead_letter"
+	// deadLetterRecordOverhead is kept free in a chunk for the fields wrapping the payload
+	deadLetterRecordOverhead = 1024
+	// maxDeadLetterFileSize stops the dead letter file from filling up /tmp
+	maxDeadLetterFileSize = 64 * 1024 * 1024
+)
+
+// deadLetterRecord wraps a payload so it is sent as text, whatever its content
+func (s *sumoLogicClient) deadLetterRecord(rawmsg []byte, reason string, cause error) ([]byte, error) {
+	message := rawmsg
+	maxMessageSize := s.config.MaxDataPayloadSize - deadLetterRecordOverhead
+	truncated := maxMessageSize > 0 && len(message) > maxMessageSize
+	if truncated {
+		message = message[:maxMessageSize]
+	}
+	record := map[string]interface{}{
+		"time":         time.Now().UTC().Format(time.RFC3339Nano),
+		"type":         DeadLetterRecordType,
+		"reason":       reason,
+		"payloadBytes": len(rawmsg),
+		"truncated":    truncated,
+		"message":      string(message),
+		"logGroup":     s.getLogGroup(),
+		"logStream":    s.getLogStream(),
+		"LayerVersion": config.SumoLogicExtensionLayerVersionSuffix,
+	}
+	if cause != nil {
+		record["error"] = cause.Error()
+	}
+	return json.Marshal(record)
+}
+
+// DeadLetter sends a payload which can not be delivered as is to the configured dead letter target.
+// The payload is never handed back to the caller, so it can not be queued again.
+func (s *sumoLogicClient) DeadLetter(ctx context.Context, rawmsg []byte, reason string, cause error) error {
+	return s.deadLetterTo(ctx, s.config.DeadLetterTarget, rawmsg, reason, cause)
+}
+
+func (s *sumoLogicClient) deadLetterTo(ctx context.Context, target string, rawmsg []byte, reason string, cause error) error {
+	s.deliveryLogger.Warnf("DeadLetter: Sending %d bytes to %s dead letter target, reason: %s", len(rawmsg), target, reason)
+	record, err := s.deadLetterRecord(rawmsg, reason, cause)
+	if err != nil {
+		return fmt.Errorf("DeadLetter - failed to create record: %w", err)
+	}
+	switch target {
+	case config.DeadLetterTargetS3:
+		line := string(record)
+		gzippedBuffer, err := utils.CompressBuffer(bytes.NewBufferString(line))
+		if err != nil {
+			return fmt.Errorf("DeadLetter - failed to compress record: %w", err)
+		}
+		return s.uploadToS3(gzippedBuffer, failoverInfo{records: 1, reason: failoverReasonDeadLetter})
+	case config.DeadLetterTargetFile:
+		return s.appendToDeadLetterFile(record)
+	default:
+		line := string(record)
+		return s.postToSumo(ctx, &line, s.getSourceHeaders(DeadLetterRecordType))
+	}
+}
+
+func (s *sumoLogicClient) appendToDeadLetterFile(record []byte) error {
+	if info, err := os.Stat(s.config.DeadLetterFile); err == nil && info.Size()+int64(len(record)) > maxDeadLetterFileSize {
+		return fmt.Errorf("DeadLetter - dropping record as %s is full", s.config.DeadLetterFile)
+	}
+	file, err := os.OpenFile(s.config.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("DeadLetter - failed to open %s: %w", s.config.DeadLetterFile, err)
+	}
+	_, err = file.Write(append(record, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("DeadLetter - failed to write %s: %w", s.config.DeadLetterFile, err)
+	}
+	return nil
+}
+
+// deadLetterUnparseable dead letters a payload which could not be parsed, failures are only logged
+// since there is nothing else to do with the payload
+func (s *sumoLogicClient) deadLetterUnparseable(ctx context.Context, rawmsg []byte, cause error) {
+	if err := s.DeadLetter(ctx, rawmsg, DeadLetterReasonParseError, cause); err != nil {
+		s.deliveryLogger.Errorf("Dropping unparseable payload of %d bytes: %v", len(rawmsg), err)
+	}
+}
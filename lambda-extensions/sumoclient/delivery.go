@@ -0,0 +1,208 @@
+package sumoclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
+	uuid "github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DeliveryIDField is stamped on every record with SUMO_DELIVERY_IDS, records with the same value in Sumo Logic are duplicates
+	DeliveryIDField = "deliveryId"
+	// DeadLetterReasonRetryOverflow is used for chunks pushed out of the retry list by newer failures
+	DeadLetterReasonRetryOverflow = "retry_overflow"
+	// maxPendingChunks bounds the memory held by chunks waiting to be retried
+	maxPendingChunks = 32
+)
+
+// environmentID identifies this execution environment, each process gets its own
+var environmentID = uuid.NewString()
+
+// deliverySequence numbers the records sent from this execution environment
+var deliverySequence atomic.Uint64
+
+// chunkSequence numbers the chunks created in this execution environment
+var chunkSequence atomic.Uint64
+
+// nextDelivery returns a delivery id unique across execution environments and its sequence number,
+// which grows with each record of this execution environment
+func nextDelivery() (string, uint64) {
+	sequence := deliverySequence.Add(1)
+	return fmt.Sprintf("%s-%d", environmentID, sequence), sequence
+}
+
+// nextChunkID returns the id a chunk is logged with, it stays the same across retries
+func nextChunkID() string {
+	return fmt.Sprintf("%s-c%d", environmentID, chunkSequence.Add(1))
+}
+
+// postStatusError is returned when Sumo Logic answers a post with an error status
+type postStatusError struct {
+	statusCode int
+}
+
+func (e *postStatusError) Error() string {
+	return fmt.Sprintf("statuscode %v", e.statusCode)
+}
+
+// postDelivered returns whether Sumo Logic accepted a post answered with statusCode. Outages answer
+// with 5xx, which have to be retried like any other failure.
+func postDelivered(statusCode int) bool {
+	return (statusCode >= http.StatusOK && statusCode < http.StatusMultipleChoices) || statusCode == http.StatusFound
+}
+
+// retryableDelivery returns whether a chunk which failed to be posted may go through later. Outages,
+// timeouts and throttling pass, other client errors are answered the same way every time.
+func retryableDelivery(err error) bool {
+	var statusErr *postStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode == http.StatusTooManyRequests || statusErr.statusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// ChunkDeliveryError is returned when some chunks could not be delivered. They are kept by the client and
+// retried on the next send, callers must not send the payloads again.
+type ChunkDeliveryError struct {
+	Failed int
+	Total  int
+}
+
+func (e *ChunkDeliveryError) Error() string {
+	return fmt.Sprintf("errors during postToSumo: %d of %d chunks kept for retry", e.Failed, e.Total)
+}
+
+// outgoingChunk is a chunk of enhanced records with the headers it is posted with
+type outgoingChunk struct {
+	id       string
+	payload  string
+	headers  sourceHeaders
+	attempts int
+}
+
+// isMetrics tells whether the chunk holds Carbon 2.0 or Prometheus metrics. Failover objects and dead
+// letters are read as JSON log records and replayed without a content type, so these chunks are kept
+// out of them: they are only sent to the metrics source.
+func (c outgoingChunk) isMetrics() bool {
+	return c.headers.contentType != ""
+}
+
+// pendingChunks holds the chunks waiting to be retried
+type pendingChunks struct {
+	mu     sync.Mutex
+	chunks []outgoingChunk
+}
+
+func (p *pendingChunks) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.chunks)
+}
+
+// take returns the pending chunks and empties the list
+func (p *pendingChunks) take() []outgoingChunk {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	chunks := p.chunks
+	p.chunks = nil
+	return chunks
+}
+
+// keep adds chunks to the list and returns the oldest ones not fitting anymore
+func (p *pendingChunks) keep(chunks []outgoingChunk) []outgoingChunk {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.chunks = append(p.chunks, chunks...)
+	if len(p.chunks) <= maxPendingChunks {
+		return nil
+	}
+	overflow := append([]outgoingChunk(nil), p.chunks[:len(p.chunks)-maxPendingChunks]...)
+	p.chunks = append([]outgoingChunk(nil), p.chunks[len(p.chunks)-maxPendingChunks:]...)
+	return overflow
+}
+
+// sendChunks posts the chunks left over from previous calls, then chunks. Each chunk is tracked on its
+// own: delivered chunks are done with, failed ones are kept and retried on the next call. Only failures
+// which are not retryable count as attempts, a chunk out of attempts is dead lettered, so an outage
+// keeps chunks pending however long it lasts. A failure never sends delivered chunks again.
+func (s *sumoLogicClient) sendChunks(ctx context.Context, chunks []outgoingChunk) error {
+	toSend := s.pending.take()
+	retried := len(toSend)
+	for _, chunk := range chunks {
+		if strings.TrimSpace(chunk.payload) != "" {
+			toSend = append(toSend, chunk)
+		}
+	}
+	if retried > 0 {
+		s.deliveryLogger.Infof("sendChunks: Retrying %d chunks which previously failed", retried)
+	}
+
+	var failed []outgoingChunk
+	for _, chunk := range toSend {
+		chunkLogger := s.deliveryLogger.WithFields(logrus.Fields{
+			utils.LogFieldChunkID: chunk.id,
+			utils.LogFieldAttempt: chunk.attempts + 1,
+		})
+		err := s.postToSumo(ctx, &chunk.payload, chunk.headers)
+		if err == nil {
+			chunkLogger.WithField(utils.LogFieldStatus, "delivered").Debug("sendChunks: Chunk delivered")
+			continue
+		}
+		chunkLogger.WithField(utils.LogFieldStatus, "failed").Warnf("sendChunks: Chunk not delivered: %v", err)
+		if retryableDelivery(err) {
+			failed = append(failed, chunk)
+			continue
+		}
+		chunk.attempts++
+		if s.config.DeadLetterMaxAttempts > 0 && chunk.attempts >= s.config.DeadLetterMaxAttempts {
+			s.deadLetterChunk(ctx, chunk, DeadLetterReasonMaxAttempts, err)
+			continue
+		}
+		failed = append(failed, chunk)
+	}
+	for _, chunk := range s.pending.keep(failed) {
+		s.deadLetterOverflow(ctx, chunk)
+	}
+	if len(failed) > 0 {
+		return &ChunkDeliveryError{Failed: len(failed), Total: len(toSend)}
+	}
+	return nil
+}
+
+func (s *sumoLogicClient) deadLetterChunk(ctx context.Context, chunk outgoingChunk, reason string, cause error) {
+	if chunk.isMetrics() {
+		s.deliveryLogger.Warnf("Dropping metrics chunk of %d bytes after %d attempts: %v", len(chunk.payload), chunk.attempts, cause)
+		return
+	}
+	if err := s.DeadLetter(ctx, []byte(chunk.payload), reason, cause); err != nil {
+		s.deliveryLogger.Errorf("Dropping chunk of %d bytes after %d attempts: %v", len(chunk.payload), chunk.attempts, err)
+	}
+}
+
+// deadLetterOverflow dead letters a chunk pushed out of the retry list. Sumo Logic is likely failing
+// then, so the failover bucket or the dead letter file is used instead of the sumo target.
+func (s *sumoLogicClient) deadLetterOverflow(ctx context.Context, chunk outgoingChunk) {
+	if chunk.isMetrics() {
+		s.deliveryLogger.Warnf("Dropping metrics chunk of %d bytes pushed out of the retry list", len(chunk.payload))
+		return
+	}
+	target := s.config.DeadLetterTarget
+	if target == config.DeadLetterTargetSumo {
+		target = config.DeadLetterTargetFile
+		if s.config.S3BucketName != "" {
+			target = config.DeadLetterTargetS3
+		}
+	}
+	if err := s.deadLetterTo(ctx, target, []byte(chunk.payload), DeadLetterReasonRetryOverflow, nil); err != nil {
+		s.deliveryLogger.Errorf("Dropping chunk of %d bytes pushed out of the retry list: %v", len(chunk.payload), err)
+	}
+}
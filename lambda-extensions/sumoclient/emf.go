@@ -0,0 +1,118 @@
+package sumoclient
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+)
+
+const (
+	// emfMetadataKey holds the metric directives of CloudWatch embedded metric format documents
+	emfMetadataKey = "_aws"
+	// emfNoUnit is the EMF unit of unitless metrics
+	emfNoUnit = "None"
+	// emfNamespaceDimension tags data points with the CloudWatch namespace of their document
+	emfNamespaceDimension = "namespace"
+)
+
+// extractEMF converts the metrics of an embedded metric format document, like the ones printed by
+// aws-embedded-metrics, into data points. A metric is sent once per dimension set of its directive, as
+// CloudWatch does, with the values of the document. It reports whether doc is an EMF document.
+func (s *sumoLogicClient) extractEMF(doc map[string]interface{}) bool {
+	metadata, ok := doc[emfMetadataKey].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	directives, ok := metadata["CloudWatchMetrics"].([]interface{})
+	if !ok {
+		return false
+	}
+	timestamp := time.Now()
+	if ms, ok := metadata["Timestamp"].(float64); ok && ms > 0 {
+		timestamp = time.UnixMilli(int64(ms))
+	}
+	for _, rawDirective := range directives {
+		directive, ok := rawDirective.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		namespace, _ := directive["Namespace"].(string)
+		dimensionSets := emfDimensionSets(directive["Dimensions"], doc)
+		definitions, _ := directive["Metrics"].([]interface{})
+		for _, rawDefinition := range definitions {
+			definition, ok := rawDefinition.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, _ := definition["Name"].(string)
+			unit, _ := definition["Unit"].(string)
+			values := emfValues(doc[name])
+			if name == "" || len(values) == 0 {
+				continue
+			}
+			for _, dimensionSet := range dimensionSets {
+				point := &metricSeries{name: name, kind: config.MetricGauge, unit: unit, timestamp: timestamp}
+				if len(values) > 1 {
+					point.kind = config.MetricHistogram
+				}
+				if namespace != "" {
+					point.dimensions = append(point.dimensions, [2]string{emfNamespaceDimension, namespace})
+				}
+				point.dimensions = append(point.dimensions, dimensionSet...)
+				for _, value := range values {
+					point.add(value)
+				}
+				s.metrics.addPoint(point)
+			}
+		}
+	}
+	return true
+}
+
+// emfDimensionSets returns each dimension set of a directive with the values of doc. Sets naming a
+// dimension missing from doc are skipped as CloudWatch rejects them, no sets is one empty set.
+func emfDimensionSets(raw interface{}, doc map[string]interface{}) [][][2]string {
+	sets, _ := raw.([]interface{})
+	if len(sets) == 0 {
+		return [][][2]string{nil}
+	}
+	var dimensionSets [][][2]string
+	for _, rawSet := range sets {
+		names, ok := rawSet.([]interface{})
+		if !ok {
+			continue
+		}
+		dimensions := make([][2]string, 0, len(names))
+		for _, rawName := range names {
+			name, _ := rawName.(string)
+			value, ok := doc[name]
+			if name == "" || !ok || name == emfNamespaceDimension {
+				dimensions = nil
+				break
+			}
+			dimensions = append(dimensions, [2]string{name, fmt.Sprint(value)})
+		}
+		if dimensions != nil {
+			dimensionSets = append(dimensionSets, dimensions)
+		}
+	}
+	return dimensionSets
+}
+
+// emfValues returns the values of a metric, a number or an array of numbers in EMF documents
+func emfValues(raw interface{}) []float64 {
+	switch v := raw.(type) {
+	case float64:
+		return []float64{v}
+	case []interface{}:
+		values := make([]float64, 0, len(v))
+		for _, item := range v {
+			if value, ok := item.(float64); ok {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package sumoclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// listTagsTimeout bounds the Lambda API call reading the function tags
+const listTagsTimeout = 3 * time.Second
+
+// FunctionMetadata describes the function the extension runs with, it is sent in X-Sumo-Fields
+// when enrichment is enabled
+type FunctionMetadata struct {
+	FunctionArn  string
+	AccountID    string
+	Alias        string
+	MemorySizeMB string
+	Architecture string
+	Runtime      string
+	Tags         map[string]string
+}
+
+// functionMetadata starts with what the environment tells and is completed on the first invocation
+var functionMetadata atomic.Pointer[FunctionMetadata]
+
+var resolveOnce sync.Once
+
+var invalidFieldKeyChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+func init() {
+	metadata := environmentFunctionMetadata()
+	functionMetadata.Store(&metadata)
+}
+
+// environmentFunctionMetadata returns the metadata known before the first invocation
+func environmentFunctionMetadata() FunctionMetadata {
+	architecture := runtime.GOARCH
+	if architecture == "amd64" {
+		// the name Lambda uses
+		architecture = config.ArchitectureX86
+	}
+	return FunctionMetadata{
+		MemorySizeMB: os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"),
+		Architecture: architecture,
+		Runtime:      strings.TrimPrefix(os.Getenv("AWS_EXECUTION_ENV"), "AWS_Lambda_"),
+	}
+}
+
+// ResolveFunctionMetadata completes the metadata from the ARN of the first invocation, later calls have
+// no effect. Tags are read in the background so the invocation is not held up by the Lambda API.
+func ResolveFunctionMetadata(invokedFunctionArn string, cfg *config.LambdaExtensionConfig, logger *logrus.Entry) {
+	resolveOnce.Do(func() {
+		metadata := withFunctionArn(*functionMetadata.Load(), invokedFunctionArn)
+		functionMetadata.Store(&metadata)
+		if cfg.EnableEnrichment && cfg.EnrichWithTags && cfg.TagsReader != nil && metadata.FunctionArn != "" {
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), listTagsTimeout)
+				defer cancel()
+				resolveTags(ctx, cfg.TagsReader, logger)
+			}()
+		}
+	})
+}
+
+// ResolveManagedInstanceMetadata completes the metadata in managed instance mode, where INVOKE events
+// are not received. The ARN is built from the account of the function role and the function name, it is
+// unqualified so {alias} stays unknown. It runs in the background, failures are only logged.
+func ResolveManagedInstanceMetadata(cfg *config.LambdaExtensionConfig, logger *logrus.Entry) {
+	if cfg.IdentityReader == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), listTagsTimeout)
+		defer cancel()
+		arn, err := managedInstanceFunctionArn(ctx, cfg)
+		if err != nil {
+			logger.Warnf("Unable to read the account of the function, {account} stays unknown: %v", err)
+			return
+		}
+		ResolveFunctionMetadata(arn, cfg, logger)
+	}()
+}
+
+// managedInstanceFunctionArn returns the unqualified ARN of the function from its caller identity
+func managedInstanceFunctionArn(ctx context.Context, cfg *config.LambdaExtensionConfig) (string, error) {
+	account, partition, err := cfg.IdentityReader.CallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("arn:%s:lambda:%s:%s:function:%s", partition, cfg.LambdaRegion, account, cfg.FunctionName), nil
+}
+
+// withFunctionArn sets the account and alias from arn:aws:lambda:<region>:<account>:function:<name>[:<qualifier>]
+func withFunctionArn(metadata FunctionMetadata, arn string) FunctionMetadata {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 7 || parts[0] != "arn" {
+		return metadata
+	}
+	metadata.FunctionArn = arn
+	metadata.AccountID = parts[4]
+	if len(parts) > 7 {
+		metadata.Alias = parts[7]
+	}
+	return metadata
+}
+
+// resolveTags reads the tags of the function, the metadata is left without tags on failure
+func resolveTags(ctx context.Context, reader utils.FunctionTagsReader, logger *logrus.Entry) {
+	// tags are read for the unqualified function, they can not be set on an alias or version
+	arn := functionMetadata.Load().FunctionArn
+	if parts := strings.Split(arn, ":"); len(parts) > 7 {
+		arn = strings.Join(parts[:7], ":")
+	}
+	tags, err := reader.ListTags(ctx, arn)
+	if err != nil {
+		logger.Warnf("Unable to read function tags for enrichment, is lambda:ListTags allowed? %v", err)
+		return
+	}
+	metadata := *functionMetadata.Load()
+	metadata.Tags = tags
+	functionMetadata.Store(&metadata)
+	logger.Debugf("Resolved %d function tags for enrichment", len(tags))
+}
+
+// enrichmentFields returns the function metadata as X-Sumo-Fields pairs, fields set in SUMO_FIELDS win
+func (s *sumoLogicClient) enrichmentFields() []string {
+	metadata := functionMetadata.Load()
+	values := map[string]string{
+		"functionArn":  metadata.FunctionArn,
+		"account":      metadata.AccountID,
+		"alias":        metadata.Alias,
+		"memorySize":   metadata.MemorySizeMB,
+		"architecture": metadata.Architecture,
+		"runtime":      metadata.Runtime,
+	}
+	for key, value := range metadata.Tags {
+		if len(s.config.EnrichmentTagKeys) > 0 && !utils.StringInSlice(key, s.config.EnrichmentTagKeys) {
+			continue
+		}
+		values[invalidFieldKeyChars.ReplaceAllString(key, "_")] = value
+	}
+	for _, field := range s.config.SumoFields {
+		delete(values, field.Key)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key, value := range values {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	// sorted so the headers of records of the same type are equal and end up in the same chunk
+	sort.Strings(keys)
+	fields := make([]string, 0, len(keys))
+	for _, key := range keys {
+		fields = append(fields, key+"="+strings.NewReplacer(",", "_", "=", "_").Replace(values[key]))
+	}
+	return fields
+}
@@ -0,0 +1,336 @@
+package sumoclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
+)
+
+const (
+	// ErrorSummaryRecordType is added after each invocation which logged errors
+	ErrorSummaryRecordType = "sumo.error.summary"
+	// SeverityField is the normalised level of function records
+	SeverityField = "severity"
+	// ErrorFingerprintField identifies the signature of an error, it does not change with IDs or line numbers
+	ErrorFingerprintField = "errorFingerprint"
+	// ErrorTypeField is the exception or error class of an error, when one is found
+	ErrorTypeField = "errorType"
+	// maxErrorSignatures bounds the signatures of a summary, further errors are only counted
+	maxErrorSignatures = 20
+	// maxErrorSampleLength bounds the message kept as an example of a signature
+	maxErrorSampleLength = 256
+	// maxTrackedInvocations bounds the invocations with errors waiting for their report, reports went
+	// missing when it is reached and every invocation is summarised
+	maxTrackedInvocations = 1000
+)
+
+var (
+	// exceptionPattern matches error classes like TypeError, java.io.IOException or botocore.exceptions.ClientError
+	exceptionPattern = regexp.MustCompile(`\b([A-Za-z_][\w.$]*(?:Error|Exception|Fault))\b`)
+	// stackFramePattern matches Java and Node.js "at" frames, Python "File" frames and Go file lines
+	stackFramePattern = regexp.MustCompile(`^\s*(?:at\s|File\s"|\S+\.go:\d+)`)
+	// signatureNoisePattern matches what changes between occurrences of an error: line and column numbers,
+	// addresses, UUIDs and other numbers
+	signatureNoisePattern = regexp.MustCompile(`(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}|\bline \d+|0x[0-9a-f]+|\d+`)
+	// quotedPattern matches quoted values of error messages, which usually hold IDs or keys
+	quotedPattern = regexp.MustCompile(`"[^"]*"|'[^']*'`)
+	// requestIDPrefixPattern matches the request id of the "<time>\t<request id>\t<level>\t" prefix of text logs
+	requestIDPrefixPattern = regexp.MustCompile(`^\S+\t([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})\t`)
+)
+
+// errorInfo describes an error found in a function log line
+type errorInfo struct {
+	errorType string
+	message   string
+	frames    []string
+}
+
+// fingerprint hashes the error type with the stack frames, or with the message for errors without
+// a stack, once what changes between occurrences is stripped
+func (e *errorInfo) fingerprint() string {
+	var signature strings.Builder
+	signature.WriteString(e.errorType)
+	if len(e.frames) > 0 {
+		for _, frame := range e.frames {
+			signature.WriteString("\n")
+			signature.WriteString(normaliseSignature(frame))
+		}
+	} else {
+		signature.WriteString("\n")
+		signature.WriteString(normaliseSignature(quotedPattern.ReplaceAllString(e.message, `""`)))
+	}
+	sum := sha256.Sum256([]byte(signature.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+func normaliseSignature(value string) string {
+	return strings.Join(strings.Fields(signatureNoisePattern.ReplaceAllString(value, "")), " ")
+}
+
+// detectSeverity returns the severity of a function log line, parsed is its JSON content or nil, and
+// describes it when it is an error. Errors are found from the level of the line, from the error JSON the
+// runtimes log for unhandled errors, or from tracebacks and exceptions in lines without a level.
+func detectSeverity(message string, parsed map[string]interface{}) (string, *errorInfo) {
+	level := unknownLevel
+	runtimeError := parsed
+	if parsed != nil {
+		if value, ok := parsed["level"].(string); ok && value != "" {
+			level = normaliseLevel(value)
+		}
+	} else {
+		level = lineLevel(message)
+		// runtimes log unhandled errors as a text prefix followed by the error JSON
+		if idx := strings.Index(message, `{"errorType"`); idx >= 0 {
+			runtimeError, _ = utils.ParseJson(message[idx:])
+		}
+	}
+	if errorType, ok := runtimeError["errorType"].(string); ok && errorType != "" {
+		info := &errorInfo{errorType: errorType}
+		info.message, _ = runtimeError["errorMessage"].(string)
+		if trace, ok := runtimeError["stackTrace"].([]interface{}); ok {
+			for _, frame := range trace {
+				info.frames = append(info.frames, fmt.Sprint(frame))
+			}
+		}
+		if level != "fatal" {
+			level = "error"
+		}
+		return level, info
+	}
+
+	text := message
+	if parsed != nil {
+		text = ""
+		for _, key := range []string{"message", "msg", "error", "stack"} {
+			if value, ok := parsed[key].(string); ok {
+				text += value + "\n"
+			}
+		}
+	}
+	info := textError(text)
+	switch level {
+	case "error", "fatal":
+		if info.message == "" {
+			info.message = message
+		}
+		return level, info
+	case unknownLevel:
+		if info.errorType != "" && (len(info.frames) > 0 || strings.Contains(text, "Traceback (most recent call last)")) {
+			return "error", info
+		}
+	}
+	return level, nil
+}
+
+// textError reads the error type, message and stack frames of a text error
+func textError(text string) *errorInfo {
+	info := &errorInfo{}
+	lines := strings.Split(text, "\n")
+	for idx := 0; idx < len(lines); idx++ {
+		line := strings.TrimRight(lines[idx], "\r")
+		if stackFramePattern.MatchString(line) {
+			info.frames = append(info.frames, strings.TrimSpace(line))
+			next := idx + 1
+			if strings.HasPrefix(strings.TrimSpace(line), `File "`) && next < len(lines) &&
+				strings.HasPrefix(lines[next], " ") && !stackFramePattern.MatchString(lines[next]) {
+				// Python frames are followed by their indented source line when it is available
+				idx = next
+			}
+			continue
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "Traceback") {
+			continue
+		}
+		if match := exceptionPattern.FindStringSubmatch(line); match != nil && info.errorType == "" {
+			info.errorType = match[1]
+			info.message = strings.TrimSpace(line)
+		}
+	}
+	if info.message == "" && len(lines) > 0 {
+		info.message = strings.TrimSpace(lines[0])
+	}
+	return info
+}
+
+func normaliseLevel(level string) string {
+	switch level = strings.ToLower(level); level {
+	case "warning":
+		return "warn"
+	case "err":
+		return "error"
+	case "critical", "panic":
+		return "fatal"
+	}
+	return level
+}
+
+// tagSeverity adds the severity of a function record and, for errors, their fingerprint, counted in the summary
+// of the invocation
+func (s *sumoLogicClient) tagSeverity(record map[string]interface{}, message string, parsed map[string]interface{}) {
+	severity, info := detectSeverity(message, parsed)
+	if severity != unknownLevel {
+		record[SeverityField] = severity
+	}
+	if info == nil {
+		return
+	}
+	fingerprint := info.fingerprint()
+	record[ErrorFingerprintField] = fingerprint
+	if info.errorType != "" {
+		record[ErrorTypeField] = info.errorType
+	}
+	s.errorSummary.add(logRequestID(message, parsed), info, fingerprint)
+}
+
+// logRequestID returns the request id of a function log line, from its JSON or its text prefix, or ""
+func logRequestID(message string, parsed map[string]interface{}) string {
+	if requestID, ok := parsed["requestId"].(string); ok {
+		return requestID
+	}
+	return TextLogRequestID(message)
+}
+
+// TextLogRequestID returns the request id of a text log line from its "<time>\t<request id>\t" prefix, or ""
+func TextLogRequestID(line string) string {
+	if match := requestIDPrefixPattern.FindStringSubmatch(line); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// errorSignature counts the errors of an invocation with one fingerprint
+type errorSignature struct {
+	Fingerprint string `json:"fingerprint"`
+	ErrorType   string `json:"errorType,omitempty"`
+	Count       int    `json:"count"`
+	// Sample is the message of the first error
+	Sample string `json:"sample"`
+}
+
+// invocationErrors aggregates the errors of one invocation
+type invocationErrors struct {
+	count         int
+	signatures    []*errorSignature
+	byFingerprint map[string]*errorSignature
+}
+
+// errorTracker aggregates the errors of each invocation by request id, a summary is made when it ends.
+// Invocations run concurrently in managed instance mode, errors of lines without a request id are counted
+// for the invocation which started last.
+type errorTracker struct {
+	mu          sync.Mutex
+	current     string
+	invocations map[string]*invocationErrors
+	// done holds the summaries of the invocations which ended since the last send
+	done responseBody
+}
+
+// newErrorTracker returns nil when error detection is disabled
+func newErrorTracker(cfg *config.LambdaExtensionConfig) *errorTracker {
+	if !cfg.ErrorDetection {
+		return nil
+	}
+	return &errorTracker{invocations: make(map[string]*invocationErrors)}
+}
+
+// start begins the invocation of requestID
+func (t *errorTracker) start(requestID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.current = requestID
+}
+
+// end summarises the invocation of requestID
+func (t *errorTracker) end(requestID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if requestID == "" {
+		requestID = t.current
+	}
+	t.summarise(requestID)
+	if requestID == t.current {
+		t.current = ""
+	}
+}
+
+// add counts an error of the invocation of requestID, of the current invocation when it is empty
+func (t *errorTracker) add(requestID string, info *errorInfo, fingerprint string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if requestID == "" {
+		requestID = t.current
+	}
+	invocation, ok := t.invocations[requestID]
+	if !ok {
+		if len(t.invocations) >= maxTrackedInvocations {
+			t.summariseAll()
+		}
+		invocation = &invocationErrors{byFingerprint: make(map[string]*errorSignature)}
+		t.invocations[requestID] = invocation
+	}
+	invocation.count++
+	if signature, ok := invocation.byFingerprint[fingerprint]; ok {
+		signature.Count++
+		return
+	}
+	if len(invocation.signatures) >= maxErrorSignatures {
+		return
+	}
+	sample := info.message
+	if len(sample) > maxErrorSampleLength {
+		sample = sample[:maxErrorSampleLength]
+	}
+	signature := &errorSignature{Fingerprint: fingerprint, ErrorType: info.errorType, Count: 1, Sample: sample}
+	invocation.signatures = append(invocation.signatures, signature)
+	invocation.byFingerprint[fingerprint] = signature
+}
+
+// summarise adds the summary of the invocation of requestID to done, t.mu must be held
+func (t *errorTracker) summarise(requestID string) {
+	invocation, ok := t.invocations[requestID]
+	if !ok {
+		return
+	}
+	delete(t.invocations, requestID)
+	t.done = append(t.done, map[string]interface{}{
+		"time": time.Now().UTC().Format(time.RFC3339Nano),
+		"type": ErrorSummaryRecordType,
+		"record": map[string]interface{}{
+			"requestId":  requestID,
+			"errorCount": invocation.count,
+			"signatures": invocation.signatures,
+		},
+	})
+}
+
+// summariseAll summarises every invocation, t.mu must be held
+func (t *errorTracker) summariseAll() {
+	requestIDs := make([]string, 0, len(t.invocations))
+	for requestID := range t.invocations {
+		requestIDs = append(requestIDs, requestID)
+	}
+	sort.Strings(requestIDs)
+	for _, requestID := range requestIDs {
+		t.summarise(requestID)
+	}
+}
+
+// take returns the summaries of the ended invocations, with the running ones when force is set
+func (t *errorTracker) take(force bool) responseBody {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if force {
+		t.summariseAll()
+	}
+	done := t.done
+	t.done = nil
+	return done
+}
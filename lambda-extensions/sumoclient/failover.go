@@ -0,0 +1,136 @@
+package sumoclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
+
+	uuid "github.com/google/uuid"
+)
+
+const (
+	// failoverReasonPostFailed is recorded when a chunk could not be posted after all retries
+	failoverReasonPostFailed = "post_failed"
+	// failoverReasonFlush is recorded when the queue is flushed straight to S3 during shutdown
+	failoverReasonFlush = "shutdown_flush"
+	// FailoverContentType is the content type of failover objects, one JSON record per line
+	FailoverContentType = "application/x-ndjson"
+)
+
+// S3 object metadata keys set on failover objects, stored as x-amz-meta-<key>
+const (
+	MetadataRecordCount    = "record-count"
+	MetadataFirstTimestamp = "first-timestamp"
+	MetadataLastTimestamp  = "last-timestamp"
+	MetadataLayerVersion   = "layer-version"
+	MetadataReason         = "reason"
+)
+
+// failoverInfo describes the records of a failover object
+type failoverInfo struct {
+	records        int
+	firstTimestamp string
+	lastTimestamp  string
+	reason         string
+}
+
+func (f failoverInfo) metadata() map[string]string {
+	metadata := map[string]string{
+		MetadataRecordCount:  strconv.Itoa(f.records),
+		MetadataLayerVersion: config.SumoLogicExtensionLayerVersionSuffix,
+		MetadataReason:       f.reason,
+	}
+	if f.firstTimestamp != "" {
+		metadata[MetadataFirstTimestamp] = f.firstTimestamp
+		metadata[MetadataLastTimestamp] = f.lastTimestamp
+	}
+	return metadata
+}
+
+// describeChunk counts the records of a newline delimited payload and finds its first and last timestamp.
+// It is only called on the failover path so the extra parsing does not slow down regular posts.
+func describeChunk(payload string, reason string) failoverInfo {
+	info := failoverInfo{reason: reason}
+	for _, line := range strings.Split(payload, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		info.records++
+		var record struct {
+			Time string `json:"time"`
+		}
+		if json.Unmarshal([]byte(line), &record) != nil || record.Time == "" {
+			continue
+		}
+		// Telemetry API timestamps are RFC 3339 in UTC, they sort as strings
+		if info.firstTimestamp == "" || record.Time < info.firstTimestamp {
+			info.firstTimestamp = record.Time
+		}
+		if record.Time > info.lastTimestamp {
+			info.lastTimestamp = record.Time
+		}
+	}
+	return info
+}
+
+// getS3KeyName returns the key by combining function name, version, date and uuid(version 1)
+// With the hive layout every path element is a key=value partition, so the bucket can be queried with Athena.
+func (s *sumoLogicClient) getS3KeyName() (string, error) {
+	currentTime := time.Now().UTC()
+	uniqueID, err := uuid.NewUUID()
+	if err != nil {
+		return "", err
+	}
+	// common prefix where all lambda logs will go
+	if s.config.S3PartitionLayout == config.S3PartitionLayoutHive {
+		key := fmt.Sprintf("%s/region=%s/function=%s/version=%s/year=%d/month=%02d/day=%02d/hour=%02d/minute=%02d/%v.gz", config.ExtensionName, s.config.LambdaRegion, s.config.FunctionName, s.config.FunctionVersion,
+			currentTime.Year(), currentTime.Month(), currentTime.Day(),
+			currentTime.Hour(), currentTime.Minute(), uniqueID)
+		return key, nil
+	}
+
+	key := fmt.Sprintf("%s/%s/%s/%s/%d/%02d/%02d/%02d/%d/%v.gz", config.ExtensionName, s.config.LambdaRegion, s.config.FunctionName, s.config.FunctionVersion,
+		currentTime.Year(), currentTime.Month(), currentTime.Day(),
+		currentTime.Hour(), currentTime.Minute(), uniqueID)
+
+	return key, nil
+}
+
+func (s *sumoLogicClient) failoverHandler(buf *bytes.Buffer, info failoverInfo) error {
+
+	if s.config.EnableFailover {
+		return s.uploadToS3(buf, info)
+	}
+	return nil
+}
+
+// uploadToS3 writes a gzipped chunk to the failover bucket
+func (s *sumoLogicClient) uploadToS3(buf *bytes.Buffer, info failoverInfo) error {
+	s.deliveryLogger.Debug("Trying to Send to S3")
+	keyName, err := s.getS3KeyName()
+	if err != nil {
+		return err
+	}
+	if s.config.S3Uploader == nil {
+		return errors.New("no S3 uploader configured")
+	}
+	err = s.config.S3Uploader.Upload(context.TODO(), s.config.S3BucketName, keyName, buf, utils.S3ObjectOptions{
+		ContentType:     FailoverContentType,
+		ContentEncoding: "gzip",
+		Metadata:        info.metadata(),
+		SSEKMSKeyID:     s.config.S3KMSKeyId,
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to send to s3 bucket %s path %s: %w", s.config.S3BucketName, keyName, err)
+	}
+	return err
+}
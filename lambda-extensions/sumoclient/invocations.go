@@ -0,0 +1,185 @@
+package sumoclient
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+)
+
+const (
+	// InvocationFailureRecordType is sent for invocations which timed out or ran out of memory
+	InvocationFailureRecordType = "lambda.invocation.failure"
+	// InvocationWarningRecordType is sent for invocations close to their timeout or memory size
+	InvocationWarningRecordType = "lambda.invocation.warning"
+)
+
+// Reasons of invocation failure and warning records
+const (
+	FailureReasonTimeout      = "timeout"
+	FailureReasonOutOfMemory  = "out_of_memory"
+	WarningReasonTimeoutUsage = "timeout_threshold"
+	WarningReasonMemoryUsage  = "memory_threshold"
+)
+
+const (
+	// failureSeverity and warningSeverity are the severity of failure and warning records
+	failureSeverity = "fatal"
+	warningSeverity = "warn"
+	// outOfMemoryErrorTypeSuffix ends the error type of invocations killed for lack of memory, Runtime.OutOfMemory
+	outOfMemoryErrorTypeSuffix = "OutOfMemory"
+	// maxTrackedRuntimeDoneEvents bounds the runtimeDone statuses waiting for their report
+	maxTrackedRuntimeDoneEvents = 1000
+)
+
+// functionTimeoutMs is the function timeout, estimated from the deadline of invocations as Lambda does
+// not tell it to extensions. It is 0 until the first invocation.
+var functionTimeoutMs atomic.Int64
+
+// ObserveInvokeDeadline estimates the function timeout from the deadline of an INVOKE event received now.
+// Timeouts are whole seconds, the time taken to deliver the event is rounded away.
+func ObserveInvokeDeadline(deadlineMs int64) {
+	remaining := deadlineMs - time.Now().UnixMilli()
+	if remaining <= 0 {
+		return
+	}
+	estimate := int64(math.Ceil(float64(remaining)/1000)) * 1000
+	for {
+		current := functionTimeoutMs.Load()
+		if estimate <= current || functionTimeoutMs.CompareAndSwap(current, estimate) {
+			return
+		}
+	}
+}
+
+// runtimeOutcome is what platform.runtimeDone tells about an invocation, kept until its report
+type runtimeOutcome struct {
+	status    string
+	errorType string
+}
+
+// invocationMonitor finds the invocations which failed from timeouts or lack of memory, and the ones
+// using more of their timeout or memory than the configured thresholds
+type invocationMonitor struct {
+	mu          sync.Mutex
+	cfg         *config.LambdaExtensionConfig
+	runtimeDone map[string]runtimeOutcome
+	// done holds the records of the invocations reported since the last send
+	done responseBody
+}
+
+// newInvocationMonitor returns nil when failure detection is disabled
+func newInvocationMonitor(cfg *config.LambdaExtensionConfig) *invocationMonitor {
+	if !cfg.FailureDetection {
+		return nil
+	}
+	return &invocationMonitor{cfg: cfg, runtimeDone: make(map[string]runtimeOutcome)}
+}
+
+// observeRuntimeDone keeps the status of a platform.runtimeDone record, older schemas only report timeouts there
+func (m *invocationMonitor) observeRuntimeDone(record map[string]interface{}) {
+	requestID, _ := record["requestId"].(string)
+	status, _ := record["status"].(string)
+	if requestID == "" || status == "" || status == "success" {
+		return
+	}
+	errorType, _ := record["errorType"].(string)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.runtimeDone) >= maxTrackedRuntimeDoneEvents {
+		// reports went missing, their gaps are flagged by the request tracker
+		m.runtimeDone = make(map[string]runtimeOutcome)
+	}
+	m.runtimeDone[requestID] = runtimeOutcome{status: status, errorType: errorType}
+}
+
+// observeReport checks a platform.report record, timestamp is the time of the report
+func (m *invocationMonitor) observeReport(record map[string]interface{}, timestamp string) {
+	if synthetic, _ := record["synthetic"].(bool); synthetic {
+		return
+	}
+	requestID, _ := record["requestId"].(string)
+	status, _ := record["status"].(string)
+	errorType, _ := record["errorType"].(string)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if outcome, ok := m.runtimeDone[requestID]; ok {
+		if status == "" || status == "success" {
+			status = outcome.status
+		}
+		if errorType == "" {
+			errorType = outcome.errorType
+		}
+		delete(m.runtimeDone, requestID)
+	}
+
+	metrics, _ := record["metrics"].(map[string]interface{})
+	durationMs, _ := metrics["durationMs"].(float64)
+	memorySizeMB, _ := metrics["memorySizeMB"].(float64)
+	maxMemoryUsedMB, _ := metrics["maxMemoryUsedMB"].(float64)
+	timeoutMs := float64(functionTimeoutMs.Load())
+
+	details := map[string]interface{}{"requestId": requestID, "durationMs": durationMs}
+	if status != "" {
+		details["status"] = status
+	}
+	if errorType != "" {
+		details["errorType"] = errorType
+	}
+	var timeoutUsed, memoryUsed float64
+	if timeoutMs > 0 {
+		timeoutUsed = durationMs * 100 / timeoutMs
+		details["timeoutMs"] = timeoutMs
+		details["timeoutUsedPercent"] = math.Round(timeoutUsed*10) / 10
+	}
+	if memorySizeMB > 0 {
+		memoryUsed = maxMemoryUsedMB * 100 / memorySizeMB
+		details["memorySizeMB"] = memorySizeMB
+		details["maxMemoryUsedMB"] = maxMemoryUsedMB
+		details["memoryHeadroomMB"] = memorySizeMB - maxMemoryUsedMB
+		details["memoryUsedPercent"] = math.Round(memoryUsed*10) / 10
+	}
+
+	switch {
+	case status == FailureReasonTimeout || (timeoutMs > 0 && durationMs >= timeoutMs):
+		m.add(InvocationFailureRecordType, FailureReasonTimeout, failureSeverity, details, timestamp)
+	case strings.HasSuffix(errorType, outOfMemoryErrorTypeSuffix) || (memorySizeMB > 0 && maxMemoryUsedMB >= memorySizeMB):
+		m.add(InvocationFailureRecordType, FailureReasonOutOfMemory, failureSeverity, details, timestamp)
+	default:
+		if m.cfg.TimeoutWarningPercent > 0 && timeoutMs > 0 && timeoutUsed >= float64(m.cfg.TimeoutWarningPercent) {
+			m.add(InvocationWarningRecordType, WarningReasonTimeoutUsage, warningSeverity, details, timestamp)
+		}
+		if m.cfg.MemoryWarningPercent > 0 && memorySizeMB > 0 && memoryUsed >= float64(m.cfg.MemoryWarningPercent) {
+			m.add(InvocationWarningRecordType, WarningReasonMemoryUsage, warningSeverity, details, timestamp)
+		}
+	}
+}
+
+// add queues a record, m.mu must be held
+func (m *invocationMonitor) add(recordType, reason, severity string, details map[string]interface{}, timestamp string) {
+	record := map[string]interface{}{"reason": reason}
+	for key, value := range details {
+		record[key] = value
+	}
+	if timestamp == "" {
+		timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	m.done = append(m.done, map[string]interface{}{
+		"time":        timestamp,
+		"type":        recordType,
+		SeverityField: severity,
+		"record":      record,
+	})
+}
+
+// take returns the records of the invocations reported since the last call
+func (m *invocationMonitor) take() responseBody {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	done := m.done
+	m.done = nil
+	return done
+}
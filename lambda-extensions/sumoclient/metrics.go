@@ -0,0 +1,371 @@
+package sumoclient
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+)
+
+const (
+	// MetricsRecordType is the type of the EMF records holding extracted metrics
+	MetricsRecordType = "sumo.metrics"
+	// metricsNamespace is the CloudWatch namespace of EMF records
+	metricsNamespace = "SumoLogicExtension"
+	// maxMetricsAge flushes metrics when no invocation end is seen, like with overlapping invocations
+	maxMetricsAge = time.Minute
+	// maxEMFValues is the most values an EMF metric can hold
+	maxEMFValues = 100
+	// Content types of Sumo Logic metrics posts
+	carbon2ContentType    = "application/vnd.sumologic.carbon2"
+	prometheusContentType = "application/vnd.sumologic.prometheus"
+)
+
+var prometheusNamePattern = regexp.MustCompile(`[^A-Za-z0-9_:]`)
+
+// metricSeries aggregates the values of a metric with one set of dimensions
+type metricSeries struct {
+	name       string
+	kind       string
+	dimensions [][2]string
+	count      int
+	sum        float64
+	min        float64
+	max        float64
+	last       float64
+	values     []float64
+	// unit and timestamp are set for data points read from EMF documents
+	unit      string
+	timestamp time.Time
+}
+
+// at returns the time of the series, now unless it was read from a document
+func (m *metricSeries) at(now time.Time) time.Time {
+	if m.timestamp.IsZero() {
+		return now
+	}
+	return m.timestamp
+}
+
+func (m *metricSeries) add(value float64) {
+	if m.count == 0 || value < m.min {
+		m.min = value
+	}
+	if m.count == 0 || value > m.max {
+		m.max = value
+	}
+	m.count++
+	m.sum += value
+	m.last = value
+	if len(m.values) < maxEMFValues {
+		m.values = append(m.values, value)
+	}
+}
+
+// metricStat is a value sent for a series, stat is empty for counters and gauges
+type metricStat struct {
+	stat  string
+	value float64
+}
+
+// stats returns the values sent for the series, histograms are sent as one series per statistic
+func (m *metricSeries) stats() []metricStat {
+	switch m.kind {
+	case config.MetricGauge:
+		return []metricStat{{"", m.last}}
+	case config.MetricHistogram:
+		return []metricStat{{"count", float64(m.count)}, {"sum", m.sum}, {"min", m.min}, {"max", m.max}}
+	default:
+		return []metricStat{{"", m.sum}}
+	}
+}
+
+// metricAggregator holds the metrics extracted since the last flush, usually the current invocation
+type metricAggregator struct {
+	mu     sync.Mutex
+	series map[string]*metricSeries
+	// points are data points from EMF documents, they keep their own timestamp and are not aggregated
+	points  []*metricSeries
+	started time.Time
+	// ended is set when an invocation end was seen, metrics are flushed with the next send
+	ended bool
+}
+
+func newMetricAggregator(cfg *config.LambdaExtensionConfig) *metricAggregator {
+	if len(cfg.MetricRules) == 0 && !cfg.EnableEMFMetrics {
+		return nil
+	}
+	return &metricAggregator{series: make(map[string]*metricSeries)}
+}
+
+func (a *metricAggregator) add(rule *config.MetricRule, value float64, dimensions [][2]string) {
+	sort.Slice(dimensions, func(i, j int) bool { return dimensions[i][0] < dimensions[j][0] })
+	var key strings.Builder
+	key.WriteString(rule.Name)
+	for _, dimension := range dimensions {
+		fmt.Fprintf(&key, ",%s=%s", dimension[0], dimension[1])
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.empty() {
+		a.started = time.Now()
+	}
+	series, ok := a.series[key.String()]
+	if !ok {
+		series = &metricSeries{name: rule.Name, kind: rule.Type, dimensions: dimensions}
+		a.series[key.String()] = series
+	}
+	series.add(value)
+}
+
+// addPoint holds a data point read from an EMF document until the next flush
+func (a *metricAggregator) addPoint(point *metricSeries) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.empty() {
+		a.started = time.Now()
+	}
+	a.points = append(a.points, point)
+}
+
+func (a *metricAggregator) empty() bool {
+	return len(a.series) == 0 && len(a.points) == 0
+}
+
+// invocationEnded marks the metrics as complete for the current invocation
+func (a *metricAggregator) invocationEnded() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ended = true
+}
+
+// take returns the series to flush, all of them when force is set, and starts a new aggregation
+func (a *metricAggregator) take(force bool) []*metricSeries {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.empty() || !(force || a.ended || time.Since(a.started) >= maxMetricsAge) {
+		a.ended = false
+		return nil
+	}
+	series := make([]*metricSeries, 0, len(a.series))
+	for _, s := range a.series {
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool { return metricKeyLess(series[i], series[j]) })
+	series = append(series, a.points...)
+	a.series = make(map[string]*metricSeries)
+	a.points = nil
+	a.ended = false
+	return series
+}
+
+func metricKeyLess(a, b *metricSeries) bool {
+	if a.name != b.name {
+		return a.name < b.name
+	}
+	return fmt.Sprint(a.dimensions) < fmt.Sprint(b.dimensions)
+}
+
+// extractMetrics evaluates the metric rules on a function log line, parsed is its JSON content or nil.
+// It reports whether the line has to be dropped, which only happens when a dropping rule matched.
+func (s *sumoLogicClient) extractMetrics(message string, parsed map[string]interface{}) bool {
+	drop := false
+	for idx := range s.config.MetricRules {
+		rule := &s.config.MetricRules[idx]
+		var value float64
+		var dimensions [][2]string
+		if pattern := rule.Pattern(); pattern != nil {
+			match := pattern.FindStringSubmatch(message)
+			if match == nil {
+				continue
+			}
+			value = 1
+			valueGroup := rule.ValueGroup()
+			for group, name := range pattern.SubexpNames() {
+				if group == 0 || name == "" {
+					continue
+				}
+				if group == valueGroup {
+					var err error
+					if value, err = strconv.ParseFloat(match[group], 64); err != nil {
+						value = math.NaN()
+					}
+					continue
+				}
+				dimensions = append(dimensions, [2]string{name, match[group]})
+			}
+		} else {
+			found, ok := metricValue(lookupPath(parsed, rule.JSONPath))
+			if !ok {
+				continue
+			}
+			value = found
+			for _, path := range rule.Dimensions {
+				if dimension := lookupPath(parsed, path); dimension != nil {
+					dimensions = append(dimensions, [2]string{path, fmt.Sprint(dimension)})
+				}
+			}
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		s.metrics.add(rule, value, dimensions)
+		drop = drop || rule.Drop
+	}
+	return drop
+}
+
+// lookupPath returns the value at a dotted path of a JSON object, nil when it is missing
+func lookupPath(parsed map[string]interface{}, path string) interface{} {
+	var current interface{} = parsed
+	for _, key := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = object[key]
+	}
+	return current
+}
+
+// metricValue converts a JSON value to a metric value, numeric strings are accepted
+func metricValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		return parsed, err == nil
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// metricsOutput returns the metrics to flush, as records for EMF or as a chunk for the other formats
+func (s *sumoLogicClient) metricsOutput(force bool) (responseBody, []outgoingChunk) {
+	if s.metrics == nil {
+		return nil, nil
+	}
+	series := s.metrics.take(force)
+	if len(series) == 0 {
+		return nil, nil
+	}
+	now := time.Now()
+	if s.config.MetricsFormat == config.MetricsFormatEMF {
+		records := s.emfRecords(series, now)
+		s.enhanceLogs(records)
+		return records, nil
+	}
+	var lines []string
+	contentType := carbon2ContentType
+	for _, m := range series {
+		for _, stat := range m.stats() {
+			if s.config.MetricsFormat == config.MetricsFormatPrometheus {
+				lines = append(lines, s.prometheusLine(m, stat, now))
+				contentType = prometheusContentType
+			} else {
+				lines = append(lines, s.carbon2Line(m, stat, now))
+			}
+		}
+	}
+	headers := s.getSourceHeaders(MetricsRecordType)
+	headers.contentType = contentType
+	return nil, []outgoingChunk{{id: nextChunkID(), payload: strings.Join(lines, "\n"), headers: headers}}
+}
+
+// carbon2Line formats a metric as "metric=<name> <tag>=<value>  <value> <epoch seconds>"
+func (s *sumoLogicClient) carbon2Line(m *metricSeries, stat metricStat, now time.Time) string {
+	var line strings.Builder
+	fmt.Fprintf(&line, "metric=%s function=%s", carbon2Value(m.name), carbon2Value(s.config.FunctionName))
+	if stat.stat != "" {
+		fmt.Fprintf(&line, " stat=%s", stat.stat)
+	}
+	for _, dimension := range m.dimensions {
+		fmt.Fprintf(&line, " %s=%s", carbon2Value(dimension[0]), carbon2Value(dimension[1]))
+	}
+	line.WriteString(" ")
+	if m.unit != "" && m.unit != emfNoUnit {
+		// units are metadata, they do not tell series apart
+		fmt.Fprintf(&line, " unit=%s", carbon2Value(m.unit))
+	}
+	fmt.Fprintf(&line, " %s %d", strconv.FormatFloat(stat.value, 'g', -1, 64), m.at(now).Unix())
+	return line.String()
+}
+
+// carbon2Value replaces the characters separating Carbon 2.0 tags
+func carbon2Value(value string) string {
+	return strings.NewReplacer(" ", "_", "=", "_").Replace(value)
+}
+
+// prometheusLine formats a metric as `<name>{<label>="<value>"} <value> <epoch milliseconds>`
+func (s *sumoLogicClient) prometheusLine(m *metricSeries, stat metricStat, now time.Time) string {
+	name := prometheusNamePattern.ReplaceAllString(m.name, "_")
+	if stat.stat != "" {
+		name += "_" + stat.stat
+	}
+	labels := []string{fmt.Sprintf("function=%q", s.config.FunctionName)}
+	for _, dimension := range m.dimensions {
+		labels = append(labels, fmt.Sprintf("%s=%q", prometheusNamePattern.ReplaceAllString(dimension[0], "_"), dimension[1]))
+	}
+	return fmt.Sprintf("%s{%s} %s %d", name, strings.Join(labels, ","), strconv.FormatFloat(stat.value, 'g', -1, 64), m.at(now).UnixMilli())
+}
+
+// emfRecords returns a CloudWatch embedded metric format record per set of dimensions
+func (s *sumoLogicClient) emfRecords(series []*metricSeries, now time.Time) responseBody {
+	var records responseBody
+	byDimensions := make(map[string]int)
+	for _, m := range series {
+		timestamp := m.at(now)
+		dimensionKey := fmt.Sprint(m.dimensions, timestamp.UnixMilli())
+		idx, ok := byDimensions[dimensionKey]
+		if !ok {
+			dimensionNames := []string{"function"}
+			record := map[string]interface{}{"function": s.config.FunctionName}
+			for _, dimension := range m.dimensions {
+				dimensionNames = append(dimensionNames, dimension[0])
+				record[dimension[0]] = dimension[1]
+			}
+			record["_aws"] = map[string]interface{}{
+				"Timestamp": timestamp.UnixMilli(),
+				"CloudWatchMetrics": []interface{}{map[string]interface{}{
+					"Namespace":  metricsNamespace,
+					"Dimensions": [][]string{dimensionNames},
+					"Metrics":    []interface{}{},
+				}},
+			}
+			idx = len(records)
+			byDimensions[dimensionKey] = idx
+			records = append(records, map[string]interface{}{
+				"time":   timestamp.UTC().Format(time.RFC3339Nano),
+				"type":   MetricsRecordType,
+				"record": record,
+			})
+		}
+		record := records[idx]["record"].(map[string]interface{})
+		directive := record["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+		unit := m.unit
+		if unit == "" {
+			unit = emfNoUnit
+		}
+		directive["Metrics"] = append(directive["Metrics"].([]interface{}), map[string]interface{}{"Name": m.name, "Unit": unit})
+		switch m.kind {
+		case config.MetricHistogram:
+			record[m.name] = m.values
+		case config.MetricGauge:
+			record[m.name] = m.last
+		default:
+			record[m.name] = m.sum
+		}
+	}
+	return records
+}
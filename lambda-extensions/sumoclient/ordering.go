@@ -0,0 +1,40 @@
+package sumoclient
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// TimestampField is the time of a record in milliseconds since the epoch, Sumo Logic can parse message times from it
+	TimestampField = "timestampMs"
+	// SequenceField numbers records in the order this execution environment received them, the environment
+	// is the prefix of DeliveryIDField. Records sorted by TimestampField then SequenceField are in order.
+	SequenceField = "sequence"
+)
+
+// recordTimestampMs returns the time of a record in milliseconds since the epoch, records without a
+// readable time are stamped with now
+func recordTimestampMs(item map[string]interface{}, now time.Time) int64 {
+	if value, ok := item["time"].(string); ok {
+		if timestamp, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return timestamp.UnixMilli()
+		}
+	}
+	return now.UnixMilli()
+}
+
+// sortRecords orders enhanced records by time then sequence. Batches sent together, concurrent sends and
+// retries mix records up, records missing the fields keep their place at the start.
+func sortRecords(records responseBody) {
+	sort.SliceStable(records, func(i, j int) bool {
+		ti, _ := records[i][TimestampField].(int64)
+		tj, _ := records[j][TimestampField].(int64)
+		if ti != tj {
+			return ti < tj
+		}
+		si, _ := records[i][SequenceField].(uint64)
+		sj, _ := records[j][SequenceField].(uint64)
+		return si < sj
+	})
+}
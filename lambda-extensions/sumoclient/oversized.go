@@ -0,0 +1,147 @@
+package sumoclient
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+	uuid "github.com/google/uuid"
+)
+
+const (
+	// TruncatedField is set on records cut to fit MaxMessageSize
+	TruncatedField = "truncated"
+	// OriginalSizeField is the size in bytes of a truncated or split record
+	OriginalSizeField = "originalSize"
+	// FragmentIDField is shared by the fragments of a split record, the delivery id of the record when it has one
+	FragmentIDField = "fragmentId"
+	// FragmentField numbers the fragments of a split record from 1
+	FragmentField = "fragment"
+	// FragmentCountField is the number of fragments of a split record
+	FragmentCountField = "fragments"
+)
+
+// envelopeFields are the fields kept next to the body when the other fields do not leave it room
+var envelopeFields = []string{"time", "type", DeliveryIDField, TimestampField, SequenceField}
+
+// fitRecord returns the lines a record encoded over MaxMessageSize is sent as: one truncated line, or
+// its fragments. Only the body of the record, its message or record field, is cut.
+func (s *sumoLogicClient) fitRecord(item map[string]interface{}, encoded []byte) ([][]byte, error) {
+	envelope, bodyKey, body := s.splitBody(item, encoded)
+	envelope[OriginalSizeField] = len(encoded)
+	if s.config.OversizedRecords == config.OversizedSplit {
+		return s.fragments(envelope, bodyKey, body)
+	}
+	envelope[TruncatedField] = true
+	envelope[bodyKey] = ""
+	base, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	envelope[bodyKey], _ = cutBody(body, s.config.MaxMessageSize-len(base))
+	line, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{line}, nil
+}
+
+// fragments splits body into as many lines as needed, each with the fields of envelope
+func (s *sumoLogicClient) fragments(envelope map[string]interface{}, bodyKey string, body string) ([][]byte, error) {
+	fragmentID, _ := envelope[DeliveryIDField].(string)
+	if fragmentID == "" {
+		fragmentID = uuid.NewString()
+	}
+	envelope[FragmentIDField] = fragmentID
+	// numbers as wide as the real ones can be, so every fragment fits
+	envelope[FragmentField] = len(body)
+	envelope[FragmentCountField] = len(body)
+	envelope[bodyKey] = ""
+	base, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	budget := s.config.MaxMessageSize - len(base)
+	var pieces []string
+	for rest := body; rest != ""; {
+		var piece string
+		piece, rest = cutBody(rest, budget)
+		pieces = append(pieces, piece)
+	}
+	lines := make([][]byte, 0, len(pieces))
+	for idx, piece := range pieces {
+		envelope[FragmentField] = idx + 1
+		envelope[FragmentCountField] = len(pieces)
+		envelope[bodyKey] = piece
+		line, err := json.Marshal(envelope)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// splitBody returns the fields of a record besides its body, the key of the body and the body as a string.
+// Records without a message or record field, or whose other fields take most of MaxMessageSize, become
+// the body of an envelope holding envelopeFields.
+func (s *sumoLogicClient) splitBody(item map[string]interface{}, encoded []byte) (map[string]interface{}, string, string) {
+	bodyKey := "message"
+	if _, ok := item[bodyKey]; !ok {
+		bodyKey = "record"
+	}
+	if value, ok := item[bodyKey]; ok {
+		envelope := make(map[string]interface{}, len(item)+5)
+		for key, field := range item {
+			if key != bodyKey {
+				envelope[key] = field
+			}
+		}
+		if fields, err := json.Marshal(envelope); err == nil && len(fields) <= s.config.MaxMessageSize/2 {
+			if body, ok := value.(string); ok {
+				return envelope, bodyKey, body
+			}
+			if body, err := json.Marshal(value); err == nil {
+				return envelope, bodyKey, string(body)
+			}
+		}
+	}
+	envelope := make(map[string]interface{}, len(envelopeFields)+5)
+	for _, key := range envelopeFields {
+		if field, ok := item[key]; ok {
+			envelope[key] = field
+		}
+	}
+	return envelope, "message", string(encoded)
+}
+
+// cutBody returns the start of body taking at most budget bytes once JSON encoded, and the rest. At least
+// one character is taken so splitting always ends.
+func cutBody(body string, budget int) (string, string) {
+	size := 0
+	for idx, r := range body {
+		runeSize := escapedLen(r, body[idx:])
+		if size+runeSize > budget && idx > 0 {
+			return body[:idx], body[idx:]
+		}
+		size += runeSize
+	}
+	return body, ""
+}
+
+// escapedLen returns how many bytes encoding/json writes for the rune starting rest, erring on the long
+// side for the control characters it may escape either way
+func escapedLen(r rune, rest string) int {
+	switch {
+	case r == '"' || r == '\\' || r == '\n' || r == '\r' || r == '\t':
+		return 2
+	case r < 0x20 || r == '<' || r == '>' || r == '&' || r == '\u2028' || r == '\u2029':
+		return 6
+	case r == utf8.RuneError:
+		if _, size := utf8.DecodeRuneInString(rest); size == 1 {
+			// invalid UTF-8 is written as \ufffd
+			return 6
+		}
+	}
+	return utf8.RuneLen(r)
+}
@@ -0,0 +1,144 @@
+package sumoclient
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Preflight steps, in the order they run
+const (
+	PreflightStepEndpoint = "endpoint"
+	PreflightStepDNS      = "dns"
+	PreflightStepTLS      = "tls"
+	PreflightStepValidate = "validate"
+)
+
+// PreflightStep is the outcome of one check
+type PreflightStep struct {
+	Name     string
+	Duration time.Duration
+	// Skipped is set for checks not applying, like DNS and TLS behind a proxy
+	Skipped bool
+	Err     error
+}
+
+// PreflightError is returned by Preflight for the first failed check
+type PreflightError struct {
+	Step string
+	Err  error
+}
+
+func (e *PreflightError) Error() string {
+	return fmt.Sprintf("preflight %s check failed: %v", e.Step, e.Err)
+}
+
+func (e *PreflightError) Unwrap() error {
+	return e.Err
+}
+
+// Preflight checks during init what is otherwise found out on the first post: the endpoint is decrypted,
+// its host resolved and a TLS connection opened. With PreflightValidate an empty post is sent as well,
+// which checks the endpoint accepts data without ingesting anything. Checks stop at the first failure.
+func Preflight(ctx context.Context, cfg *config.LambdaExtensionConfig, logger *logrus.Entry) ([]PreflightStep, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.PreflightTimeout)
+	defer cancel()
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, &PreflightError{Step: PreflightStepTLS, Err: err}
+	}
+	client := &sumoLogicClient{httpClient: httpClient, config: cfg, logger: logger}
+
+	var endpoint *url.URL
+	var proxied bool
+	checks := []struct {
+		name  string
+		check func() (bool, error)
+	}{
+		{PreflightStepEndpoint, func() (bool, error) {
+			rawEndpoint, err := client.getHttpEndpoint(ctx)
+			if err != nil {
+				return false, err
+			}
+			if endpoint, err = url.Parse(rawEndpoint); err != nil {
+				return false, fmt.Errorf("invalid endpoint: %w", err)
+			}
+			proxyURL, err := http.ProxyFromEnvironment(&http.Request{URL: endpoint})
+			proxied = proxyURL != nil
+			return false, err
+		}},
+		{PreflightStepDNS, func() (bool, error) {
+			if proxied {
+				return true, nil
+			}
+			_, err := net.DefaultResolver.LookupHost(ctx, endpoint.Hostname())
+			return false, err
+		}},
+		{PreflightStepTLS, func() (bool, error) {
+			if proxied || endpoint.Scheme != "https" {
+				return true, nil
+			}
+			return false, client.dialTLS(ctx, endpoint)
+		}},
+		{PreflightStepValidate, func() (bool, error) {
+			if !cfg.PreflightValidate {
+				return true, nil
+			}
+			return false, client.validateEndpoint(ctx, endpoint)
+		}},
+	}
+	var steps []PreflightStep
+	for _, c := range checks {
+		start := time.Now()
+		skipped, err := c.check()
+		steps = append(steps, PreflightStep{Name: c.name, Duration: time.Since(start), Skipped: skipped, Err: err})
+		if err != nil {
+			return steps, &PreflightError{Step: c.name, Err: err}
+		}
+	}
+	return steps, nil
+}
+
+// dialTLS opens and closes a TLS connection to the endpoint with the transport's TLS settings
+func (s *sumoLogicClient) dialTLS(ctx context.Context, endpoint *url.URL) error {
+	var tlsConfig *tls.Config
+	if transport, ok := s.httpClient.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	port := endpoint.Port()
+	if port == "" {
+		port = "443"
+	}
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: s.config.HTTPConnectTimeout}, Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(endpoint.Hostname(), port))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// validateEndpoint posts an empty payload, Sumo Logic answers 200 without ingesting anything
+func (s *sumoLogicClient) validateEndpoint(ctx context.Context, endpoint *url.URL) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), http.NoBody)
+	if err != nil {
+		return err
+	}
+	request.Header.Add("X-Sumo-Client", config.SumoLogicExtensionLayerVersionSuffix)
+	response, err := s.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer s.closeResponse(response)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("statuscode %v", response.StatusCode)
+	}
+	return nil
+}
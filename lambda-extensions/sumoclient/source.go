@@ -0,0 +1,140 @@
+package sumoclient
+
+import (
+	"strings"
+)
+
+// unresolvedPlaceholder is rendered for placeholders whose value is not known yet, like {account}
+// before the first invocation
+const unresolvedPlaceholder = "unknown"
+
+// sourceHeaders are the X-Sumo-* headers a chunk is sent with
+type sourceHeaders struct {
+	category string
+	name     string
+	host     string
+	fields   string
+	// contentType is only set for metrics, logs are sent without one
+	contentType string
+}
+
+// renderTemplate replaces the placeholders supported in source templates
+func (s *sumoLogicClient) renderTemplate(template string, logType string) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+	account, alias := unresolvedPlaceholder, unresolvedPlaceholder
+	metadata := functionMetadata.Load()
+	if metadata.AccountID != "" {
+		account = metadata.AccountID
+	}
+	if metadata.Alias != "" {
+		alias = metadata.Alias
+	}
+	if logType == "" {
+		logType = unresolvedPlaceholder
+	}
+	return strings.NewReplacer(
+		"{function}", s.config.FunctionName,
+		"{version}", s.config.FunctionVersion,
+		"{region}", s.config.LambdaRegion,
+		"{alias}", alias,
+		"{account}", account,
+		"{logType}", logType,
+	).Replace(template)
+}
+
+// sourceCategory returns the category route matching logType, the exact type is looked up first,
+// then its family (platform.report belongs to platform), then the default category.
+func (s *sumoLogicClient) sourceCategory(logType string) string {
+	if category, ok := s.config.SourceCategoryRoutes[logType]; ok {
+		return category
+	}
+	family, _, _ := strings.Cut(logType, ".")
+	if category, ok := s.config.SourceCategoryRoutes[family]; ok {
+		return category
+	}
+	return s.config.SourceCategoryOverride
+}
+
+// getSourceHeaders returns the headers records of logType are sent with
+func (s *sumoLogicClient) getSourceHeaders(logType string) sourceHeaders {
+	headers := sourceHeaders{
+		category: s.renderTemplate(s.sourceCategory(logType), logType),
+		name:     s.getLogStream(),
+		host:     s.getLogGroup(),
+	}
+	if s.config.SourceNameTemplate != "" {
+		headers.name = s.renderTemplate(s.config.SourceNameTemplate, logType)
+	}
+	if s.config.SourceHostTemplate != "" {
+		headers.host = s.renderTemplate(s.config.SourceHostTemplate, logType)
+	}
+	var fields []string
+	for _, field := range s.config.SumoFields {
+		fields = append(fields, field.Key+"="+s.renderTemplate(field.Value, logType))
+	}
+	if s.config.EnableEnrichment {
+		fields = append(fields, s.enrichmentFields()...)
+	}
+	headers.fields = strings.Join(fields, ",")
+	return headers
+}
+
+// sourceGroup holds the records sent with the same headers
+type sourceGroup struct {
+	headers sourceHeaders
+	records responseBody
+}
+
+// recordTypes returns the type of each record, it has to be read before enhanceLogs
+// as records may be replaced by their message
+func recordTypes(msgArr responseBody) []string {
+	types := make([]string, len(msgArr))
+	for idx, item := range msgArr {
+		types[idx], _ = item["type"].(string)
+	}
+	return types
+}
+
+// groupBySource splits records by the headers they are sent with, keeping their order within a group.
+// Without routes or per type templates every record ends up in a single group.
+func (s *sumoLogicClient) groupBySource(msgArr responseBody, types []string) []sourceGroup {
+	var groups []sourceGroup
+	index := make(map[sourceHeaders]int)
+	cache := make(map[string]sourceHeaders)
+	for idx, item := range msgArr {
+		if item == nil {
+			// dropped by enhanceLogs
+			continue
+		}
+		headers, ok := cache[types[idx]]
+		if !ok {
+			headers = s.getSourceHeaders(types[idx])
+			cache[types[idx]] = headers
+		}
+		groupIdx, ok := index[headers]
+		if !ok {
+			groupIdx = len(groups)
+			index[headers] = groupIdx
+			groups = append(groups, sourceGroup{headers: headers})
+		}
+		groups[groupIdx].records = append(groups[groupIdx].records, item)
+	}
+	return groups
+}
+
+// createSourceChunks chunks each group of records sharing headers separately, as headers apply to a whole post
+func (s *sumoLogicClient) createSourceChunks(msgArr responseBody, types []string) ([]outgoingChunk, error) {
+	var chunks []outgoingChunk
+	for _, group := range s.groupBySource(msgArr, types) {
+		payloads, err := s.createChunks(group.records)
+		if err != nil {
+			return nil, err
+		}
+		for _, payload := range payloads {
+			chunks = append(chunks, outgoingChunk{id: nextChunkID(), payload: payload, headers: group.headers})
+		}
+	}
+	return chunks, nil
+}
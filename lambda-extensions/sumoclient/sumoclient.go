@@ -6,10 +6,12 @@ import (
 	b64 "encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
@@ -20,27 +22,45 @@ import (
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/kms"
 
-	uuid "github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
 var isColdStart bool = true
 
 var decryptedSumoHttpEndpoint string
+
+// kmsEndpointCacheTime is when the decrypted endpoint expires
 var kmsEndpointCacheTime = time.Now().Add(-5 * time.Minute)
 
+// kmsEndpointMu guards the decrypted endpoint cache, chunks are posted concurrently
+var kmsEndpointMu sync.Mutex
+
 // LogSender interface which needs to be implemented to send logs
 type LogSender interface {
 	SendLogs(context.Context, []byte) error
 	SendAllLogs(context.Context, [][]byte) error
 	FlushAll([][]byte) error
+	DeadLetter(ctx context.Context, rawmsg []byte, reason string, cause error) error
 }
 
 // sumoLogicClient implements LogSender interface
 type sumoLogicClient struct {
-	httpClient http.Client
+	httpClient *http.Client
 	config     *config.LambdaExtensionConfig
 	logger     *logrus.Entry
+	// deliveryLogger logs about sending chunks, its entries are not forwarded with the telemetry
+	deliveryLogger *logrus.Entry
+	// pending holds the chunks which failed to be delivered, they are retried on the next send
+	pending    *pendingChunks
+	compressor *utils.Compressor
+	// limiter is nil when no rate limit or ingest budget is configured
+	limiter *ingestLimiter
+	// metrics is nil when no metric rule is configured
+	metrics *metricAggregator
+	// errorSummary is nil when error detection is disabled
+	errorSummary *errorTracker
+	// invocations is nil when failure detection is disabled
+	invocations *invocationMonitor
 }
 
 // It is assumed that logs will be array of json objects and all channel payloads satisfy this format
@@ -55,11 +75,32 @@ type KMSDecryptAPI interface {
 // NewLogSenderClient returns interface pointing to the concrete version of LogSender client
 func NewLogSenderClient(logger *logrus.Entry, cfg *config.LambdaExtensionConfig) LogSender {
 	// setting the cold start variable here since this function is called
-	var logSenderClient LogSender = &sumoLogicClient{
-		httpClient: http.Client{Timeout: cfg.ConnectionTimeoutValue},
-		config:     cfg,
-		logger:     logger,
+	compressor, err := utils.NewCompressor(cfg.Compression, cfg.CompressionLevel, cfg.CompressionMinBytes)
+	if err != nil {
+		logger.Warnf("Using default gzip compression: %v", err)
+		compressor, _ = utils.NewCompressor(utils.EncodingGzip, 0, 0)
+	}
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		logger.Errorf("Using the default HTTP transport: %v", err)
+		httpClient = &http.Client{Timeout: cfg.ConnectionTimeoutValue}
+	}
+	client := &sumoLogicClient{
+		httpClient:     httpClient,
+		config:         cfg,
+		logger:         logger,
+		deliveryLogger: logger.WithField(utils.LogFieldDelivery, true),
+		pending:        &pendingChunks{},
+		compressor:     compressor,
+		limiter:        newIngestLimiter(cfg),
+		metrics:        newMetricAggregator(cfg),
+		errorSummary:   newErrorTracker(cfg),
+		invocations:    newInvocationMonitor(cfg),
+	}
+	if cfg.PrewarmConnections {
+		go client.prewarm(context.Background())
 	}
+	var logSenderClient LogSender = client
 	return logSenderClient
 }
 
@@ -70,8 +111,9 @@ func (s *sumoLogicClient) getColdStart() bool {
 	return isColdStart
 }
 
-func (s *sumoLogicClient) makeRequest(ctx context.Context, buf *bytes.Buffer) (*http.Response, error) {
-	endpoint, err := s.getHttpEndpoint()
+// makeRequest posts buf, encoding is its Content-Encoding and is empty for uncompressed payloads
+func (s *sumoLogicClient) makeRequest(ctx context.Context, buf *bytes.Buffer, encoding string, headers sourceHeaders) (*http.Response, error) {
+	endpoint, err := s.getHttpEndpoint(ctx)
 	if err != nil {
 		err = fmt.Errorf("failed to get SUMO HTTP Endpoint error: %v", err)
 		return nil, err
@@ -82,32 +124,44 @@ func (s *sumoLogicClient) makeRequest(ctx context.Context, buf *bytes.Buffer) (*
 		err = fmt.Errorf("http.NewRequest() error: %v", err)
 		return nil, err
 	}
-	request.Header.Add("Content-Encoding", "gzip")
+	if encoding != "" {
+		request.Header.Add("Content-Encoding", encoding)
+	}
 	request.Header.Add("X-Sumo-Client", config.SumoLogicExtensionLayerVersionSuffix)
 	// This is added to make it compatible with AWS Lambda and AWS Lambda ULM App
-	request.Header.Add("X-Sumo-Name", s.getLogStream())
-	request.Header.Add("X-Sumo-Host", s.getLogGroup())
-	if s.config.SourceCategoryOverride != "" {
-		request.Header.Add("X-Sumo-Category", s.config.SourceCategoryOverride)
+	request.Header.Add("X-Sumo-Name", headers.name)
+	request.Header.Add("X-Sumo-Host", headers.host)
+	if headers.category != "" {
+		request.Header.Add("X-Sumo-Category", headers.category)
+	}
+	if headers.fields != "" {
+		request.Header.Add("X-Sumo-Fields", headers.fields)
+	}
+	if headers.contentType != "" {
+		request.Header.Add("Content-Type", headers.contentType)
 	}
 	response, err := s.httpClient.Do(request)
 	return response, err
 }
 
-// Use cached KMS decrypted endpoint, refresh the cached endpoint, or return unencrypted endpoint
-func (s *sumoLogicClient) getHttpEndpoint() (string, error) {
+// Use cached KMS decrypted endpoint, refresh the cached endpoint, or return unencrypted endpoint.
+// ctx bounds the KMS call.
+func (s *sumoLogicClient) getHttpEndpoint(ctx context.Context) (string, error) {
 
 	if s.config.KMSKeyId == "" {
 		return s.config.SumoHTTPEndpoint, nil
 	}
 
+	kmsEndpointMu.Lock()
+	defer kmsEndpointMu.Unlock()
+
 	if s.config.KMSKeyId != "" && time.Until(kmsEndpointCacheTime) > 0 {
 		return decryptedSumoHttpEndpoint, nil
 	}
 
 	if s.config.KMSKeyId != "" && (time.Until(kmsEndpointCacheTime) <= 0 || s.config.KmsCacheSeconds == 0) {
 
-		cfg, err := awsConfig.LoadDefaultConfig(context.TODO())
+		cfg, err := awsConfig.LoadDefaultConfig(ctx)
 		if err != nil {
 			return "", fmt.Errorf("configuration error in aws client, error: %v", err)
 		}
@@ -125,17 +179,17 @@ func (s *sumoLogicClient) getHttpEndpoint() (string, error) {
 			EncryptionContext: map[string]string{"LambdaFunctionName": os.Getenv("AWS_LAMBDA_FUNCTION_NAME")},
 		}
 
-		result, err := DecodeData(context.TODO(), client, input)
+		result, err := DecodeData(ctx, client, input)
 
 		if err != nil {
 			return "", fmt.Errorf("got error decrypting data, error: %v", err)
 		}
 
 		// Set the decrypted endpoint var as decrypted string to use as cache
-		decryptedSumoHttpEndpoint := string(result.Plaintext)
+		decryptedSumoHttpEndpoint = string(result.Plaintext)
 
-		// Set new cache time
-		kmsEndpointCacheTime = time.Now()
+		// Set new cache expiry
+		kmsEndpointCacheTime = time.Now().Add(time.Duration(s.config.KmsCacheSeconds) * time.Second)
 
 		return decryptedSumoHttpEndpoint, nil
 	}
@@ -145,54 +199,30 @@ func (s *sumoLogicClient) getHttpEndpoint() (string, error) {
 	return "", err
 }
 
-// getS3KeyName returns the key by combining function name, version, date and uuid(version 1)
-func (s *sumoLogicClient) getS3KeyName() (string, error) {
-	currentTime := time.Now()
-	uniqueID, err := uuid.NewUUID()
-	if err != nil {
-		return "", err
-	}
-	// common prefix where all lambda logs will go
-
-	key := fmt.Sprintf("%s/%s/%s/%s/%d/%02d/%02d/%02d/%d/%v.gz", config.ExtensionName, s.config.LambdaRegion, s.config.FunctionName, s.config.FunctionVersion,
-		currentTime.Year(), currentTime.Month(), currentTime.Day(),
-		currentTime.Hour(), currentTime.Minute(), uniqueID)
-
-	return key, nil
-}
-
-func (s *sumoLogicClient) failoverHandler(buf *bytes.Buffer) error {
-
-	if s.config.EnableFailover {
-
-		s.logger.Debug("Trying to Send to S3")
-		keyName, err := s.getS3KeyName()
-		if err != nil {
-			return err
-		}
-		err = utils.UploadToS3(&s.config.S3BucketName, &keyName, buf)
-		if err != nil {
-			err = fmt.Errorf("failed to send to s3 bucket %s path %s: %w", s.config.S3BucketName, keyName, err)
-		}
-		return err
-	}
-	return nil
-}
-
 func (s *sumoLogicClient) FlushAll(msgQueue [][]byte) error {
 	var err error
 
-	if len(msgQueue) > 0 && s.config.EnableFailover {
-		s.logger.Debugf("FlushAll - Attempting to send %d payloads from dataqueue to S3", len(msgQueue))
+	if (len(msgQueue) > 0 || s.pending.len() > 0) && s.config.EnableFailover {
+		s.deliveryLogger.Debugf("FlushAll - Attempting to send %d payloads from dataqueue to S3", len(msgQueue))
 		var errorCount = 0
 		var totalitems = 0
 		var payload bytes.Buffer
+		// chunks waiting to be retried are already enhanced, they go first
+		var pending []outgoingChunk
+		for _, chunk := range s.pending.take() {
+			if chunk.isMetrics() {
+				s.deliveryLogger.Warnf("FlushAll - Dropping metrics chunk of %d bytes, failover objects only hold log records", len(chunk.payload))
+				continue
+			}
+			pending = append(pending, chunk)
+			payload.WriteString(fmt.Sprintf("\n%s", chunk.payload))
+		}
 		for _, rawmsg := range msgQueue {
 			// converting to arr of maps
 			msgArr, err := s.transformBytesToArrayOfMap(rawmsg)
 			if err != nil {
-				s.logger.Error("FlushAll - Error in transforming bytes to array of struct", err.Error())
-				errorCount++
+				s.deliveryLogger.Error("FlushAll - Error in transforming bytes to array of struct", err.Error())
+				s.deadLetterUnparseable(context.TODO(), rawmsg, errors.Unwrap(err))
 				continue
 			}
 			if len(msgArr) > 0 {
@@ -202,9 +232,12 @@ func (s *sumoLogicClient) FlushAll(msgQueue [][]byte) error {
 
 				// converting back to string
 				for _, item := range msgArr {
+					if item == nil {
+						continue
+					}
 					b, err := json.Marshal(item)
 					if err != nil {
-						s.logger.Error("FlushAll - Error in converting to json: ", err.Error())
+						s.deliveryLogger.Error("FlushAll - Error in converting to json: ", err.Error())
 						errorCount++
 						continue
 					}
@@ -212,7 +245,28 @@ func (s *sumoLogicClient) FlushAll(msgQueue [][]byte) error {
 				}
 			}
 		}
-		s.logger.Debugf("FlushAll - Total log lines transformed: %d", totalitems)
+		if s.metrics != nil {
+			// metrics are written as EMF records, failover objects only hold JSON records
+			if series := s.metrics.take(true); len(series) > 0 {
+				metricRecords := s.emfRecords(series, time.Now())
+				s.enhanceLogs(metricRecords)
+				for _, item := range metricRecords {
+					if b, err := json.Marshal(item); err == nil {
+						payload.WriteString(fmt.Sprintf("\n%s", string(b)))
+					}
+				}
+			}
+		}
+		for _, item := range s.derivedRecords(true) {
+			if b, err := json.Marshal(item); err == nil {
+				payload.WriteString(fmt.Sprintf("\n%s", string(b)))
+			}
+		}
+		s.deliveryLogger.Debugf("FlushAll - Total log lines transformed: %d", totalitems)
+		if payload.Len() == 0 {
+			return nil
+		}
+		info := describeChunk(payload.String(), failoverReasonFlush)
 		var gzippedBuffer *bytes.Buffer
 
 		// compressing and pushing to S3
@@ -220,12 +274,17 @@ func (s *sumoLogicClient) FlushAll(msgQueue [][]byte) error {
 		if err != nil {
 			return fmt.Errorf("flushAll - failed to compress log string: %w", err)
 		}
-		senderr := s.failoverHandler(gzippedBuffer)
+		senderr := s.failoverHandler(gzippedBuffer, info)
+		if senderr != nil {
+			for _, chunk := range s.pending.keep(pending) {
+				s.deadLetterChunk(context.TODO(), chunk, DeadLetterReasonRetryOverflow, nil)
+			}
+		}
 		if errorCount > 0 || senderr != nil {
 			return fmt.Errorf("flushAll - errors during chunk creation: %d, errors during flushing to S3: %v", errorCount, senderr)
 		}
 	} else {
-		s.logger.Info("flushAll - Dropping messages as no failover enabled.")
+		s.deliveryLogger.Info("flushAll - Dropping messages as no failover enabled.")
 	}
 	return err
 }
@@ -240,7 +299,12 @@ func (s *sumoLogicClient) createCWLogLine(item map[string]interface{}) {
 
 	// Todo convert this to struct
 	// Updated cwMessageLine to also cover new field initDurationMs as record.metrics do have it.
-	metric := message["metrics"].(map[string]interface{})
+	metric, ok := message["metrics"].(map[string]interface{})
+	if !ok {
+		// leaving the record untouched if the schema in use reports metrics differently
+		s.logger.Debug("No metrics found in platform.report record.")
+		return
+	}
 	if metric["initDurationMs"] == nil {
 		cwMessageLine := fmt.Sprintf("REPORT RequestId: %v	Duration: %v ms	Billed Duration: %v ms 	Memory Size: %v MB	Max Memory Used: %v MB",
 			message["requestId"], metric["durationMs"], metric["billedDurationMs"], metric["memorySizeMB"], metric["maxMemoryUsedMB"])
@@ -262,46 +326,110 @@ func (s *sumoLogicClient) getLogStream() string {
 	return fmt.Sprintf("%s/[%s]%s", currentDate, s.config.FunctionVersion, config.ExtensionName)
 }
 
+// addSourceFields adds the fields AWS Observability expects on every record
+func (s *sumoLogicClient) addSourceFields(item map[string]interface{}) {
+	// item["FunctionName"] = s.config.FunctionName
+	// item["FunctionVersion"] = s.config.FunctionVersion
+	// creating loggroup/logstream as they are not available in Env.
+	// This is done to make it compatible with AWS Observability
+
+	item["logGroup"] = s.getLogGroup()
+	item["logStream"] = s.getLogStream()
+
+	item["IsColdStart"] = s.getColdStart()
+	item["LayerVersion"] = config.SumoLogicExtensionLayerVersionSuffix
+}
+
+// formatFunctionLog returns the function log item the way it is sent, message is its trimmed line and
+// parsed the line read as JSON, nil for text lines.
+func (s *sumoLogicClient) formatFunctionLog(item map[string]interface{}, message string, parsed map[string]interface{}) map[string]interface{} {
+	if parsed == nil {
+		if s.config.EnhanceJsonLogs {
+			item["message"] = message
+			return item
+		}
+		s.logger.Debug("EnhanceJsonLogs disabled sending only message.")
+		return map[string]interface{}{"message": message}
+	}
+	if s.config.EnhanceJsonLogs {
+		item["message"] = parsed
+		return item
+	}
+	s.logger.Debug("EnhanceJsonLogs disabled sending only json log.")
+	return parsed
+}
+
+// functionLogLine removes the raw line from a function log item and returns it trimmed, with its JSON document
+func functionLogLine(item map[string]interface{}) (string, map[string]interface{}, error) {
+	message, ok := item["record"].(string)
+	if ok {
+		delete(item, "record")
+	}
+	message = strings.TrimSpace(message)
+	parsed, err := utils.ParseJson(message)
+	return message, parsed, err
+}
+
+// enhanceLogs adds the fields Sumo Logic apps expect to records. Records turned into metrics by a dropping
+// rule are set to nil, so msg keeps its length and stays aligned with the record types read before.
 func (s *sumoLogicClient) enhanceLogs(msg responseBody) {
 	s.logger.Debugln("Enhancing logs")
+	now := time.Now()
 	for idx, item := range msg {
-		// item["FunctionName"] = s.config.FunctionName
-		// item["FunctionVersion"] = s.config.FunctionVersion
-		// creating loggroup/logstream as they are not available in Env.
-		// This is done to make it compatible with AWS Observability
-
-		item["logGroup"] = s.getLogGroup()
-		item["logStream"] = s.getLogStream()
-
-		item["IsColdStart"] = s.getColdStart()
-		item["LayerVersion"] = config.SumoLogicExtensionLayerVersionSuffix
+		// read first as the record may be replaced below
+		timestampMs := recordTimestampMs(item, now)
+		s.addSourceFields(item)
 		logType, ok := item["type"].(string)
 		if ok && logType == "function" {
-			message, ok := item["record"].(string)
-			if ok {
-				delete(item, "record")
+			message, json, err := functionLogLine(item)
+			if err == nil && s.config.EnableEMFMetrics && s.extractEMF(json) && s.config.StripEMFMetadata {
+				// the metrics went to the metrics source, the log keeps the document properties
+				delete(json, emfMetadataKey)
+			}
+			if s.metrics != nil && s.extractMetrics(message, json) {
+				// the line is only kept as a metric, later steps skip nil records
+				msg[idx] = nil
+				continue
 			}
-			message = strings.TrimSpace(message)
-			json, err := utils.ParseJson(message)
 			if err != nil {
-				if s.config.EnhanceJsonLogs {
-					item["message"] = message
-				} else {
-					s.logger.Debug("EnhanceJsonLogs disabled sending only message.")
-					msg[idx] = map[string]interface{}{"message": message}
-				}
-			} else {
-				if s.config.EnhanceJsonLogs {
-					item["message"] = json
-				} else {
-					s.logger.Debug("EnhanceJsonLogs disabled sending only json log.")
-					msg[idx] = json
-				}
+				json = nil
+			}
+			msg[idx] = s.formatFunctionLog(item, message, json)
+			if s.errorSummary != nil {
+				s.tagSeverity(msg[idx], message, json)
+			}
+		} else if ok && logType == "platform.start" {
+			if s.errorSummary != nil {
+				record, _ := item["record"].(map[string]interface{})
+				requestID, _ := record["requestId"].(string)
+				s.errorSummary.start(requestID)
 			}
 		} else if ok && logType == "platform.report" {
 			s.createCWLogLine(item)
+			if s.config.EstimateCost {
+				s.estimateCost(item)
+			}
+			if s.metrics != nil {
+				s.metrics.invocationEnded()
+			}
+			if s.errorSummary != nil {
+				record, _ := item["record"].(map[string]interface{})
+				requestID, _ := record["requestId"].(string)
+				// reports made up for requests which never reported do not end an invocation seen here
+				if synthetic, _ := record["synthetic"].(bool); !synthetic {
+					s.errorSummary.end(requestID)
+				}
+			}
+			if s.invocations != nil {
+				record, _ := item["record"].(map[string]interface{})
+				timestamp, _ := item["time"].(string)
+				s.invocations.observeReport(record, timestamp)
+			}
 		} else if ok && logType == "platform.runtimeDone" {
 			message, ok := item["record"].(map[string]interface{})
+			if ok && s.invocations != nil {
+				s.invocations.observeRuntimeDone(message)
+			}
 			if ok {
 				_, ok := message["spans"]
 				if ok && s.config.EnableSpanDrops {
@@ -310,7 +438,32 @@ func (s *sumoLogicClient) enhanceLogs(msg responseBody) {
 				}
 			}
 		}
+		// stamped last as the record may have been replaced above, retries keep the id of the first attempt
+		if msg[idx] != nil {
+			deliveryID, sequence := nextDelivery()
+			if s.config.DeliveryIDs {
+				msg[idx][DeliveryIDField] = deliveryID
+			}
+			if s.config.OrderedDelivery {
+				msg[idx][TimestampField] = timestampMs
+				msg[idx][SequenceField] = sequence
+			}
+		}
+	}
+}
+
+// derivedRecords returns the records made from the logs sent so far, error summaries and invocation failures,
+// enhanced like the other records. force adds the error summary of the current invocation.
+func (s *sumoLogicClient) derivedRecords(force bool) responseBody {
+	var records responseBody
+	if s.errorSummary != nil {
+		records = append(records, s.errorSummary.take(force)...)
 	}
+	if s.invocations != nil {
+		records = append(records, s.invocations.take()...)
+	}
+	s.enhanceLogs(records)
+	return records
 }
 
 func (s *sumoLogicClient) transformBytesToArrayOfMap(rawmsg []byte) (responseBody, error) {
@@ -319,7 +472,7 @@ func (s *sumoLogicClient) transformBytesToArrayOfMap(rawmsg []byte) (responseBod
 	// var err error
 	var err = json.Unmarshal(rawmsg, &msg)
 	if err != nil {
-		return msg, fmt.Errorf("error in parsing payload %s: %v", string(rawmsg), err)
+		return msg, fmt.Errorf("error in parsing payload %s: %w", string(rawmsg), err)
 	}
 	return msg, err
 }
@@ -332,6 +485,9 @@ func (s *sumoLogicClient) createChunks(msgArr responseBody) ([]string, error) {
 	var chunkSize = 0
 	var currentChunk bytes.Buffer
 	var errorCount = 0
+	if s.config.OrderedDelivery {
+		sortRecords(msgArr)
+	}
 	for _, item := range msgArr {
 		b, err := json.Marshal(item)
 		if err != nil {
@@ -339,18 +495,35 @@ func (s *sumoLogicClient) createChunks(msgArr responseBody) ([]string, error) {
 			errorCount++
 			continue
 		}
-		itemSize = binary.Size(b)
-		if chunkSize+itemSize+1 >= s.config.MaxDataPayloadSize {
-			chunks = append(chunks, currentChunk.String())
-			currentChunk = *bytes.NewBufferString(string(b))
-			chunkSize = itemSize
-		} else {
-			chunkSize += itemSize + 1
-			currentChunk.WriteString(fmt.Sprintf("\n%s", string(b)))
+		lines := [][]byte{b}
+		if s.config.MaxMessageSize > 0 && len(b) > s.config.MaxMessageSize {
+			lines, err = s.fitRecord(item, b)
+			if err != nil {
+				s.logger.Error("Error in fitting an oversized record: ", err.Error())
+				errorCount++
+				continue
+			}
+			s.logger.Debugf("Record of %d bytes over %d sent as %d lines, %s", len(b), s.config.MaxMessageSize, len(lines), s.config.OversizedRecords)
 		}
-
+		for _, line := range lines {
+			itemSize = binary.Size(line)
+			if currentChunk.Len() == 0 {
+				// a line larger than MaxDataPayloadSize still gets a chunk of its own
+				currentChunk.Write(line)
+				chunkSize = itemSize
+			} else if chunkSize+itemSize+1 > s.config.MaxDataPayloadSize {
+				chunks = append(chunks, currentChunk.String())
+				currentChunk = *bytes.NewBufferString(string(line))
+				chunkSize = itemSize
+			} else {
+				chunkSize += itemSize + 1
+				currentChunk.WriteString(fmt.Sprintf("\n%s", string(line)))
+			}
+		}
+	}
+	if currentChunk.Len() > 0 {
+		chunks = append(chunks, currentChunk.String())
 	}
-	chunks = append(chunks, currentChunk.String())
 	if errorCount > 0 {
 		err = fmt.Errorf("dropping %d messages due to json parsing error", errorCount)
 	}
@@ -364,52 +537,57 @@ func (s *sumoLogicClient) SendLogs(ctx context.Context, rawmsg []byte) error {
 		// converting to arr of maps
 		msgArr, err := s.transformBytesToArrayOfMap(rawmsg)
 		if err != nil {
-			return fmt.Errorf("SendLogs - transformBytesToArrayOfMap failed: %v", err)
+			s.deliveryLogger.Error("SendLogs - transformBytesToArrayOfMap failed: ", err.Error())
+			s.deadLetterUnparseable(ctx, rawmsg, errors.Unwrap(err))
+			return nil
 		}
-		s.logger.Debugf("SendLogs - Total log lines transformed: %d", len(msgArr))
+		s.deliveryLogger.Debugf("SendLogs - Total log lines transformed: %d", len(msgArr))
+		msgArr = s.limitIngest(msgArr)
+		types := recordTypes(msgArr)
 		s.enhanceLogs(msgArr)
+		metricRecords, metricChunks := s.metricsOutput(false)
+		msgArr = append(msgArr, metricRecords...)
+		types = append(types, recordTypes(metricRecords)...)
+		derived := s.derivedRecords(false)
+		msgArr = append(msgArr, derived...)
+		types = append(types, recordTypes(derived)...)
 
 		// converting back to chunks of string
-		chunks, err := s.createChunks(msgArr)
+		chunks, err := s.createSourceChunks(msgArr, types)
 		if err != nil {
 			return fmt.Errorf("SendLogs - createChunks failed: %v", err)
 		}
-		var errorCount = 0
-		for _, strobj := range chunks {
-			err := s.postToSumo(ctx, &strobj)
-			if err != nil {
-				errorCount++
-			}
-		}
-		if errorCount > 0 {
-			err = fmt.Errorf("SendLogs - errors during postToSumo: %d", errorCount)
-			return err
+		chunks = append(chunks, metricChunks...)
+		if err := s.sendChunks(ctx, chunks); err != nil {
+			return fmt.Errorf("SendLogs - %w", err)
 		}
 	}
 	return nil
 }
 
 func (s *sumoLogicClient) SendAllLogs(ctx context.Context, allMessages [][]byte) error {
-	if len(allMessages) == 0 {
-		s.logger.Debugf("SendAllLogs: No messages to send")
+	if len(allMessages) == 0 && s.pending.len() == 0 {
+		s.deliveryLogger.Debugf("SendAllLogs: No messages to send")
 		return nil
 	}
 
-	s.logger.Debugf("SendAllLogs: Attempting to send %d payloads from dataqueue to SumoLogic", len(allMessages))
+	s.deliveryLogger.Debugf("SendAllLogs: Attempting to send %d payloads from dataqueue to SumoLogic", len(allMessages))
 
-	var errorCount = 0
 	var totalitems = 0
 	var payload responseBody
+	var types []string
 	for _, rawmsg := range allMessages {
 		// converting to arr of maps
 		msgArr, err := s.transformBytesToArrayOfMap(rawmsg)
 		if err != nil {
-			s.logger.Error("SendAllLogs: Error in transforming bytes to array of struct", err.Error())
-			errorCount++
+			s.deliveryLogger.Error("SendAllLogs: Error in transforming bytes to array of struct", err.Error())
+			s.deadLetterUnparseable(ctx, rawmsg, errors.Unwrap(err))
 			continue
 		}
 
+		msgArr = s.limitIngest(msgArr)
 		if len(msgArr) > 0 {
+			types = append(types, recordTypes(msgArr)...)
 			// enhancing logs
 			s.enhanceLogs(msgArr)
 			totalitems += len(msgArr)
@@ -418,34 +596,33 @@ func (s *sumoLogicClient) SendAllLogs(ctx context.Context, allMessages [][]byte)
 
 		}
 	}
-	s.logger.Debugf("SendAllLogs: Enhanced TotalLogItems - %d \n", totalitems)
+	s.deliveryLogger.Debugf("SendAllLogs: Enhanced TotalLogItems - %d \n", totalitems)
+	metricRecords, metricChunks := s.metricsOutput(false)
+	payload = append(payload, metricRecords...)
+	types = append(types, recordTypes(metricRecords)...)
+	derived := s.derivedRecords(false)
+	payload = append(payload, derived...)
+	types = append(types, recordTypes(derived)...)
 	// converting back to chunks of string
-	chunks, err := s.createChunks(payload)
+	chunks, err := s.createSourceChunks(payload, types)
 	if err != nil {
 		return fmt.Errorf("SendAllLogs: CreateChunks failed - %v", err)
 	}
-	for _, strobj := range chunks {
-		err := s.postToSumo(ctx, &strobj)
-		if err != nil {
-			errorCount++
-		}
-	}
-	if errorCount > 0 {
-		err = fmt.Errorf("SendAllLogs: Errors during postToSumo - %d", errorCount)
-		return err
-	} else {
-		s.logger.Debugf("SendAllLogs: Sent TotalChunks - %d \n", totalitems)
+	chunks = append(chunks, metricChunks...)
+	if err := s.sendChunks(ctx, chunks); err != nil {
+		return fmt.Errorf("SendAllLogs: %w", err)
 	}
+	s.deliveryLogger.Debugf("SendAllLogs: Sent TotalLogItems - %d \n", totalitems)
 
 	return nil
 }
 
-func (s *sumoLogicClient) postToSumo(ctx context.Context, logStringToSend *string) error {
+func (s *sumoLogicClient) postToSumo(ctx context.Context, logStringToSend *string, headers sourceHeaders) error {
 
-	s.logger.Debug("postToSumo: Attempting to send to Sumo Endpoint")
+	s.deliveryLogger.Debug("postToSumo: Attempting to send to Sumo Endpoint")
 
 	// compressing here because Sumo recommends payload size of 1MB before compression
-	bytedata, err := utils.Compress(logStringToSend)
+	bytedata, encoding, err := s.compressor.Compress([]byte(*logStringToSend))
 	if err != nil {
 		return fmt.Errorf("failed to compress log string: %w", err)
 	}
@@ -455,48 +632,62 @@ func (s *sumoLogicClient) postToSumo(ctx context.Context, logStringToSend *strin
 		return bytes.NewBuffer(dest)
 	}
 	buf := createBuffer()
-	response, err := s.makeRequest(ctx, buf)
-	if response != nil {
-		defer func() {
-			if err := response.Body.Close(); err != nil {
-				s.logger.Debugf("failed to close body: %v", err)
-			}
-		}()
-	}
-	if (err != nil) || (response.StatusCode != 200 && response.StatusCode != 302 && response.StatusCode < 500) {
-		s.logger.Errorf("postToSumo: Not able to post statuscode -  %v %v\n", err, response)
+	response, err := s.makeRequest(ctx, buf, encoding, headers)
+	defer s.closeResponse(response)
+	if err != nil || !postDelivered(response.StatusCode) {
+		s.deliveryLogger.Errorf("postToSumo: Not able to post statuscode -  %v %v\n", err, response)
+		// the error of the last post tells whether the chunk is worth retrying later
+		lastErr := err
+		if lastErr == nil {
+			lastErr = &postStatusError{statusCode: response.StatusCode}
+		}
 		err := utils.Retry(func(attempt int) (bool, error) {
-			s.logger.Debugf("postToSumo: Waiting for %v ms for retry attempt - %v\n", s.config.RetrySleepTime, attempt)
-			time.Sleep(s.config.RetrySleepTime)
+			s.deliveryLogger.Debugf("postToSumo: Waiting for %v ms for retry attempt - %v\n", s.config.RetrySleepTime, attempt)
+			select {
+			case <-time.After(s.config.RetrySleepTime):
+			case <-ctx.Done():
+				// no point retrying past the deadline, failover below still gets the data
+				return false, ctx.Err()
+			}
 			buf := createBuffer()
-			retryResponse, errRetry := s.makeRequest(ctx, buf)
-			if (errRetry != nil) || (retryResponse.StatusCode != 200 && retryResponse.StatusCode != 302 && retryResponse.StatusCode < 500) {
+			retryResponse, errRetry := s.makeRequest(ctx, buf, encoding, headers)
+			defer s.closeResponse(retryResponse)
+			if errRetry != nil || !postDelivered(retryResponse.StatusCode) {
 				if errRetry == nil {
-					errRetry = fmt.Errorf("statuscode %v", retryResponse.StatusCode)
+					errRetry = &postStatusError{statusCode: retryResponse.StatusCode}
 				}
-				s.logger.Error("postToSumo: Not able to post - ", errRetry)
+				lastErr = errRetry
+				s.deliveryLogger.Error("postToSumo: Not able to post - ", errRetry)
 				return attempt < s.config.MaxRetryAttempts, errRetry
-			} else if retryResponse.StatusCode == 200 {
-				s.logger.Debugf("postToSumo: Post of logs successful after retry %v attempts\n", attempt)
-				return true, nil
 			}
-			return attempt < s.config.MaxRetryAttempts, errRetry
+			s.deliveryLogger.Debugf("postToSumo: Post of logs successful after retry %v attempts\n", attempt)
+			return true, nil
 		}, s.config.NumRetry)
 		if err != nil {
-			s.logger.Error("postToSumo: Finished retrying Error - ", err)
-			if s.config.EnableFailover {
+			s.deliveryLogger.Error("postToSumo: Finished retrying Error - ", err)
+			if ctx.Err() == nil {
+				err = lastErr
+			}
+			if s.config.EnableFailover && headers.contentType == "" {
 				buf = createBuffer()
-				err := s.failoverHandler(buf)
+				if encoding != utils.EncodingGzip {
+					// failover objects are always gzipped, whatever is sent to Sumo Logic
+					if buf, err = utils.CompressBuffer(bytes.NewBufferString(*logStringToSend)); err != nil {
+						return fmt.Errorf("failed to compress log string: %w", err)
+					}
+				}
+				err := s.failoverHandler(buf, describeChunk(*logStringToSend, failoverReasonPostFailed))
 				if err != nil {
-					s.logger.Errorf("postToSumo: Dropping messages as post to S3 failed - %v\n", err)
+					s.deliveryLogger.Errorf("postToSumo: Dropping messages as post to S3 failed - %v\n", err)
 					return err
 				}
 			} else {
-				s.logger.Info("postToSumo: Dropping messages as no failover enabled.")
+				// the caller keeps the chunk for a later attempt, metrics never go to log failover
+				return err
 			}
 		}
-	} else if response.StatusCode == 200 {
-		s.logger.Debugf("postToSumo: Post of logs successful")
+	} else {
+		s.deliveryLogger.Debugf("postToSumo: Post of logs successful")
 	}
 
 	return nil
@@ -1,18 +1,30 @@
 package sumoclient
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
-	ioutil "io"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
 	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
 
 	"github.com/sirupsen/logrus"
 )
@@ -32,6 +44,8 @@ func setupEnv() {
 	_ = os.Setenv("SUMO_LOG_LEVEL", "DEBUG")
 	_ = os.Setenv("SUMO_RETRY_SLEEP_TIME_MS", "50")
 	_ = os.Setenv("SUMO_LOG_TYPES", "function")
+	// test servers only expect posts
+	_ = os.Setenv("SUMO_PREWARM_CONNECTIONS", "false")
 }
 
 func assertEqual(t *testing.T, a interface{}, b interface{}, message string) {
@@ -54,6 +68,37 @@ func assertNotEmpty(t *testing.T, a interface{}, message string) {
 	t.Error(message)
 }
 
+// fakeS3Uploader records uploads instead of sending them to S3
+type fakeS3Uploader struct {
+	mu      sync.Mutex
+	keys    []string
+	options []utils.S3ObjectOptions
+	bodies  [][]byte
+	err     error
+}
+
+func (f *fakeS3Uploader) Upload(ctx context.Context, bucketName string, keyName string, data io.Reader, options utils.S3ObjectOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	body, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	f.keys = append(f.keys, keyName)
+	f.options = append(f.options, options)
+	f.bodies = append(f.bodies, body)
+	return nil
+}
+
+func (f *fakeS3Uploader) uploads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.keys)
+}
+
 func TestSumoClient(t *testing.T) {
 	var logger = logrus.New().WithField("Name", "sumologic-extension")
 	var config *cfg.LambdaExtensionConfig
@@ -74,7 +119,7 @@ func TestSumoClient(t *testing.T) {
 		assertNotEmpty(t, r.Header.Get("X-Sumo-Name"), "Source Name Header not present")
 		assertNotEmpty(t, r.Header.Get("X-Sumo-Host"), "Source Host Header not present")
 
-		reqBytes, err := ioutil.ReadAll(r.Body)
+		reqBytes, err := io.ReadAll(r.Body)
 		assertEqual(t, err, nil, "Received error")
 		defer func() {
 			if err := r.Body.Close(); err != nil {
@@ -102,6 +147,8 @@ func TestSumoClient(t *testing.T) {
 	assertEqual(t, err, nil, "GetConfig should not generate error")
 
 	logger.Logger.SetLevel(config.LogLevel)
+	uploader := &fakeS3Uploader{}
+	config.S3Uploader = uploader
 
 	t.Log("\nsuccess scenario\n======================")
 	client := NewLogSenderClient(logger, config)
@@ -130,11 +177,16 @@ func TestSumoClient(t *testing.T) {
 		[]byte(`[{"time":"2020-10-27T15:36:14.133Z","type":"platform.start","record":{"requestId":"7313c951-e0bc-4818-879f-72d202e24727","version":"$LATEST"}},{"time":"2020-10-27T15:36:14.282Z","type":"platform.logsSubscription","record":{"name":"sumologic-extension","state":"Subscribed","types":["platform","function"]}},{"time":"2020-10-27T15:36:14.283Z","type":"function","record":"2020-10-27T15:36:14.281Z\tundefined\tINFO\tLoading function\n"},{"time":"2020-10-27T15:36:14.283Z","type":"platform.extension","record":{"name":"sumologic-extension","state":"Ready","events":["INVOKE"]}},{"time":"2020-10-27T15:36:14.301Z","type":"function","record":"2020-10-27T15:36:14.285Z\t7313c951-e0bc-4818-879f-72d202e24727\tINFO\tvalue1 = value1\n"},{"time":"2020-10-27T15:36:14.302Z","type":"function","record":"2020-10-27T15:36:14.301Z\t7313c951-e0bc-4818-879f-72d202e24727\tINFO\tvalue2 = value2\n"},{"time":"2020-10-27T15:36:14.302Z","type":"function","record":"2020-10-27T15:36:14.301Z\t7313c951-e0bc-4818-879f-72d202e24727\tINFO\tvalue3 = value3\n"}]`),
 	}
 	err = client.FlushAll(multiplelargedata)
-	if err != nil {
-		assertEqual(t, strings.HasPrefix(err.Error(), "FlushAll - Errors during chunk creation: 0, Errors during flushing to S3"), true, "FlushAll should generate error")
-	}
+	assertEqual(t, err, nil, "FlushAll should not generate error")
+	assertEqual(t, uploader.uploads(), 1, "FlushAll should upload one object")
+	// the records and the error summary of the invocation started by the large data above, which logged an error
+	assertEqual(t, uploader.options[0].Metadata[MetadataRecordCount], "22", "")
+	assertEqual(t, uploader.options[0].Metadata[MetadataReason], failoverReasonFlush, "")
 
-	//Todo mock S3 client to improve below tests
+	uploader.err = errors.New("access denied")
+	err = client.FlushAll(multiplelargedata)
+	assertEqual(t, err != nil && strings.HasPrefix(err.Error(), "flushAll - errors during chunk creation: 0, errors during flushing to S3"), true, "FlushAll should generate error")
+	uploader.err = nil
 
 	t.Log("\ntesting report data conversion\n================")
 	var reportLogs = []byte(`[{"record":{"metrics":{"billedDurationMs":120000,"durationMs":122066.85,"maxMemoryUsedMB":74,"memorySizeMB":128},"requestId":"fcea12d9-e0b4-43b2-a9a2-04d04519539f"},"time":"2020-11-02T20:33:16.536Z","type":"platform.report"}]`)
@@ -154,4 +206,1109 @@ func TestSumoClient(t *testing.T) {
 	if err != nil {
 		assertEqual(t, strings.HasPrefix(err.Error(), "SendLogs - errors during postToSumo: 1"), true, "SendLogs should generate error")
 	}
+	assertEqual(t, uploader.uploads(), 2, "failed chunk should be uploaded to S3")
+	assertEqual(t, uploader.options[1].Metadata[MetadataReason], failoverReasonPostFailed, "")
+}
+
+func TestDescribeChunk(t *testing.T) {
+	payload := `{"time":"2025-09-26T10:00:02.000Z","type":"function","record":"b"}
+{"time":"2025-09-26T10:00:01.000Z","type":"function","record":"a"}
+not json
+
+{"time":"2025-09-26T10:00:03.500Z","type":"platform.report","record":{}}
+`
+	info := describeChunk(payload, failoverReasonPostFailed)
+	metadata := info.metadata()
+	assertEqual(t, metadata[MetadataRecordCount], "4", "")
+	assertEqual(t, metadata[MetadataFirstTimestamp], "2025-09-26T10:00:01.000Z", "")
+	assertEqual(t, metadata[MetadataLastTimestamp], "2025-09-26T10:00:03.500Z", "")
+	assertEqual(t, metadata[MetadataReason], failoverReasonPostFailed, "")
+	assertEqual(t, metadata[MetadataLayerVersion], cfg.SumoLogicExtensionLayerVersionSuffix, "")
+
+	_, ok := describeChunk("plain text\n", failoverReasonFlush).metadata()[MetadataFirstTimestamp]
+	assertEqual(t, ok, false, "timestamps should be omitted when no record has one")
+}
+
+func TestDeadLetterUnparseablePayload(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	dlqFile := filepath.Join(t.TempDir(), "dlq.ndjson")
+	config := &cfg.LambdaExtensionConfig{
+		DeadLetterTarget:   cfg.DeadLetterTargetFile,
+		DeadLetterFile:     dlqFile,
+		MaxDataPayloadSize: 1024 * 1024,
+		FunctionName:       "himlambda",
+	}
+	client := NewLogSenderClient(logger, config)
+
+	assertEqual(t, client.SendLogs(context.Background(), []byte(`[{"type":"function"`)), nil, "SendLogs should not return an error for an unparseable payload")
+	assertEqual(t, client.SendAllLogs(context.Background(), [][]byte{[]byte("not json")}), nil, "SendAllLogs should not return an error for an unparseable payload")
+
+	data, err := os.ReadFile(dlqFile)
+	assertEqual(t, err, nil, "dead letter file should be written")
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assertEqual(t, len(lines), 2, "")
+	var record map[string]interface{}
+	assertEqual(t, json.Unmarshal([]byte(lines[1]), &record), nil, "")
+	assertEqual(t, record["type"], DeadLetterRecordType, "")
+	assertEqual(t, record["reason"], DeadLetterReasonParseError, "")
+	assertEqual(t, record["message"], "not json", "")
+	assertEqual(t, record["truncated"], false, "")
+}
+
+func TestSendAllLogsRetriesOnlyFailedChunks(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	var mu sync.Mutex
+	posts := map[string][]string{}
+	failing := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := gzip.NewReader(r.Body)
+		assertEqual(t, err, nil, "payload should be gzipped")
+		body, _ := io.ReadAll(reader)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			var record map[string]interface{}
+			assertEqual(t, json.Unmarshal([]byte(line), &record), nil, "")
+			message, _ := record["message"].(string)
+			posts[message] = append(posts[message], record[DeliveryIDField].(string))
+		}
+		if failing && strings.Contains(string(body), "second") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	config := &cfg.LambdaExtensionConfig{
+		SumoHTTPEndpoint:      server.URL,
+		MaxDataPayloadSize:    300,
+		NumRetry:              1,
+		MaxRetryAttempts:      1,
+		DeadLetterMaxAttempts: 5,
+		EnhanceJsonLogs:       true,
+		DeliveryIDs:           true,
+	}
+	client := NewLogSenderClient(logger, config)
+	logs := []byte(`[{"time":"2020-10-27T15:36:14.301Z","type":"function","record":"first"},{"time":"2020-10-27T15:36:14.302Z","type":"function","record":"second"}]`)
+
+	err := client.SendAllLogs(context.Background(), [][]byte{logs})
+	var chunkErr *ChunkDeliveryError
+	assertEqual(t, errors.As(err, &chunkErr), true, "SendAllLogs should report the failed chunk")
+	assertEqual(t, chunkErr.Failed, 1, "")
+	assertEqual(t, chunkErr.Total, 2, "")
+
+	failing = false
+	assertEqual(t, client.SendAllLogs(context.Background(), nil), nil, "retry should succeed")
+	assertEqual(t, client.SendAllLogs(context.Background(), nil), nil, "nothing should be left to send")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assertEqual(t, len(posts["first"]), 1, "delivered chunk should not be sent again")
+	assertEqual(t, len(posts["second"]), 3, "failed chunk should be retried")
+	assertEqual(t, posts["second"][0], posts["second"][2], "retries should keep the delivery id")
+	assertEqual(t, posts["first"][0] != posts["second"][0], true, "records should get distinct delivery ids")
+	assertEqual(t, strings.HasPrefix(posts["first"][0], environmentID+"-"), true, "delivery id should start with the environment id")
+
+	// raw JSON logs are sent as logged unless delivery ids are asked for
+	raw := NewLogSenderClient(logger, &cfg.LambdaExtensionConfig{}).(*sumoLogicClient)
+	records := responseBody{{"time": "2020-10-27T15:36:14.303Z", "type": "function", "record": `{"level":"INFO"}`}}
+	raw.enhanceLogs(records)
+	sent, _ := json.Marshal(records[0])
+	assertEqual(t, string(sent), `{"level":"INFO"}`, "")
+}
+
+func TestSourceRouting(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	var mu sync.Mutex
+	headers := map[string]http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := gzip.NewReader(r.Body)
+		assertEqual(t, err, nil, "payload should be gzipped")
+		body, _ := io.ReadAll(reader)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			var record map[string]interface{}
+			assertEqual(t, json.Unmarshal([]byte(line), &record), nil, "")
+			message, ok := record["message"].(string)
+			if !ok {
+				// extension logs keep their record
+				message, _ = record["record"].(string)
+			}
+			headers[message] = r.Header
+		}
+	}))
+	defer server.Close()
+	config := &cfg.LambdaExtensionConfig{
+		SumoHTTPEndpoint:   server.URL,
+		MaxDataPayloadSize: 1024 * 1024,
+		FunctionName:       "himlambda",
+		FunctionVersion:    "$LATEST",
+		LambdaRegion:       "us-east-1",
+		EnhanceJsonLogs:    true,
+		SourceCategoryRoutes: map[string]string{
+			"platform":        "aws/lambda/platform",
+			"platform.report": "aws/lambda/report",
+			"function":        "aws/lambda/{region}/app",
+		},
+		SourceCategoryOverride: "aws/lambda/other",
+		SourceNameTemplate:     "{function}:{alias}",
+		SumoFields:             []cfg.SumoField{{Key: "env", Value: "prod"}, {Key: "logType", Value: "{logType}"}},
+	}
+	client := NewLogSenderClient(logger, config)
+	logs := []byte(`[{"time":"2020-10-27T15:36:14.301Z","type":"function","record":"app"},` +
+		`{"time":"2020-10-27T15:36:14.302Z","type":"platform.start","record":{"requestId":"1"}},` +
+		`{"time":"2020-10-27T15:36:14.303Z","type":"extension","record":"ext"}]`)
+	assertEqual(t, client.SendAllLogs(context.Background(), [][]byte{logs}), nil, "SendAllLogs should not generate error")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assertEqual(t, headers["app"].Get("X-Sumo-Category"), "aws/lambda/us-east-1/app", "")
+	assertEqual(t, headers["app"].Get("X-Sumo-Fields"), "env=prod,logType=function", "")
+	assertEqual(t, headers["app"].Get("X-Sumo-Name"), "himlambda:unknown", "")
+	assertEqual(t, headers["app"].Get("X-Sumo-Host"), "/aws/lambda/himlambda", "")
+	assertEqual(t, headers["ext"].Get("X-Sumo-Category"), "aws/lambda/other", "")
+	assertEqual(t, headers["ext"].Get("X-Sumo-Fields"), "env=prod,logType=extension", "")
+
+	client.(*sumoLogicClient).config.SourceCategoryRoutes["function"] = "{account}/{alias}"
+	metadata := withFunctionArn(environmentFunctionMetadata(), "arn:aws:lambda:us-east-1:123456789012:function:himlambda:live")
+	functionMetadata.Store(&metadata)
+	defer resetFunctionMetadata()
+	sourceHeaders := client.(*sumoLogicClient).getSourceHeaders("function")
+	assertEqual(t, sourceHeaders.category, "123456789012/live", "")
+	assertEqual(t, client.(*sumoLogicClient).sourceCategory("platform.report"), "aws/lambda/report", "exact type should win over its family")
+}
+
+func resetFunctionMetadata() {
+	metadata := environmentFunctionMetadata()
+	functionMetadata.Store(&metadata)
+}
+
+// fakeTagsReader returns fixed tags instead of calling the Lambda API
+type fakeTagsReader struct {
+	tags map[string]string
+	arn  string
+}
+
+func (f *fakeTagsReader) ListTags(ctx context.Context, functionArn string) (map[string]string, error) {
+	f.arn = functionArn
+	return f.tags, nil
+}
+
+func TestEnrichmentFields(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	_ = os.Setenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE", "512")
+	_ = os.Setenv("AWS_EXECUTION_ENV", "AWS_Lambda_python3.12")
+	defer func() {
+		_ = os.Unsetenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE")
+		_ = os.Unsetenv("AWS_EXECUTION_ENV")
+		resetFunctionMetadata()
+	}()
+	resetFunctionMetadata()
+
+	reader := &fakeTagsReader{tags: map[string]string{"team": "payments", "cost-center": "a,b", "secret": "x"}}
+	config := &cfg.LambdaExtensionConfig{
+		EnableEnrichment:  true,
+		EnrichWithTags:    true,
+		EnrichmentTagKeys: []string{"team", "cost-center"},
+		TagsReader:        reader,
+		SumoFields:        []cfg.SumoField{{Key: "team", Value: "override"}},
+	}
+	client := NewLogSenderClient(logger, config).(*sumoLogicClient)
+
+	metadata := withFunctionArn(*functionMetadata.Load(), "arn:aws:lambda:us-east-1:123456789012:function:himlambda:live")
+	functionMetadata.Store(&metadata)
+	resolveTags(context.Background(), reader, logger)
+	assertEqual(t, reader.arn, "arn:aws:lambda:us-east-1:123456789012:function:himlambda", "tags should be read for the unqualified function")
+
+	fields := strings.Join(client.enrichmentFields(), ",")
+	arch := environmentFunctionMetadata().Architecture
+	want := "account=123456789012,alias=live,architecture=" + arch + ",cost_center=a_b,functionArn=arn:aws:lambda:us-east-1:123456789012:function:himlambda:live,memorySize=512,runtime=python3.12"
+	assertEqual(t, fields, want, fmt.Sprintf("unexpected fields %s", fields))
+	assertEqual(t, client.getSourceHeaders("function").fields, "team=override,"+want, "")
+}
+
+// fakeIdentityReader returns a fixed caller identity instead of calling STS
+type fakeIdentityReader struct {
+	account   string
+	partition string
+}
+
+func (f *fakeIdentityReader) CallerIdentity(ctx context.Context) (string, string, error) {
+	return f.account, f.partition, nil
+}
+
+func TestManagedInstanceFunctionArn(t *testing.T) {
+	config := &cfg.LambdaExtensionConfig{
+		LambdaRegion:   "cn-north-1",
+		FunctionName:   "himlambda",
+		IdentityReader: &fakeIdentityReader{account: "123456789012", partition: "aws-cn"},
+	}
+	arn, err := managedInstanceFunctionArn(context.Background(), config)
+	assertEqual(t, err, nil, "")
+	assertEqual(t, arn, "arn:aws-cn:lambda:cn-north-1:123456789012:function:himlambda", "")
+
+	defer resetFunctionMetadata()
+	metadata := withFunctionArn(*functionMetadata.Load(), arn)
+	assertEqual(t, metadata.AccountID, "123456789012", "")
+	assertEqual(t, metadata.Alias, "", "the unqualified ARN tells no alias")
+}
+
+func TestCompressionEncoding(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	var encodings []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.Header.Get("Content-Encoding")
+		encodings = append(encodings, encoding)
+		var body io.Reader = r.Body
+		if encoding == utils.EncodingDeflate {
+			reader, err := zlib.NewReader(r.Body)
+			assertEqual(t, err, nil, "payload should be zlib encoded")
+			body = reader
+		}
+		payload, _ := io.ReadAll(body)
+		assertEqual(t, strings.Contains(string(payload), "compressed"), true, "payload should be readable")
+	}))
+	defer server.Close()
+	config := &cfg.LambdaExtensionConfig{
+		SumoHTTPEndpoint:    server.URL,
+		MaxDataPayloadSize:  1024 * 1024,
+		NumRetry:            1,
+		MaxRetryAttempts:    1,
+		Compression:         utils.EncodingDeflate,
+		CompressionLevel:    1,
+		CompressionMinBytes: 200,
+	}
+	client := NewLogSenderClient(logger, config)
+	small := []byte(`[{"time":"2020-10-27T15:36:14.301Z","type":"function","record":"compressed"}]`)
+	large := []byte(`[{"time":"2020-10-27T15:36:14.301Z","type":"function","record":"compressed ` + strings.Repeat("x", 300) + `"}]`)
+	assertEqual(t, client.SendLogs(context.Background(), small), nil, "")
+	assertEqual(t, client.SendLogs(context.Background(), large), nil, "")
+	assertEqual(t, strings.Join(encodings, ","), ","+utils.EncodingDeflate, "payloads below the threshold should be sent uncompressed")
+}
+
+func TestHTTPTransport(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	var mu sync.Mutex
+	var requests []string
+	var connections int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.Proto)
+	}))
+	server.EnableHTTP2 = true
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			defer mu.Unlock()
+			connections++
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	caBundle := writeCABundle(t, server)
+	config := &cfg.LambdaExtensionConfig{
+		SumoHTTPEndpoint:      server.URL,
+		MaxDataPayloadSize:    1024 * 1024,
+		MaxConcurrentRequests: 2,
+		NumRetry:              1,
+		MaxRetryAttempts:      1,
+		HTTPCABundle:          caBundle,
+		EnableHTTP2:           true,
+	}
+	client := NewLogSenderClient(logger, config).(*sumoLogicClient)
+	client.prewarm(context.Background())
+	logs := []byte(`[{"time":"2020-10-27T15:36:14.301Z","type":"function","record":"hello"}]`)
+	assertEqual(t, client.SendLogs(context.Background(), logs), nil, "the CA bundle should be trusted")
+	assertEqual(t, client.SendLogs(context.Background(), logs), nil, "")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assertEqual(t, strings.Join(requests, ","), "HEAD HTTP/2.0,POST HTTP/2.0,POST HTTP/2.0", "posts should follow the prewarm request over HTTP/2")
+	assertEqual(t, connections, 1, "the prewarmed connection should be reused")
+}
+
+// writeCABundle writes the certificate of a TLS test server as a PEM bundle
+func writeCABundle(t *testing.T, server *httptest.Server) string {
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assertEqual(t, os.WriteFile(caBundle, certificate, 0o600), nil, "")
+	return caBundle
+}
+
+func TestPreflight(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	status := http.StatusOK
+	var posts []int64
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts = append(posts, r.ContentLength)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	config := &cfg.LambdaExtensionConfig{
+		SumoHTTPEndpoint:   server.URL,
+		HTTPCABundle:       writeCABundle(t, server),
+		PreflightValidate:  true,
+		PreflightTimeout:   5 * time.Second,
+		HTTPConnectTimeout: time.Second,
+	}
+
+	steps, err := Preflight(context.Background(), config, logger)
+	assertEqual(t, err, nil, "preflight should pass")
+	var names []string
+	for _, step := range steps {
+		assertEqual(t, step.Skipped, false, step.Name+" should run")
+		names = append(names, step.Name)
+	}
+	assertEqual(t, strings.Join(names, ","), "endpoint,dns,tls,validate", "")
+	assertEqual(t, fmt.Sprint(posts), "[0]", "validation should post an empty payload")
+
+	status = http.StatusUnauthorized
+	_, err = Preflight(context.Background(), config, logger)
+	var preflightErr *PreflightError
+	assertEqual(t, errors.As(err, &preflightErr), true, "a rejected validation should fail preflight")
+	assertEqual(t, preflightErr.Step, PreflightStepValidate, "")
+
+	config.PreflightValidate = false
+	config.SumoHTTPEndpoint = "https://collectors.sumologic.invalid/receiver/v1/http/token"
+	steps, err = Preflight(context.Background(), config, logger)
+	assertEqual(t, errors.As(err, &preflightErr), true, "an unknown host should fail preflight")
+	assertEqual(t, preflightErr.Step, PreflightStepDNS, "")
+	assertEqual(t, len(steps), 2, "checks should stop at the first failure")
+}
+
+func TestRecordLevel(t *testing.T) {
+	for record, expected := range map[string]string{
+		"2024-01-01T00:00:00.000Z\t6b8ae4c4-1d9c-4e87-a7a5-5c6f3f8b1c2d\tERROR\tInvoke Error": "error",
+		"[WARNING]\t2024-01-01T00:00:00.000Z\tid\tretrying":                                   "warn",
+		`{"level":"INFO","message":"done"}`:                                                   "info",
+		"plain text mentioning an ERROR later on in the line":                                 "unknown",
+	} {
+		assertEqual(t, recordLevel(map[string]interface{}{"type": "function", "record": record}), expected, record)
+	}
+	assertEqual(t, recordLevel(map[string]interface{}{"record": map[string]interface{}{"level": "DEBUG"}}), "debug", "")
+}
+
+func TestIngestLimits(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	var records []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := gzip.NewReader(r.Body)
+		assertEqual(t, err, nil, "payload should be gzipped")
+		body, _ := io.ReadAll(reader)
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			var record map[string]interface{}
+			assertEqual(t, json.Unmarshal([]byte(line), &record), nil, "")
+			records = append(records, record)
+		}
+	}))
+	defer server.Close()
+	config := &cfg.LambdaExtensionConfig{
+		SumoHTTPEndpoint:   server.URL,
+		MaxDataPayloadSize: 1024 * 1024,
+		NumRetry:           1,
+		MaxRetryAttempts:   1,
+		IngestBudgetBytes:  20,
+		IngestBudgetPeriod: cfg.IngestBudgetInvocation,
+		OverBudgetAction:   cfg.OverBudgetSummarize,
+		EnhanceJsonLogs:    true,
+	}
+	client := NewLogSenderClient(logger, config).(*sumoLogicClient)
+	countTypes := func() map[string]int {
+		counts := map[string]int{}
+		for _, record := range records {
+			recordType, _ := record["type"].(string)
+			counts[recordType]++
+		}
+		records = nil
+		return counts
+	}
+
+	logs := []byte(`[{"time":"2020-10-27T15:36:14.300Z","type":"platform.start","record":{"requestId":"1"}},` +
+		`{"time":"2020-10-27T15:36:14.301Z","type":"function","record":"0123456789"},` +
+		`{"time":"2020-10-27T15:36:14.302Z","type":"function","record":"0123456789"},` +
+		`{"time":"2020-10-27T15:36:14.303Z","type":"function","record":"id\tERROR\tover"},` +
+		`{"time":"2020-10-27T15:36:14.304Z","type":"function","record":"over budget"}]`)
+	assertEqual(t, client.SendLogs(context.Background(), logs), nil, "")
+	counts := countTypes()
+	assertEqual(t, counts["platform.start"], 1, "platform records are not limited")
+	assertEqual(t, counts["function"], 2, "records within the budget should be sent")
+	assertEqual(t, counts[IngestWarningRecordType], 1, "going over the budget should be reported")
+	assertEqual(t, counts[IngestSummaryRecordType], 1, "")
+
+	// the warning is only sent once per period, summaries are sent with every send
+	over := []byte(`[{"time":"2020-10-27T15:36:14.305Z","type":"function","record":"still over budget"}]`)
+	assertEqual(t, client.SendLogs(context.Background(), over), nil, "")
+	counts = countTypes()
+	assertEqual(t, counts[IngestWarningRecordType], 0, "the warning should be sent once per period")
+	assertEqual(t, counts[IngestSummaryRecordType], 1, "")
+
+	// a new invocation starts a new budget
+	assertEqual(t, client.SendLogs(context.Background(), logs), nil, "")
+	assertEqual(t, countTypes()["function"], 2, "the budget should be reset by platform.start")
+
+	config.IngestBudgetBytes = 0
+	config.RateLimitRecords = 2
+	config.OverBudgetAction = cfg.OverBudgetSample
+	config.OverBudgetSampleRate = 2
+	client = NewLogSenderClient(logger, config).(*sumoLogicClient)
+	now := time.Now()
+	client.limiter.now = func() time.Time { return now }
+	var burst []string
+	for i := 0; i < 7; i++ {
+		burst = append(burst, fmt.Sprintf(`{"time":"2020-10-27T15:36:14.301Z","type":"function","record":"line %d"}`, i))
+	}
+	assertEqual(t, client.SendLogs(context.Background(), []byte("["+strings.Join(burst, ",")+"]")), nil, "")
+	sent := records
+	counts = countTypes()
+	// 2 within the rate, then 1 in 2 of the 5 others
+	assertEqual(t, counts["function"], 5, "records over the rate should be sampled")
+	for _, record := range sent {
+		if record["type"] == IngestSummaryRecordType {
+			summary := record["record"].(map[string]interface{})
+			assertEqual(t, summary["suppressedRecords"], float64(2), "")
+			assertEqual(t, summary["reason"], limitReasonRate, "")
+		}
+	}
+}
+
+func TestIngestLimiterBuckets(t *testing.T) {
+	config := &cfg.LambdaExtensionConfig{RateLimitBytes: 100, RateLimitRecords: 3, OverBudgetAction: cfg.OverBudgetSummarize}
+	limiter := newIngestLimiter(config)
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	record := func(size int) map[string]interface{} {
+		return map[string]interface{}{"type": "function", "record": strings.Repeat("x", size)}
+	}
+
+	admitted, _, _ := limiter.admit(responseBody{record(150)})
+	assertEqual(t, len(admitted), 1, "a record larger than the bucket should be admitted when the bucket is full")
+	admitted, limited, _ := limiter.admit(responseBody{record(10)})
+	assertEqual(t, len(admitted), 0, "the bucket should be in debt after an oversized record")
+	assertEqual(t, limited.reason, limitReasonRate, "")
+	assertEqual(t, limiter.records.tokens, float64(2), "a record over the byte rate should not take a record token")
+
+	now = now.Add(2 * time.Second)
+	admitted, _, _ = limiter.admit(responseBody{record(10), record(10), record(10), record(10)})
+	assertEqual(t, len(admitted), 3, "the record rate should still apply")
+}
+
+func TestOverflowUploadHasNoSideEffects(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	rules, _ := cfg.ParseMetricRules(`[{"name":"orders.count","type":"counter","regex":"order placed"}]`)
+	uploader := &fakeS3Uploader{}
+	client := NewLogSenderClient(logger, &cfg.LambdaExtensionConfig{
+		FunctionName:    "orders",
+		EnhanceJsonLogs: true,
+		ErrorDetection:  true,
+		MetricRules:     rules,
+		MetricsFormat:   cfg.MetricsFormatCarbon2,
+		S3BucketName:    "failover",
+		S3Uploader:      uploader,
+	}).(*sumoLogicClient)
+	sequence := deliverySequence.Load()
+	records := responseBody{
+		{"time": "2020-10-27T15:36:14.301Z", "type": "function", "record": "order placed"},
+		{"time": "2020-10-27T15:36:14.302Z", "type": "function", "record": `{"requestId":"1","level":"ERROR","message":"failed"}`},
+	}
+	assertEqual(t, client.uploadOverflow(records), nil, "")
+
+	assertEqual(t, deliverySequence.Load(), sequence, "overflow records should not take delivery ids")
+	_, chunks := client.metricsOutput(true)
+	assertEqual(t, len(chunks), 0, "overflow records should not be counted in metrics")
+	assertEqual(t, len(client.derivedRecords(true)), 0, "overflow records should not be summarised")
+	reader, err := gzip.NewReader(bytes.NewReader(uploader.bodies[0]))
+	assertEqual(t, err, nil, "")
+	body, _ := io.ReadAll(reader)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	assertEqual(t, len(lines), 2, "")
+	var record map[string]interface{}
+	assertEqual(t, json.Unmarshal([]byte(lines[1]), &record), nil, "")
+	assertEqual(t, record["message"].(map[string]interface{})["message"], "failed", "overflow records should be formatted like sent ones")
+	assertEqual(t, record["logGroup"], "/aws/lambda/orders", "")
+	_, stamped := record[DeliveryIDField]
+	assertEqual(t, stamped, false, "")
+}
+
+func TestMetricExtraction(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	var mu sync.Mutex
+	posts := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := gzip.NewReader(r.Body)
+		assertEqual(t, err, nil, "payload should be gzipped")
+		body, _ := io.ReadAll(reader)
+		mu.Lock()
+		defer mu.Unlock()
+		posts[r.Header.Get("Content-Type")] += strings.TrimSpace(string(body)) + "\n"
+	}))
+	defer server.Close()
+	rules, errs := cfg.ParseMetricRules(`[
+		{"name":"orders.amount","type":"histogram","regex":"order placed amount=(?P<value>[0-9.]+) region=(?P<region>\\w+)","drop":true},
+		{"name":"orders.count","type":"counter","regex":"order placed"},
+		{"name":"latency","type":"gauge","jsonPath":"metrics.latencyMs","dimensions":["tier"]}
+	]`)
+	assertEqual(t, len(errs), 0, fmt.Sprint(errs))
+	config := &cfg.LambdaExtensionConfig{
+		SumoHTTPEndpoint:   server.URL,
+		FunctionName:       "orders",
+		MaxDataPayloadSize: 1024 * 1024,
+		NumRetry:           1,
+		MaxRetryAttempts:   1,
+		EnhanceJsonLogs:    true,
+		MetricRules:        rules,
+		MetricsFormat:      cfg.MetricsFormatCarbon2,
+	}
+	client := NewLogSenderClient(logger, config)
+	logs := []byte(`[{"time":"2020-10-27T15:36:14.301Z","type":"function","record":"order placed amount=12.4 region=eu"},` +
+		`{"time":"2020-10-27T15:36:14.302Z","type":"function","record":"order placed amount=7.6 region=eu"},` +
+		`{"time":"2020-10-27T15:36:14.303Z","type":"function","record":"{\"tier\":\"gold\",\"metrics\":{\"latencyMs\":42}}"},` +
+		`{"time":"2020-10-27T15:36:14.304Z","type":"function","record":"unrelated"}]`)
+	assertEqual(t, client.SendLogs(context.Background(), logs), nil, "")
+	mu.Lock()
+	assertEqual(t, strings.Count(posts[""], "\n"), 2, "matched lines of dropping rules should not be sent")
+	assertEqual(t, strings.Contains(posts[""], "order placed"), false, "")
+	assertEqual(t, len(posts[carbon2ContentType]), 0, "metrics should wait for the end of the invocation")
+	mu.Unlock()
+
+	report := []byte(`[{"time":"2020-10-27T15:36:14.400Z","type":"platform.report","record":{"requestId":"1","metrics":{"durationMs":1}}}]`)
+	assertEqual(t, client.SendLogs(context.Background(), report), nil, "")
+	mu.Lock()
+	lines := strings.Split(strings.TrimSpace(posts[carbon2ContentType]), "\n")
+	mu.Unlock()
+	for idx, line := range lines {
+		// the timestamp changes between runs
+		lines[idx] = line[:strings.LastIndex(line, " ")]
+	}
+	assertEqual(t, strings.Join(lines, "\n"), strings.Join([]string{
+		"metric=latency function=orders tier=gold  42",
+		"metric=orders.amount function=orders stat=count region=eu  2",
+		"metric=orders.amount function=orders stat=sum region=eu  20",
+		"metric=orders.amount function=orders stat=min region=eu  7.6",
+		"metric=orders.amount function=orders stat=max region=eu  12.4",
+		"metric=orders.count function=orders  2",
+	}, "\n"), "metrics should be aggregated per invocation")
+
+	config.MetricsFormat = cfg.MetricsFormatEMF
+	emfClient := NewLogSenderClient(logger, config).(*sumoLogicClient)
+	emfClient.extractMetrics("order placed amount=3 region=us", nil)
+	records, chunks := emfClient.metricsOutput(true)
+	assertEqual(t, len(chunks), 0, "EMF metrics are sent as records")
+	assertEqual(t, len(records), 2, "metrics with other dimensions should go in another record")
+	record := records[0]["record"].(map[string]interface{})
+	assertEqual(t, record["region"], "us", "")
+	assertEqual(t, fmt.Sprint(record["orders.amount"]), "[3]", "histograms should hold their values")
+	assertEqual(t, records[1]["record"].(map[string]interface{})["orders.count"], float64(1), "")
+
+	config.MetricsFormat = cfg.MetricsFormatPrometheus
+	promClient := NewLogSenderClient(logger, config).(*sumoLogicClient)
+	promClient.extractMetrics("order placed amount=3 region=us", nil)
+	_, chunks = promClient.metricsOutput(true)
+	assertEqual(t, chunks[0].headers.contentType, prometheusContentType, "")
+	assertEqual(t, strings.HasPrefix(chunks[0].payload, `orders_amount_count{function="orders",region="us"} 1 `), true, chunks[0].payload)
+}
+
+func TestEMFExtraction(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	config := &cfg.LambdaExtensionConfig{
+		FunctionName:     "orders",
+		EnhanceJsonLogs:  true,
+		EnableEMFMetrics: true,
+		StripEMFMetadata: true,
+		MetricsFormat:    cfg.MetricsFormatCarbon2,
+	}
+	client := NewLogSenderClient(logger, config).(*sumoLogicClient)
+	document := `{"_aws":{"Timestamp":1603813000000,"CloudWatchMetrics":[{"Namespace":"Shop",` +
+		`"Dimensions":[["Service"],["Service","Operation"],["Missing"]],` +
+		`"Metrics":[{"Name":"Latency","Unit":"Milliseconds"},{"Name":"Items"}]}]},` +
+		`"Service":"orders","Operation":"place","Latency":[10,30],"Items":3,"orderId":"42"}`
+	records := responseBody{
+		{"time": "2020-10-27T15:36:40.000Z", "type": "function", "record": document},
+		{"time": "2020-10-27T15:36:40.001Z", "type": "function", "record": `{"_aws":"not emf"}`},
+	}
+	client.enhanceLogs(records)
+	message := records[0]["message"].(map[string]interface{})
+	_, hasMetadata := message[emfMetadataKey]
+	assertEqual(t, hasMetadata, false, "EMF metadata should be stripped from the log")
+	assertEqual(t, message["orderId"], "42", "document properties should be kept")
+	_, hasMetadata = records[1]["message"].(map[string]interface{})[emfMetadataKey]
+	assertEqual(t, hasMetadata, true, "documents without metric directives are not EMF")
+
+	_, chunks := client.metricsOutput(true)
+	assertEqual(t, len(chunks), 1, "")
+	assertEqual(t, chunks[0].headers.contentType, carbon2ContentType, "")
+	assertEqual(t, chunks[0].payload, strings.Join([]string{
+		"metric=Latency function=orders stat=count namespace=Shop Service=orders  unit=Milliseconds 2 1603813000",
+		"metric=Latency function=orders stat=sum namespace=Shop Service=orders  unit=Milliseconds 40 1603813000",
+		"metric=Latency function=orders stat=min namespace=Shop Service=orders  unit=Milliseconds 10 1603813000",
+		"metric=Latency function=orders stat=max namespace=Shop Service=orders  unit=Milliseconds 30 1603813000",
+		"metric=Latency function=orders stat=count namespace=Shop Service=orders Operation=place  unit=Milliseconds 2 1603813000",
+		"metric=Latency function=orders stat=sum namespace=Shop Service=orders Operation=place  unit=Milliseconds 40 1603813000",
+		"metric=Latency function=orders stat=min namespace=Shop Service=orders Operation=place  unit=Milliseconds 10 1603813000",
+		"metric=Latency function=orders stat=max namespace=Shop Service=orders Operation=place  unit=Milliseconds 30 1603813000",
+		"metric=Items function=orders namespace=Shop Service=orders  3 1603813000",
+		"metric=Items function=orders namespace=Shop Service=orders Operation=place  3 1603813000",
+	}, "\n"), "EMF metrics should be sent per dimension set with the document timestamp")
+}
+
+func TestErrorDetection(t *testing.T) {
+	for _, test := range []struct {
+		message   string
+		severity  string
+		errorType string
+	}{
+		{"2024-01-01T00:00:00.000Z\t3f1c2d4e-5b6a-4c7d-8e9f-0a1b2c3d4e5f\tINFO\tstarted", "info", ""},
+		{`{"level":"WARNING","message":"slow"}`, "warn", ""},
+		{"[ERROR] KeyError: 'id'\nTraceback (most recent call last):\n  File \"/var/task/app.py\", line 12, in handler\n    return event['id']", "error", "KeyError"},
+		{"Traceback (most recent call last):\n  File \"/var/task/app.py\", line 12, in handler\n    return 1/0\nZeroDivisionError: division by zero", "error", "ZeroDivisionError"},
+		{"2024-01-01T00:00:00.000Z\t3f1c2d4e-5b6a-4c7d-8e9f-0a1b2c3d4e5f\tERROR\tInvoke Error \t" +
+			`{"errorType":"TypeError","errorMessage":"x is undefined","stackTrace":["TypeError: x is undefined","    at handler (/var/task/index.js:3:9)"]}`, "error", "TypeError"},
+		{"java.lang.IllegalStateException: closed\n\tat com.example.Handler.handle(Handler.java:42)", "error", "java.lang.IllegalStateException"},
+		{"a RetryError was handled", "unknown", ""},
+	} {
+		parsed, _ := utils.ParseJson(test.message)
+		severity, info := detectSeverity(test.message, parsed)
+		assertEqual(t, severity, test.severity, test.message)
+		errorType := ""
+		if info != nil {
+			errorType = info.errorType
+		}
+		assertEqual(t, errorType, test.errorType, test.message)
+	}
+
+	first, _ := detectSeverity("java.lang.IllegalStateException: closed 1234\n\tat com.example.Handler.handle(Handler.java:42)", nil)
+	_, firstInfo := detectSeverity("java.lang.IllegalStateException: closed 1234\n\tat com.example.Handler.handle(Handler.java:42)", nil)
+	_, secondInfo := detectSeverity("java.lang.IllegalStateException: closed 5678\n\tat com.example.Handler.handle(Handler.java:57)", nil)
+	_, otherInfo := detectSeverity("java.lang.IllegalStateException: closed\n\tat com.example.Other.run(Other.java:42)", nil)
+	assertEqual(t, first, "error", "")
+	assertEqual(t, firstInfo.fingerprint(), secondInfo.fingerprint(), "line numbers and IDs should not change fingerprints")
+	assertEqual(t, firstInfo.fingerprint() == otherInfo.fingerprint(), false, "other frames should change fingerprints")
+	_, firstInfo = detectSeverity(`{"level":"error","message":"order 1234 not found for user 'a1'"}`, map[string]interface{}{"level": "error", "message": "order 1234 not found for user 'a1'"})
+	_, secondInfo = detectSeverity(`{"level":"error","message":"order 99 not found for user 'b2'"}`, map[string]interface{}{"level": "error", "message": "order 99 not found for user 'b2'"})
+	assertEqual(t, firstInfo.fingerprint(), secondInfo.fingerprint(), "messages without a stack should be normalised")
+
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	client := NewLogSenderClient(logger, &cfg.LambdaExtensionConfig{FunctionName: "orders", EnhanceJsonLogs: true, ErrorDetection: true}).(*sumoLogicClient)
+	records := responseBody{
+		{"time": "2020-10-27T15:36:14.100Z", "type": "platform.start", "record": map[string]interface{}{"requestId": "1"}},
+		{"time": "2020-10-27T15:36:14.101Z", "type": "function", "record": `{"level":"error","message":"order 1234 not found"}`},
+		{"time": "2020-10-27T15:36:14.102Z", "type": "function", "record": `{"level":"error","message":"order 99 not found"}`},
+		{"time": "2020-10-27T15:36:14.103Z", "type": "function", "record": "Traceback (most recent call last):\n  File \"/var/task/app.py\", line 3, in handler\nValueError: bad"},
+		{"time": "2020-10-27T15:36:14.104Z", "type": "function", "record": `{"level":"info","message":"done"}`},
+	}
+	client.enhanceLogs(records)
+	assertEqual(t, records[1][SeverityField], "error", "")
+	assertEqual(t, records[1][ErrorFingerprintField], records[2][ErrorFingerprintField], "")
+	assertEqual(t, records[3][ErrorTypeField], "ValueError", "")
+	assertEqual(t, records[4][SeverityField], "info", "")
+	_, tagged := records[4][ErrorFingerprintField]
+	assertEqual(t, tagged, false, "only errors have a fingerprint")
+	assertEqual(t, len(client.derivedRecords(false)), 0, "summaries should wait for the end of the invocation")
+
+	client.enhanceLogs(responseBody{{"time": "2020-10-27T15:36:14.200Z", "type": "platform.report", "record": map[string]interface{}{"requestId": "1"}}})
+	summaries := client.derivedRecords(false)
+	assertEqual(t, len(summaries), 1, "")
+	assertEqual(t, summaries[0]["type"], ErrorSummaryRecordType, "")
+	summary := summaries[0]["record"].(map[string]interface{})
+	assertEqual(t, summary["requestId"], "1", "")
+	assertEqual(t, summary["errorCount"], 3, "")
+	signatures := summary["signatures"].([]*errorSignature)
+	assertEqual(t, len(signatures), 2, "")
+	assertEqual(t, signatures[0].Count, 2, "")
+	assertEqual(t, signatures[1].ErrorType, "ValueError", "")
+	assertEqual(t, len(client.derivedRecords(true)), 0, "invocations without errors have no summary")
+}
+
+func TestErrorSummariesOfConcurrentInvocations(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	client := NewLogSenderClient(logger, &cfg.LambdaExtensionConfig{FunctionName: "orders", EnhanceJsonLogs: true, ErrorDetection: true}).(*sumoLogicClient)
+	first := "3f1c2d4e-5b6a-4c7d-8e9f-0a1b2c3d4e5f"
+	second := "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d"
+	client.enhanceLogs(responseBody{
+		{"time": "2020-10-27T15:36:14.100Z", "type": "platform.start", "record": map[string]interface{}{"requestId": first}},
+		{"time": "2020-10-27T15:36:14.101Z", "type": "platform.start", "record": map[string]interface{}{"requestId": second}},
+		{"time": "2020-10-27T15:36:14.102Z", "type": "function", "record": "2020-10-27T15:36:14.102Z\t" + first + "\tERROR\tfirst failed"},
+		{"time": "2020-10-27T15:36:14.103Z", "type": "function", "record": `{"level":"error","requestId":"` + second + `","message":"second failed"}`},
+		{"time": "2020-10-27T15:36:14.104Z", "type": "function", "record": `{"level":"error","requestId":"` + first + `","message":"first failed again"}`},
+		{"time": "2020-10-27T15:36:14.105Z", "type": "platform.report", "record": map[string]interface{}{"requestId": second, "synthetic": true}},
+		{"time": "2020-10-27T15:36:14.106Z", "type": "platform.report", "record": map[string]interface{}{"requestId": first}},
+	})
+	summaries := client.derivedRecords(false)
+	assertEqual(t, len(summaries), 1, "only the reported invocation should be summarised")
+	summary := summaries[0]["record"].(map[string]interface{})
+	assertEqual(t, summary["requestId"], first, "")
+	assertEqual(t, summary["errorCount"], 2, "errors should be counted for the invocation which logged them")
+
+	summaries = client.derivedRecords(true)
+	assertEqual(t, len(summaries), 1, "")
+	summary = summaries[0]["record"].(map[string]interface{})
+	assertEqual(t, summary["requestId"], second, "")
+	assertEqual(t, summary["errorCount"], 1, "")
+}
+
+func TestInvocationFailures(t *testing.T) {
+	defer functionTimeoutMs.Store(0)
+	ObserveInvokeDeadline(time.Now().Add(3*time.Second - 20*time.Millisecond).UnixMilli())
+	assertEqual(t, functionTimeoutMs.Load(), int64(3000), "the timeout should be rounded up to seconds")
+	ObserveInvokeDeadline(time.Now().Add(time.Second).UnixMilli())
+	assertEqual(t, functionTimeoutMs.Load(), int64(3000), "later invocations may have been delivered late")
+
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	client := NewLogSenderClient(logger, &cfg.LambdaExtensionConfig{
+		FunctionName:          "orders",
+		FailureDetection:      true,
+		MemoryWarningPercent:  90,
+		TimeoutWarningPercent: 80,
+	}).(*sumoLogicClient)
+	report := func(requestID string, durationMs, maxMemoryUsedMB float64, status string) map[string]interface{} {
+		record := map[string]interface{}{
+			"requestId": requestID,
+			"metrics":   map[string]interface{}{"durationMs": durationMs, "memorySizeMB": float64(128), "maxMemoryUsedMB": maxMemoryUsedMB},
+		}
+		if status != "" {
+			record["status"] = status
+		}
+		return map[string]interface{}{"time": "2020-10-27T15:36:14.400Z", "type": "platform.report", "record": record}
+	}
+	client.enhanceLogs(responseBody{
+		{"time": "2020-10-27T15:36:14.300Z", "type": "platform.runtimeDone", "record": map[string]interface{}{"requestId": "1", "status": "timeout"}},
+		report("1", 3000.2, 60, ""),
+		report("2", 120, 128, "error"),
+		report("3", 2500, 120, "success"),
+		report("4", 100, 60, "success"),
+		{"time": "2020-10-27T15:36:14.500Z", "type": "platform.report", "record": map[string]interface{}{"requestId": "5", "synthetic": true}},
+	})
+	records := client.derivedRecords(false)
+	assertEqual(t, len(records), 4, "")
+	var reasons []string
+	for _, item := range records {
+		reasons = append(reasons, fmt.Sprint(item["type"], " ", item["record"].(map[string]interface{})["reason"], " ", item[SeverityField]))
+	}
+	assertEqual(t, strings.Join(reasons, ","), strings.Join([]string{
+		InvocationFailureRecordType + " timeout fatal",
+		InvocationFailureRecordType + " out_of_memory fatal",
+		InvocationWarningRecordType + " timeout_threshold warn",
+		InvocationWarningRecordType + " memory_threshold warn",
+	}, ","), "")
+	failure := records[0]["record"].(map[string]interface{})
+	assertEqual(t, failure["requestId"], "1", "")
+	assertEqual(t, failure["status"], "timeout", "the runtimeDone status should be used when the report has none")
+	assertEqual(t, failure["timeoutMs"], float64(3000), "")
+	assertEqual(t, failure["memoryHeadroomMB"], float64(68), "")
+	assertEqual(t, records[3]["record"].(map[string]interface{})["memoryUsedPercent"], 93.8, "")
+	assertEqual(t, len(client.derivedRecords(false)), 0, "records should only be sent once")
+}
+
+func TestCostEstimation(t *testing.T) {
+	table, err := cfg.ParsePriceTable(`{"ap-east-1":{"x86_64":{"gbSecond":0.00002865,"request":0.0000002}}}`, true)
+	assertEqual(t, err, nil, "")
+	price, _ := table.Lookup("ap-east-1", cfg.ArchitectureX86)
+	assertEqual(t, price.GBSecond, 0.00002865, "configured regions should use their prices")
+	price, _ = table.Lookup("eu-west-1", cfg.ArchitectureARM64)
+	assertEqual(t, price.GBSecond, 0.0000133334, "other regions should use the bundled prices")
+	_, err = cfg.ParsePriceTable(`{"us-east-1":{"mips":{"gbSecond":1}}}`, true)
+	assertEqual(t, err != nil, true, "unknown architectures should be rejected")
+
+	// 1024 MB for 1s is a GB-second
+	assertEqual(t, invocationCost(cfg.LambdaPrice{GBSecond: 0.0000166667, Request: 0.0000002}, 1000, 1024), 0.0000168667, "")
+	assertEqual(t, invocationCost(cfg.LambdaPrice{GBSecond: 0.0000166667, Request: 0.0000002}, 100, 128), 0.0000004083, "")
+
+	rules, _ := cfg.ParseMetricRules(`[{"name":"orders.count","type":"counter","regex":"order placed"}]`)
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	client := NewLogSenderClient(logger, &cfg.LambdaExtensionConfig{
+		FunctionName:  "orders",
+		LambdaRegion:  "eu-west-1",
+		EstimateCost:  true,
+		PriceTable:    cfg.DefaultPriceTable(),
+		MetricRules:   rules,
+		MetricsFormat: cfg.MetricsFormatCarbon2,
+	}).(*sumoLogicClient)
+	records := responseBody{
+		{"time": "2020-10-27T15:36:14.400Z", "type": "platform.report", "record": map[string]interface{}{
+			"requestId": "1",
+			"metrics":   map[string]interface{}{"durationMs": 921.5, "billedDurationMs": float64(1000), "memorySizeMB": float64(1024), "maxMemoryUsedMB": float64(74)},
+		}},
+	}
+	client.enhanceLogs(records)
+	price, _ = client.config.PriceTable.Lookup("eu-west-1", functionMetadata.Load().Architecture)
+	expected := invocationCost(price, 1000, 1024)
+	assertEqual(t, records[0][EstimatedCostField], expected, "")
+	_, chunks := client.metricsOutput(true)
+	assertEqual(t, strings.HasPrefix(chunks[0].payload, "metric=lambda.estimatedCostUSD function=orders  "+strconv.FormatFloat(expected, 'g', -1, 64)+" "), true, chunks[0].payload)
+
+	// tables without the bundled prices, as in managed instance mode, only price what they list
+	client.config.PriceTable, err = cfg.ParsePriceTable(`{"us-east-1":{"arm64":{"gbSecond":0.00001,"request":0}}}`, false)
+	assertEqual(t, err, nil, "")
+	_, ok := client.config.PriceTable.Lookup("eu-west-1", cfg.ArchitectureX86)
+	assertEqual(t, ok, false, "regions missing from the table should have no price")
+	unpriced := responseBody{{"time": "2020-10-27T15:36:14.500Z", "type": "platform.report", "record": map[string]interface{}{
+		"requestId": "2",
+		"metrics":   map[string]interface{}{"billedDurationMs": float64(1000), "memorySizeMB": float64(1024)},
+	}}}
+	client.enhanceLogs(unpriced)
+	_, estimated := unpriced[0][EstimatedCostField]
+	assertEqual(t, estimated, false, "records without a price should not be estimated")
+	_, chunks = client.metricsOutput(true)
+	assertEqual(t, len(chunks), 0, "records without a price should not add cost metrics")
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	client := NewLogSenderClient(logger, &cfg.LambdaExtensionConfig{
+		FunctionName:       "orders",
+		EnhanceJsonLogs:    false,
+		OrderedDelivery:    true,
+		MaxDataPayloadSize: 1024 * 1024,
+	}).(*sumoLogicClient)
+	// two batches sent together, the second one older, and a record without a time
+	first := responseBody{
+		{"time": "2020-10-27T15:36:14.500Z", "type": "function", "record": "third"},
+		{"time": "2020-10-27T15:36:14.500Z", "type": "function", "record": `{"msg":"fourth"}`},
+	}
+	second := responseBody{
+		{"time": "2020-10-27T15:36:14.4Z", "type": "function", "record": "first"},
+		{"time": "2020-10-27T15:36:14.400Z", "type": "function", "record": "second"},
+		{"type": "function", "record": "last"},
+	}
+	client.enhanceLogs(first)
+	client.enhanceLogs(second)
+	assertEqual(t, first[1][TimestampField], int64(1603812974500), "records replaced by their JSON should keep their time")
+	assertEqual(t, first[1][SequenceField].(uint64) < second[0][SequenceField].(uint64), true, "sequence should follow the order records are received in")
+
+	chunks, err := client.createChunks(append(first, second...))
+	assertEqual(t, err, nil, "")
+	var order []string
+	var previous uint64
+	for _, line := range strings.Split(strings.TrimSpace(chunks[0]), "\n") {
+		var record map[string]interface{}
+		assertEqual(t, json.Unmarshal([]byte(line), &record), nil, line)
+		if message, ok := record["message"].(string); ok {
+			order = append(order, message)
+		} else {
+			order = append(order, record["msg"].(string))
+		}
+		sequence := uint64(record[SequenceField].(float64))
+		assertEqual(t, sequence > 0 && sequence != previous, true, line)
+		previous = sequence
+	}
+	assertEqual(t, strings.Join(order, ","), "first,second,third,fourth,last", "records should be sorted by time then sequence")
+}
+
+func TestOversizedRecords(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	config := &cfg.LambdaExtensionConfig{MaxMessageSize: 1024, OversizedRecords: cfg.OversizedTruncate, MaxDataPayloadSize: 4096}
+	client := NewLogSenderClient(logger, config).(*sumoLogicClient)
+	// record returns a record encoded in exactly size bytes
+	record := func(size int) map[string]interface{} {
+		item := map[string]interface{}{"type": "function", DeliveryIDField: "env-1", "message": ""}
+		base, _ := json.Marshal(item)
+		item["message"] = strings.Repeat("a", size-len(base))
+		return item
+	}
+	decode := func(line string) map[string]interface{} {
+		var decoded map[string]interface{}
+		assertEqual(t, json.Unmarshal([]byte(line), &decoded), nil, line)
+		return decoded
+	}
+
+	atLimit, _ := json.Marshal(record(1024))
+	chunks, err := client.createChunks(responseBody{record(1024)})
+	assertEqual(t, err, nil, "")
+	assertEqual(t, chunks[0], string(atLimit), "records at the max message size should be sent as they are")
+
+	chunks, _ = client.createChunks(responseBody{record(1025)})
+	truncated := decode(chunks[0])
+	assertEqual(t, len(chunks[0]) <= 1024, true, chunks[0])
+	assertEqual(t, truncated[TruncatedField], true, "")
+	assertEqual(t, truncated[OriginalSizeField], float64(1025), "")
+	assertEqual(t, truncated[DeliveryIDField], "env-1", "fields besides the message should be kept")
+
+	config.OversizedRecords = cfg.OversizedSplit
+	message := strings.Repeat(`é"<a>`, 500)
+	chunks, _ = client.createChunks(responseBody{{"type": "function", DeliveryIDField: "env-2", "message": message}})
+	var lines []string
+	for _, chunk := range chunks {
+		lines = append(lines, strings.Split(chunk, "\n")...)
+	}
+	var rebuilt strings.Builder
+	for idx, line := range lines {
+		fragment := decode(line)
+		assertEqual(t, len(line) <= 1024, true, line)
+		assertEqual(t, fragment[FragmentIDField], "env-2", "fragments should share the delivery id of the record")
+		assertEqual(t, fragment[FragmentField], float64(idx+1), "")
+		assertEqual(t, fragment[FragmentCountField], float64(len(lines)), "")
+		rebuilt.WriteString(fragment["message"].(string))
+	}
+	assertEqual(t, rebuilt.String(), message, "fragments should join into the message")
+
+	// records without a message are split as a whole
+	chunks, _ = client.createChunks(responseBody{{"type": "custom", "payload": strings.Repeat("b", 2000)}})
+	first := decode(strings.Split(chunks[0], "\n")[0])
+	assertEqual(t, first[FragmentField], float64(1), "")
+	assertEqual(t, strings.HasPrefix(first["message"].(string), `{"payload":"bbb`), true, first["message"].(string))
+	assertEqual(t, first["type"], "custom", "")
+}
+
+func TestCreateChunksBoundaries(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	client := NewLogSenderClient(logger, &cfg.LambdaExtensionConfig{MaxDataPayloadSize: 2048}).(*sumoLogicClient)
+	record := func(size int) map[string]interface{} {
+		item := map[string]interface{}{"message": ""}
+		base, _ := json.Marshal(item)
+		item["message"] = strings.Repeat("a", size-len(base))
+		return item
+	}
+
+	// two lines and the newline between them fill a chunk exactly
+	chunks, _ := client.createChunks(responseBody{record(1000), record(1047)})
+	assertEqual(t, len(chunks), 1, "")
+	assertEqual(t, len(chunks[0]), 2048, "")
+	chunks, _ = client.createChunks(responseBody{record(1000), record(1048)})
+	assertEqual(t, len(chunks), 2, "a chunk should not go over the max payload size")
+	assertEqual(t, len(chunks[0]), 1000, "")
+
+	// without a max message size a line over the max payload size gets a chunk of its own, after no empty one
+	chunks, _ = client.createChunks(responseBody{record(3000), record(20)})
+	assertEqual(t, len(chunks), 2, "")
+	assertEqual(t, len(chunks[0]), 3000, "")
+	assertEqual(t, len(chunks[1]), 20, "")
+	chunks, _ = client.createChunks(responseBody{})
+	assertEqual(t, len(chunks), 0, "no records should make no chunks")
+}
+
+func TestFlushAllWritesPendingChunksAsLines(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	uploader := &fakeS3Uploader{}
+	config := &cfg.LambdaExtensionConfig{
+		SumoHTTPEndpoint:      server.URL,
+		MaxDataPayloadSize:    300,
+		NumRetry:              1,
+		MaxRetryAttempts:      1,
+		DeadLetterMaxAttempts: 5,
+		EnhanceJsonLogs:       true,
+		S3BucketName:          "failover",
+		S3Uploader:            uploader,
+	}
+	client := NewLogSenderClient(logger, config).(*sumoLogicClient)
+	logs := []byte(`[{"time":"2020-10-27T15:36:14.301Z","type":"function","record":"first"},{"time":"2020-10-27T15:36:14.302Z","type":"function","record":"second"},{"time":"2020-10-27T15:36:14.303Z","type":"function","record":"third"}]`)
+	assertEqual(t, client.SendAllLogs(context.Background(), [][]byte{logs}) != nil, true, "posts should fail")
+	assertEqual(t, client.pending.len() >= 2, true, "every chunk should be pending")
+
+	// failover is used on shutdown for what is left
+	config.EnableFailover = true
+	queued := []byte(`[{"time":"2020-10-27T15:36:15.301Z","type":"function","record":"fourth"}]`)
+	assertEqual(t, client.FlushAll([][]byte{queued}), nil, "")
+	assertEqual(t, uploader.uploads(), 1, "")
+	reader, err := gzip.NewReader(bytes.NewReader(uploader.bodies[0]))
+	assertEqual(t, err, nil, "")
+	body, _ := io.ReadAll(reader)
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		var record map[string]interface{}
+		assertEqual(t, json.Unmarshal([]byte(line), &record), nil, line)
+		messages = append(messages, record["message"].(string))
+	}
+	assertEqual(t, strings.Join(messages, ","), "first,second,third,fourth", "every record should be a line of its own")
+}
+
+func TestMetricsChunksStayOutOfFailover(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	uploader := &fakeS3Uploader{}
+	config := &cfg.LambdaExtensionConfig{
+		SumoHTTPEndpoint:   server.URL,
+		MaxDataPayloadSize: 1024,
+		NumRetry:           1,
+		MaxRetryAttempts:   1,
+		EnableFailover:     true,
+		S3BucketName:       "failover",
+		S3Uploader:         uploader,
+	}
+	client := NewLogSenderClient(logger, config).(*sumoLogicClient)
+	chunk := outgoingChunk{id: nextChunkID(), payload: "metric=Duration function=f  12 1603813374", headers: sourceHeaders{contentType: carbon2ContentType}}
+	assertEqual(t, client.sendChunks(context.Background(), []outgoingChunk{chunk}) != nil, true, "the post should fail")
+	assertEqual(t, uploader.uploads(), 0, "metrics should not be written as log records")
+	assertEqual(t, client.pending.len(), 1, "metrics should be kept for the metrics source")
+
+	assertEqual(t, client.FlushAll(nil), nil, "")
+	assertEqual(t, uploader.uploads(), 0, "metrics should not be flushed to the failover bucket")
+	assertEqual(t, client.pending.len(), 0, "")
+}
+
+func TestSendChunksKeepsRetryableFailures(t *testing.T) {
+	logger := logrus.New().WithField("Name", "sumologic-extension")
+	var mu sync.Mutex
+	status := http.StatusTooManyRequests
+	deadLettered := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := gzip.NewReader(r.Body)
+		assertEqual(t, err, nil, "payload should be gzipped")
+		body, _ := io.ReadAll(reader)
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Contains(string(body), DeadLetterRecordType) {
+			deadLettered++
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	config := &cfg.LambdaExtensionConfig{
+		SumoHTTPEndpoint:      server.URL,
+		MaxDataPayloadSize:    300,
+		NumRetry:              1,
+		MaxRetryAttempts:      1,
+		DeadLetterMaxAttempts: 2,
+		DeadLetterTarget:      cfg.DeadLetterTargetSumo,
+		DeadLetterFile:        filepath.Join(t.TempDir(), "dlq.ndjson"),
+		EnhanceJsonLogs:       true,
+	}
+	client := NewLogSenderClient(logger, config).(*sumoLogicClient)
+	logs := []byte(`[{"time":"2020-10-27T15:36:14.301Z","type":"function","record":"first"}]`)
+	client.SendAllLogs(context.Background(), [][]byte{logs})
+	for i := 0; i < 5; i++ {
+		client.SendAllLogs(context.Background(), nil)
+	}
+	assertEqual(t, client.pending.len(), 1, "throttled chunks should stay pending whatever the attempts")
+	assertEqual(t, deadLettered, 0, "")
+
+	// an outage is not a delivery
+	mu.Lock()
+	status = http.StatusServiceUnavailable
+	mu.Unlock()
+	for i := 0; i < 5; i++ {
+		assertEqual(t, client.SendAllLogs(context.Background(), nil) != nil, true, "a 503 should fail the send")
+	}
+	assertEqual(t, client.pending.len(), 1, "chunks failing with 5xx should stay pending whatever the attempts")
+	assertEqual(t, deadLettered, 0, "")
+
+	mu.Lock()
+	status = http.StatusBadRequest
+	mu.Unlock()
+	client.SendAllLogs(context.Background(), nil)
+	client.SendAllLogs(context.Background(), nil)
+	assertEqual(t, client.pending.len(), 0, "rejected chunks should run out of attempts")
+	assertEqual(t, deadLettered, 1, "")
+
+	// chunks pushed out of the retry list do not go to the failing endpoint
+	mu.Lock()
+	status = http.StatusTooManyRequests
+	mu.Unlock()
+	var records []string
+	for i := 0; i < maxPendingChunks+3; i++ {
+		records = append(records, fmt.Sprintf(`{"time":"2020-10-27T15:36:14.301Z","type":"function","record":"%d %s"}`, i, strings.Repeat("x", 150)))
+	}
+	client.SendAllLogs(context.Background(), [][]byte{[]byte("[" + strings.Join(records, ",") + "]")})
+	assertEqual(t, client.pending.len(), maxPendingChunks, "")
+	assertEqual(t, deadLettered, 1, "")
+	written, err := os.ReadFile(config.DeadLetterFile)
+	assertEqual(t, err, nil, "")
+	assertEqual(t, strings.Count(string(written), "\n"), 3, "")
 }
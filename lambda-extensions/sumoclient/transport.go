@@ -0,0 +1,119 @@
+package sumoclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+)
+
+const (
+	// idleConnTimeout closes pooled connections before the Sumo Logic load balancers do
+	idleConnTimeout = 50 * time.Second
+	// maxDrainBytes bounds what is read from a response body so its connection can be reused,
+	// larger bodies are cheaper to drop with their connection
+	maxDrainBytes = 64 * 1024
+	// prewarmTimeout bounds the connection set up during init
+	prewarmTimeout = 5 * time.Second
+)
+
+// newHTTPClient returns the client posting to Sumo Logic. Its idle pool holds a connection per concurrent
+// request, so a flush reuses connections instead of paying a TCP and TLS handshake per chunk.
+func newHTTPClient(cfg *config.LambdaExtensionConfig) (*http.Client, error) {
+	connections := cfg.MaxConcurrentRequests
+	if connections < 1 {
+		connections = 1
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// resumed sessions skip the full handshake when a pooled connection was closed
+		ClientSessionCache: tls.NewLRUClientSessionCache(connections),
+	}
+	if cfg.HTTPCABundle != "" {
+		rootCAs, err := loadCABundle(cfg.HTTPCABundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	transport := &http.Transport{
+		// honours HTTPS_PROXY and NO_PROXY
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.HTTPConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   cfg.HTTPConnectTimeout,
+		ResponseHeaderTimeout: cfg.HTTPHeaderTimeout,
+		ForceAttemptHTTP2:     cfg.EnableHTTP2,
+		MaxIdleConns:          connections,
+		MaxIdleConnsPerHost:   connections,
+		IdleConnTimeout:       idleConnTimeout,
+	}
+	if !cfg.EnableHTTP2 {
+		// a non nil empty map disables HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{Timeout: cfg.ConnectionTimeoutValue, Transport: transport}, nil
+}
+
+// loadCABundle returns the system roots with the PEM certificates of path added, for endpoints
+// reached through a TLS inspecting proxy
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil || rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if !rootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in CA bundle %s", path)
+	}
+	return rootCAs, nil
+}
+
+// closeResponse drains and closes a response body, an unread body keeps its connection out of the idle pool
+func (s *sumoLogicClient) closeResponse(response *http.Response) {
+	if response == nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, maxDrainBytes))
+	if err := response.Body.Close(); err != nil {
+		s.logger.Debugf("failed to close body: %v", err)
+	}
+}
+
+// prewarm opens a connection to the endpoint with a HEAD request, which ingests nothing, so the first
+// flush does not pay for DNS, TCP and TLS set up. It also fills the KMS endpoint cache.
+func (s *sumoLogicClient) prewarm(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, prewarmTimeout)
+	defer cancel()
+	start := time.Now()
+	endpoint, err := s.getHttpEndpoint(ctx)
+	if err != nil {
+		s.logger.Warnf("prewarm: %v", err)
+		return
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
+	if err != nil {
+		s.logger.Warnf("prewarm: %v", err)
+		return
+	}
+	response, err := s.httpClient.Do(request)
+	if err != nil {
+		s.logger.Warnf("prewarm: Unable to connect to Sumo Logic: %v", err)
+		return
+	}
+	s.closeResponse(response)
+	s.logger.Debugf("prewarm: Connected to Sumo Logic in %v using %s", time.Since(start), response.Proto)
+}
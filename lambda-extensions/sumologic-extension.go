@@ -2,15 +2,18 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
 
 	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/lambdaapi"
+	sumocli "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/sumoclient"
 	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/workers"
 
 	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
@@ -22,6 +25,7 @@ var (
 	extensionName   = filepath.Base(os.Args[0]) // extension name has to match the filename
 	extensionClient = lambdaapi.NewClient(os.Getenv("AWS_LAMBDA_RUNTIME_API"), extensionName)
 	logger          = logrus.New().WithField("Name", extensionName)
+	initStart       = time.Now()
 )
 
 var producer workers.TaskProducer
@@ -30,14 +34,20 @@ var managedInstanceProducer workers.ManagedInstanceTaskProducer
 var managedInstanceConsumer workers.ManagedInstanceTaskConsumer
 var config *cfg.LambdaExtensionConfig
 var dataQueue chan []byte
-var flushSignal chan string
+var flushSignal *workers.FlushSignaler
 var isManagedInstance bool
+var lifecycle *workers.Lifecycle
+var flushScheduler *workers.FlushScheduler
+var lifecycleStartErr error
+
+// shutdownDeadlineMargin is kept free before the SHUTDOWN event deadline so the extension exits in time
+const shutdownDeadlineMargin = 100 * time.Millisecond
+
+// initDurationWarning is most of the 10 seconds the function and its extensions get to initialize
+const initDurationWarning = 7 * time.Second
 
 func init() {
-	Formatter := new(logrus.TextFormatter)
-	Formatter.TimestampFormat = "2006-01-02T15:04:05.999999999Z07:00"
-	Formatter.FullTimestamp = true
-	logger.Logger.SetFormatter(Formatter)
+	logger.Logger.SetFormatter(utils.NewLogFormatter(utils.LogFormatText))
 
 	logger.Logger.SetOutput(os.Stdout)
 
@@ -49,77 +59,152 @@ func init() {
 	}
 
 	logger.Logger.SetLevel(config.LogLevel)
+	logger.Logger.SetFormatter(utils.NewLogFormatter(config.ExtensionLogFormat))
 	dataQueue = make(chan []byte, config.MaxDataQueueLength)
+	if config.ForwardExtensionLogs {
+		logger.Logger.AddHook(workers.NewExtensionLogHook(dataQueue, config.ForwardLogLevel))
+	}
+	producerLogger := logger.WithField(utils.LogFieldComponent, "producer")
+	consumerLogger := logger.WithField(utils.LogFieldComponent, "consumer")
+	lifecycleLogger := logger.WithField(utils.LogFieldComponent, "lifecycle")
 
 	// Check initialization type to determine if managed instance mode should be used
 	initializationType := os.Getenv("AWS_LAMBDA_INITIALIZATION_TYPE")
-	if initializationType == "lambda-managed-instances" {
+	if initializationType == cfg.ManagedInstancesInitType {
 		isManagedInstance = true
 		logger.Debug("Initializing in Managed Instance mode")
 
-		// Initialize flushSignal channel for managed instance mode communication
-		flushSignal = make(chan string, 10) // Buffered channel to prevent blocking
+		// Initialize flushSignal for managed instance mode communication, signals are coalesced and never block
+		flushSignal = workers.NewFlushSignaler()
 
-		// Initialize Managed Instance Producer and start it in a goroutine
-		managedInstanceProducer = workers.NewManagedInstanceTaskProducer(dataQueue, flushSignal, logger)
-		go func() {
-			if err := managedInstanceProducer.Start(); err != nil {
-				logger.Errorf("managedInstanceProducer Start failed: %v", err)
-			}
-		}()
-
-		// Initialize Managed Instance Consumer and start it
-		managedInstanceConsumer = workers.NewManagedInstanceTaskConsumer(dataQueue, flushSignal, config, logger)
-		// Start the consumer's independent processing loop
-		ctx := context.Background()
-		managedInstanceConsumer.Start(ctx)
-
-		logger.Debug("Managed Instance mode initialization complete")
+		// Initialize Managed Instance Producer and Consumer, the consumer runs its own processing loop
+		// Requests run concurrently, the tracker follows each of them until it reports
+		requestTracker := workers.NewRequestTracker(config.RequestReportTimeout)
+		managedInstanceProducer = workers.NewManagedInstanceTaskProducer(dataQueue, flushSignal, requestTracker, config, producerLogger)
+		managedInstanceConsumer = workers.NewManagedInstanceTaskConsumer(dataQueue, flushSignal, requestTracker, config, consumerLogger)
+		lifecycle = workers.NewManagedInstanceLifecycle(managedInstanceProducer, managedInstanceConsumer, lifecycleLogger)
 	} else {
 		logger.Debug("Initializing in standard mode")
-		// Start HTTP Server before subscription in a goRoutine
-		producer = workers.NewTaskProducer(dataQueue, logger)
-		go func() {
-			if err := producer.Start(); err != nil {
-				logger.Errorf("producer Start failed: %v", err)
-			}
-		}()
+		// Creating producer and SumoTaskConsumer
+		producer = workers.NewTaskProducer(dataQueue, config, producerLogger)
+		consumer = workers.NewTaskConsumer(dataQueue, config, consumerLogger)
+		flushScheduler = workers.NewFlushScheduler(consumer, config, consumerLogger)
+		lifecycle = workers.NewLifecycle(producer, consumer, lifecycleLogger)
+	}
 
-		// Creating SumoTaskConsumer
-		consumer = workers.NewTaskConsumer(dataQueue, config, logger)
-		logger.Debug("Standard mode initialization complete")
+	// Start the server before subscription, consumer loop first in managed instance mode
+	lifecycleStartErr = lifecycle.Start(context.Background())
+	if lifecycleStartErr != nil {
+		logger.Error("Error during starting the extension: ", lifecycleStartErr.Error())
+	} else {
+		logger.Debug("Initialization complete")
 	}
 
 	logger.Debug("Is Managed Instance value: ", isManagedInstance)
 }
 
-func runTimeAPIInit() (int64, error) {
+// runTimeAPIInit registers and subscribes the extension, it returns the first event in standard mode
+func runTimeAPIInit() (*lambdaapi.NextEventResponse, error) {
 	// Register early so Runtime could start in parallel
 	logger.Debug("Registering Extension to Run Time API Client..........")
 	registerResponse, err := extensionClient.RegisterExtension(context.TODO(), isManagedInstance)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	logger.Debug("Succcessfully Registered with Run Time API Client: ", utils.PrettyPrint(registerResponse))
 
-	// Subscribe to Telemetry API
+	if lifecycleStartErr != nil {
+		if _, err := extensionClient.InitError(context.TODO(), "Extension.StartFailed"); err != nil {
+			logger.Error("Error during reporting init error: ", err.Error())
+		}
+		return nil, lifecycleStartErr
+	}
+
+	if config.PreflightMode != cfg.PreflightOff {
+		if err := runPreflight(context.TODO()); err != nil {
+			return nil, err
+		}
+	}
+
+	// Subscribe to Telemetry API, falling back to older schemas and the Logs API on older runtimes
 	logger.Debug("Subscribing Extension to Telemetry API........")
-	subscribeResponse, err := extensionClient.SubscribeToTelemetryAPI(context.TODO(), config.LogTypes, config.TelemetryTimeoutMs, config.TelemetryMaxBytes, config.TelemetryMaxItems, isManagedInstance)
+	destination := lambdaapi.Destination{Protocol: config.TelemetryProtocol, Port: config.TelemetryReceiverPort}
+	if isManagedInstance && destination.Protocol != lambdaapi.HTTPProtocol {
+		// managed instance producer inspects each HTTP batch for flush signals
+		logger.Warnf("Telemetry protocol %s is not supported in Managed Instance mode, using %s", destination.Protocol, lambdaapi.HTTPProtocol)
+		destination.Protocol = lambdaapi.HTTPProtocol
+	}
+	candidates, err := lambdaapi.SchemaCandidates(config.TelemetrySchema, isManagedInstance)
+	if err != nil {
+		return nil, err
+	}
+	subscribeRequest := lambdaapi.SubscribeRequest{
+		Destination: destination,
+		Types:       config.LogTypes,
+		TimeoutMs:   config.TelemetryTimeoutMs,
+		MaxBytes:    config.TelemetryMaxBytes,
+		MaxItems:    config.TelemetryMaxItems,
+	}
+	schema, subscribeResponse, err := extensionClient.Subscribe(context.TODO(), subscribeRequest, candidates)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	logger.Debug("Successfully subscribed to Telemetry API: ", utils.PrettyPrint(string(subscribeResponse)))
+	logger.Infof("Successfully subscribed with schema %s", schema)
+	if !isManagedInstance && !schema.ReportsRuntimeDone() {
+		flushScheduler.RuntimeDoneUnavailable(fmt.Sprintf("schema %s does not report runtimeDone", schema))
+	}
+	logger.Debug("Subscription response: ", utils.PrettyPrint(string(subscribeResponse)))
 
-	// Call next to say registration is successful and get the deadtimems
-	if !isManagedInstance {
-		nextResponse, err := nextEvent(context.TODO())
-		if err != nil {
-			return 0, err
-		}
-		return nextResponse.DeadlineMs, nil
+	logInitDuration()
+
+	if isManagedInstance {
+		// INVOKE events are not received, the metadata is completed from the caller identity
+		sumocli.ResolveManagedInstanceMetadata(config, logger)
+		return nil, nil
+	}
+	// Call next to say registration is successful and get the first event
+	return nextEvent(context.TODO())
+}
+
+// runPreflight checks the endpoint can be reached. A failure is reported to /init/error in strict
+// mode and only logged in lenient mode, where the extension keeps going.
+func runPreflight(ctx context.Context) error {
+	preflightLogger := logger.WithField(utils.LogFieldComponent, "preflight")
+	steps, err := sumocli.Preflight(ctx, config, preflightLogger)
+	for _, step := range steps {
+		preflightLogger.WithFields(logrus.Fields{
+			"step":       step.Name,
+			"durationMs": step.Duration.Milliseconds(),
+			"skipped":    step.Skipped,
+		}).Debug("Preflight check done")
+	}
+	if err == nil {
+		preflightLogger.WithField(utils.LogFieldStatus, "passed").Info("Preflight checks passed")
+		return nil
+	}
+	preflightLogger = preflightLogger.WithFields(logrus.Fields{utils.LogFieldStatus: "failed", "mode": config.PreflightMode})
+	if config.PreflightMode == cfg.PreflightLenient {
+		preflightLogger.Errorf("PREFLIGHT FAILED, logs may not reach Sumo Logic: %v", err)
+		return nil
+	}
+	preflightLogger.Errorf("Preflight failed, failing init: %v", err)
+	if _, initErr := extensionClient.InitError(ctx, "Extension.PreflightFailed"); initErr != nil {
+		logger.Error("Error during reporting init error: ", initErr.Error())
 	}
-	return 0, nil
+	return err
+}
+
+// logInitDuration logs how long the extension took to initialize, most of the init budget
+// being used is logged as a warning
+func logInitDuration() {
+	initDuration := time.Since(initStart)
+	initLogger := logger.WithField("initDurationMs", initDuration.Milliseconds())
+	if initDuration > initDurationWarning {
+		initLogger.Warnf("Extension init took %v of the %v init budget", initDuration, 10*time.Second)
+		return
+	}
+	initLogger.Info("Extension init complete")
 }
 
 func nextEvent(ctx context.Context) (*lambdaapi.NextEventResponse, error) {
@@ -131,45 +216,65 @@ func nextEvent(ctx context.Context) (*lambdaapi.NextEventResponse, error) {
 	return nextResponse, nil
 }
 
+// shutdownDeadline returns the deadline of the SHUTDOWN event, or the configured timeout when there is none
+func shutdownDeadline(deadlineMs int64) time.Time {
+	if deadlineMs > 0 {
+		return time.UnixMilli(deadlineMs).Add(-shutdownDeadlineMargin)
+	}
+	return time.Now().Add(config.ShutdownTimeout)
+}
+
+// invoked is called on INVOKE events, which are only received in standard mode
+func invoked(ctx context.Context, event *lambdaapi.NextEventResponse) {
+	sumocli.ResolveFunctionMetadata(event.InvokedFunctionArn, config, logger)
+	sumocli.ObserveInvokeDeadline(event.DeadlineMs)
+	flushScheduler.Invoked(ctx, event.DeadlineMs)
+}
+
 // processEvents is - Will block until shutdown event is received or cancelled via the context..
-func processEvents(ctx context.Context) {
-	_, err := runTimeAPIInit()
+// It returns the deadline by which the extension has to be shut down.
+func processEvents(ctx context.Context) time.Time {
+	firstEvent, err := runTimeAPIInit()
 	if err != nil {
 		logger.Error("Error during Registration: ", err.Error())
-		return
+		return shutdownDeadline(0)
+	}
+	if !isManagedInstance {
+		// the flush started during an invocation has to be done before shutting down
+		defer flushScheduler.Wait()
+		if firstEvent.EventType == lambdaapi.Shutdown {
+			return shutdownDeadline(firstEvent.DeadlineMs)
+		}
+		if firstEvent.EventType == lambdaapi.Invoke {
+			invoked(ctx, firstEvent)
+		}
 	}
 
 	// The For loop will continue till we recieve a shutdown event.
 	for {
 		select {
 		case <-ctx.Done():
-			consumer.FlushDataQueue(ctx)
-			return
+			return shutdownDeadline(0)
 		default:
 			if !isManagedInstance {
 				logger.Debugf("switching to other go routine")
 				runtime.Gosched()
-				logger.Infof("Calling DrainQueue from processEvents")
-				// for {
-				runtime_done := consumer.DrainQueue(ctx)
-				if runtime_done == 1 {
-					logger.Infof("Exiting DrainQueueLoop: Runtime is Done")
-				}
+				flushScheduler.BeforeNext(ctx)
 			}
 
-			// }
-
-			// This statement will freeze lambda
+			// This statement will freeze lambda, cancelling ctx unblocks it
 			nextResponse, err := nextEvent(ctx)
 			if err != nil {
 				logger.Error("Error during Next Event call: ", err.Error())
-				return
+				return shutdownDeadline(0)
 			}
 			// Next invoke will start from here
 			logger.Infof("Received Next Event as %s", nextResponse.EventType)
+			if nextResponse.EventType == lambdaapi.Invoke {
+				invoked(ctx, nextResponse)
+			}
 			if nextResponse.EventType == lambdaapi.Shutdown {
-				consumer.DrainQueue(ctx)
-				return
+				return shutdownDeadline(nextResponse.DeadlineMs)
 			}
 		}
 	}
@@ -184,11 +289,11 @@ func main() {
 	go func() {
 		s := <-sigs
 		cancel()
-		logger.Info("Received", s)
+		logger.WithField("signal", s.String()).Info("Received signal, stopping")
 	}()
 	defer func() {
 		if err := recover(); err != nil {
-			logger.Error("Extension failed:", err)
+			logger.WithField("panic", fmt.Sprint(err)).Error("Extension failed")
 			_, err := nextEvent(ctx)
 			if err != nil {
 				logger.Error("error during Next Event call: ", err.Error())
@@ -196,6 +301,13 @@ func main() {
 		}
 	}()
 	// Will block until shutdown event is received or cancelled via the context.
-	processEvents(ctx)
+	deadline := processEvents(ctx)
+
+	// ctx may already be cancelled, shutting down gets its own deadline
+	shutdownCtx, shutdownCancel := context.WithDeadline(context.Background(), deadline)
+	defer shutdownCancel()
+	if err := lifecycle.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("Shutdown did not complete cleanly: ", err.Error())
+	}
 	logger.Info("Stopping the Sumo Logic Extension................")
 }
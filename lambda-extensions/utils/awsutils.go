@@ -2,42 +2,170 @@ package utils
 
 import (
 	"context"
+	"fmt"
 	"io"
-	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
-var uploader *manager.Uploader
+// S3ObjectOptions are the optional attributes of an uploaded object
+type S3ObjectOptions struct {
+	ContentType     string
+	ContentEncoding string
+	// Metadata is stored as x-amz-meta-* headers
+	Metadata map[string]string
+	// SSEKMSKeyID enables SSE-KMS encryption with the given key
+	SSEKMSKeyID string
+}
+
+// S3Uploader sends objects to S3
+type S3Uploader interface {
+	Upload(ctx context.Context, bucketName string, keyName string, data io.Reader, options S3ObjectOptions) error
+}
+
+// s3Uploader creates its S3 client on the first upload, so the AWS SDK config is not loaded
+// during init when failover is disabled or never needed.
+type s3Uploader struct {
+	region   string
+	endpoint string
+	mu       sync.Mutex
+	uploader *manager.Uploader
+}
+
+// NewS3Uploader returns an uploader for region. endpoint overrides the S3 endpoint, for example
+// to use a local S3 compatible store, and is addressed with path style requests.
+func NewS3Uploader(region string, endpoint string) S3Uploader {
+	return &s3Uploader{region: region, endpoint: endpoint}
+}
 
-func init() {
-	awsRegion, found := os.LookupEnv("SUMO_S3_BUCKET_REGION")
-	if !found {
-		awsRegion = os.Getenv("AWS_REGION")
+// client returns the uploader, creating it if needed. A failure is returned and retried on the next upload.
+func (s *s3Uploader) client(ctx context.Context) (*manager.Uploader, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.uploader != nil {
+		return s.uploader, nil
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(s.region))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS SDK config: %w", err)
 	}
+	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if s.endpoint != "" {
+			o.BaseEndpoint = aws.String(s.endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	s.uploader = manager.NewUploader(s3Client)
+	return s.uploader, nil
+}
 
-	// Load AWS default config with region
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion(awsRegion),
-	)
+// Upload sends data to S3
+func (s *s3Uploader) Upload(ctx context.Context, bucketName string, keyName string, data io.Reader, options S3ObjectOptions) error {
+	uploader, err := s.client(ctx)
 	if err != nil {
-		panic("unable to load AWS SDK config, " + err.Error())
+		return err
 	}
+	input := &s3.PutObjectInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(keyName),
+		Body:     data,
+		Metadata: options.Metadata,
+	}
+	if options.ContentType != "" {
+		input.ContentType = aws.String(options.ContentType)
+	}
+	if options.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(options.ContentEncoding)
+	}
+	if options.SSEKMSKeyID != "" {
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(options.SSEKMSKeyID)
+	}
+	_, err = uploader.Upload(ctx, input)
+	return err
+}
 
-	// Create S3 client
-	s3Client := s3.NewFromConfig(cfg)
+// FunctionTagsReader reads the resource tags of a Lambda function
+type FunctionTagsReader interface {
+	ListTags(ctx context.Context, functionArn string) (map[string]string, error)
+}
 
-	// Create uploader
-	uploader = manager.NewUploader(s3Client)
+// lambdaTagsReader creates its Lambda client on the first call, like s3Uploader
+type lambdaTagsReader struct {
+	region string
+	mu     sync.Mutex
+	client *lambda.Client
 }
 
-// UploadToS3 sends data to S3
-func UploadToS3(bucketName *string, keyName *string, data io.Reader) error {
-	_, err := uploader.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket: bucketName,
-		Key:    keyName,
-		Body:   data,
-	})
-	return err
+// NewFunctionTagsReader returns a reader calling the Lambda API in region, the function role
+// needs the lambda:ListTags permission
+func NewFunctionTagsReader(region string) FunctionTagsReader {
+	return &lambdaTagsReader{region: region}
+}
+
+func (l *lambdaTagsReader) lambdaClient(ctx context.Context) (*lambda.Client, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.client != nil {
+		return l.client, nil
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(l.region))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS SDK config: %w", err)
+	}
+	l.client = lambda.NewFromConfig(cfg)
+	return l.client, nil
+}
+
+// ListTags returns the tags of the function
+func (l *lambdaTagsReader) ListTags(ctx context.Context, functionArn string) (map[string]string, error) {
+	client, err := l.lambdaClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	output, err := client.ListTags(ctx, &lambda.ListTagsInput{Resource: aws.String(functionArn)})
+	if err != nil {
+		return nil, err
+	}
+	return output.Tags, nil
+}
+
+// CallerIdentityReader reads the account and partition the function runs in
+type CallerIdentityReader interface {
+	CallerIdentity(ctx context.Context) (account string, partition string, err error)
+}
+
+// stsIdentityReader calls STS GetCallerIdentity, which needs no permission
+type stsIdentityReader struct {
+	region string
+}
+
+// NewCallerIdentityReader returns a reader calling STS in region
+func NewCallerIdentityReader(region string) CallerIdentityReader {
+	return &stsIdentityReader{region: region}
+}
+
+// CallerIdentity returns the account of the function role and the partition of its ARN
+func (r *stsIdentityReader) CallerIdentity(ctx context.Context) (string, string, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(r.region))
+	if err != nil {
+		return "", "", fmt.Errorf("unable to load AWS SDK config: %w", err)
+	}
+	output, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", "", err
+	}
+	partition := "aws"
+	if parts := strings.Split(aws.ToString(output.Arn), ":"); len(parts) > 1 && parts[1] != "" {
+		partition = parts[1]
+	}
+	return aws.ToString(output.Account), partition, nil
 }
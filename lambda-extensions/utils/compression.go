@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Encodings supported by the Sumo Logic HTTP source, the value is sent as the Content-Encoding header
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+	EncodingNone    = "none"
+)
+
+// resettableWriter is implemented by the gzip and zlib writers, it lets pooled writers be reused
+type resettableWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// Compressor compresses payloads with an encoding and level, reusing its writers across calls
+type Compressor struct {
+	encoding string
+	level    int
+	minBytes int
+	pool     sync.Pool
+}
+
+// NewCompressor returns a compressor for encoding, gzip when it is empty. level ranges from 1 (fastest)
+// to 9 (smallest), 0 uses the default level. Payloads smaller than minBytes are sent as is, compressing
+// them costs CPU and often makes them larger.
+func NewCompressor(encoding string, level int, minBytes int) (*Compressor, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	} else if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return nil, fmt.Errorf("compression level %d is not between %d and %d", level, gzip.BestSpeed, gzip.BestCompression)
+	}
+	if encoding == "" {
+		encoding = EncodingGzip
+	}
+	c := &Compressor{encoding: encoding, level: level, minBytes: minBytes}
+	switch encoding {
+	case EncodingGzip:
+		c.pool.New = func() interface{} {
+			w, _ := gzip.NewWriterLevel(io.Discard, c.level)
+			return w
+		}
+	case EncodingDeflate:
+		// HTTP deflate is the zlib format, not raw deflate
+		c.pool.New = func() interface{} {
+			w, _ := zlib.NewWriterLevel(io.Discard, c.level)
+			return w
+		}
+	case EncodingNone:
+	default:
+		return nil, fmt.Errorf("compression %s is unsupported", encoding)
+	}
+	return c, nil
+}
+
+// Compress returns data encoded and the Content-Encoding to send it with, which is empty when
+// data is sent uncompressed. data is not modified.
+func (c *Compressor) Compress(data []byte) ([]byte, string, error) {
+	if c.encoding == EncodingNone || len(data) < c.minBytes {
+		return data, "", nil
+	}
+	var buf bytes.Buffer
+	w := c.pool.Get().(resettableWriter)
+	w.Reset(&buf)
+	_, err := w.Write(data)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	// a writer is reset before its next use, so it can go back to the pool even after an error
+	c.pool.Put(w)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to %s compress payload: %w", c.encoding, err)
+	}
+	return buf.Bytes(), c.encoding, nil
+}
+
+// defaultGzip backs Compress and CompressBuffer, whose output is always gzip as S3 objects are read as gzip
+var defaultGzip, _ = NewCompressor(EncodingGzip, 0, 0)
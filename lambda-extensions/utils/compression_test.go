@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCompressor(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"time":"2020-10-27T15:36:14.301Z","type":"function","record":"hello"}`+"\n", 100))
+	readers := map[string]func(io.Reader) (io.Reader, error){
+		EncodingGzip:    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		EncodingDeflate: func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	}
+	for encoding, newReader := range readers {
+		compressor, err := NewCompressor(encoding, 9, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a second call reuses the pooled writer
+		for i := 0; i < 2; i++ {
+			compressed, contentEncoding, err := compressor.Compress(payload)
+			if err != nil || contentEncoding != encoding {
+				t.Fatalf("%s: unexpected encoding %q, error %v", encoding, contentEncoding, err)
+			}
+			reader, err := newReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatalf("%s: %v", encoding, err)
+			}
+			decompressed, err := io.ReadAll(reader)
+			if err != nil || !bytes.Equal(decompressed, payload) {
+				t.Fatalf("%s: payload changed by a round trip, error %v", encoding, err)
+			}
+		}
+	}
+
+	compressor, _ := NewCompressor(EncodingGzip, 0, len(payload)+1)
+	if data, contentEncoding, _ := compressor.Compress(payload); contentEncoding != "" || !bytes.Equal(data, payload) {
+		t.Fatal("payloads below the threshold should be sent as is")
+	}
+	if _, err := NewCompressor(EncodingGzip, 10, 0); err == nil {
+		t.Fatal("level 10 should be rejected")
+	}
+	if _, err := NewCompressor("zstd", 0, 0); err == nil {
+		t.Fatal("zstd should be rejected")
+	}
+}
+
+// BenchmarkCompress reports MB/s per encoding and level for a 1MB chunk, the CPU time per MB is its inverse.
+// Compare architectures with GOARCH=arm64 go test -bench Compress -run ^$ ./utils on a Graviton host.
+func BenchmarkCompress(b *testing.B) {
+	var payload bytes.Buffer
+	for i := 0; payload.Len() < 1024*1024; i++ {
+		fmt.Fprintf(&payload, `{"time":"2020-10-27T15:36:14.%03dZ","type":"function","record":"request %d processed in %d ms"}`+"\n", i%1000, i, i%250)
+	}
+	for _, encoding := range []string{EncodingGzip, EncodingDeflate} {
+		for _, level := range []int{1, 6, 9} {
+			compressor, err := NewCompressor(encoding, level, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("%s-%d", encoding, level), func(b *testing.B) {
+				b.SetBytes(int64(payload.Len()))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, _, err := compressor.Compress(payload.Bytes()); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
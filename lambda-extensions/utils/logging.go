@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// Structured fields shared by the log lines of the extension
+const (
+	LogFieldComponent = "component"
+	LogFieldRequestID = "requestId"
+	LogFieldChunkID   = "chunkId"
+	LogFieldAttempt   = "attempt"
+	LogFieldStatus    = "status"
+	// LogFieldDelivery marks entries about sending telemetry, they are not forwarded to Sumo Logic: during
+	// an outage they would be queued along the telemetry failing to be sent and add to it
+	LogFieldDelivery = "delivery"
+)
+
+// Log formats of the extension's own logs
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// logTimestampFormat keeps nanoseconds so lines logged in the same millisecond stay ordered
+const logTimestampFormat = "2006-01-02T15:04:05.999999999Z07:00"
+
+// NewLogFormatter returns the formatter for format, text when it is not json
+func NewLogFormatter(format string) logrus.Formatter {
+	if format == LogFormatJSON {
+		return &logrus.JSONFormatter{TimestampFormat: logTimestampFormat}
+	}
+	return &logrus.TextFormatter{TimestampFormat: logTimestampFormat, FullTimestamp: true}
+}
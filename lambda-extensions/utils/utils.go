@@ -2,10 +2,8 @@ package utils
 
 import (
 	"bytes"
-	"compress/gzip"
 	"encoding/json"
 	"errors"
-	"fmt"
 )
 
 //------------------Retry Logic Code-------------------------------
@@ -46,34 +44,17 @@ func StringInSlice(a string, list []string) bool {
 
 // Compress compresses string and returns byte array
 func Compress(logStringToSend *string) ([]byte, error) {
-	var buf bytes.Buffer
-	g := gzip.NewWriter(&buf)
-
-	if _, err := g.Write([]byte(*logStringToSend)); err != nil {
-		return nil, fmt.Errorf("failed to write log string: %w", err)
-	}
-
-	if err := g.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close gzip writer: %w", err)
-	}
-
-	return buf.Bytes(), nil
+	data, _, err := defaultGzip.Compress([]byte(*logStringToSend))
+	return data, err
 }
 
 // CompressBuffer compresses string and returns byte array
 func CompressBuffer(inputbuf *bytes.Buffer) (*bytes.Buffer, error) {
-	var outputbuf bytes.Buffer
-	g := gzip.NewWriter(&outputbuf)
-
-	if _, err := g.Write(inputbuf.Bytes()); err != nil {
-		return nil, fmt.Errorf("failed to compress buffer: %w", err)
-	}
-
-	if err := g.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close gzip writer: %w", err)
+	data, _, err := defaultGzip.Compress(inputbuf.Bytes())
+	if err != nil {
+		return nil, err
 	}
-
-	return &outputbuf, nil
+	return bytes.NewBuffer(data), nil
 }
 
 // PrettyPrint is to print the object
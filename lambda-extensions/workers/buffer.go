@@ -0,0 +1,167 @@
+package workers
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxSpoolBytes keeps the spool from filling up /tmp, larger buffers are only held in memory
+const maxSpoolBytes = 64 * 1024 * 1024
+
+// Reasons a buffer is flushed
+const (
+	BufferFlushBytes   = "bytes"
+	BufferFlushRecords = "records"
+	BufferFlushAge     = "age"
+)
+
+// telemetryBuffer holds telemetry payloads across invocations until a size target or the max age is
+// reached, so frequent invocations share a post instead of paying one each. While payloads are held
+// they are spooled to a file, which a restarted extension sends first.
+type telemetryBuffer struct {
+	config   *cfg.LambdaExtensionConfig
+	logger   *logrus.Entry
+	payloads [][]byte
+	bytes    int64
+	records  int
+	oldest   time.Time
+	// spooled is set when the spool file holds every payload of the buffer
+	spooled bool
+	now     func() time.Time
+}
+
+// newTelemetryBuffer returns nil when no buffer target is configured, payloads are then sent on every invocation
+func newTelemetryBuffer(config *cfg.LambdaExtensionConfig, logger *logrus.Entry) *telemetryBuffer {
+	if config.BufferBytes <= 0 && config.BufferRecords <= 0 {
+		return nil
+	}
+	buffer := &telemetryBuffer{config: config, logger: logger, now: time.Now}
+	buffer.recover()
+	return buffer
+}
+
+// add buffers payloads received now
+func (b *telemetryBuffer) add(payloads ...[]byte) {
+	for _, payload := range payloads {
+		b.addAt(payload, b.now())
+	}
+}
+
+func (b *telemetryBuffer) addAt(payload []byte, received time.Time) {
+	if len(b.payloads) == 0 || received.Before(b.oldest) {
+		b.oldest = received
+	}
+	b.payloads = append(b.payloads, payload)
+	b.bytes += int64(len(payload))
+	b.records += countRecords(payload)
+	b.spooled = false
+}
+
+// due returns why the buffer has to be flushed, empty when it can wait for more payloads
+func (b *telemetryBuffer) due() string {
+	switch {
+	case len(b.payloads) == 0:
+		return ""
+	case b.config.BufferBytes > 0 && b.bytes >= b.config.BufferBytes:
+		return BufferFlushBytes
+	case b.config.BufferRecords > 0 && b.records >= b.config.BufferRecords:
+		return BufferFlushRecords
+	case b.now().Sub(b.oldest) >= b.config.BufferMaxAge:
+		return BufferFlushAge
+	}
+	return ""
+}
+
+// take empties the buffer and its spool, the payloads returned are the caller's to deliver
+func (b *telemetryBuffer) take() [][]byte {
+	payloads := b.payloads
+	b.payloads = nil
+	b.bytes = 0
+	b.records = 0
+	b.oldest = time.Time{}
+	b.spooled = false
+	if b.config.BufferSpool {
+		if err := os.Remove(b.config.BufferSpoolFile); err != nil && !os.IsNotExist(err) {
+			b.logger.Warnf("Unable to remove the buffer spool: %v", err)
+		}
+	}
+	return payloads
+}
+
+// spool writes the buffer to the spool file, called before the environment may be frozen. The file is
+// replaced with a rename so a crash never leaves a partial spool behind.
+func (b *telemetryBuffer) spool() {
+	if !b.config.BufferSpool || b.spooled || len(b.payloads) == 0 {
+		return
+	}
+	if b.bytes > maxSpoolBytes {
+		b.logger.Warnf("Not spooling the buffer, its %d bytes are over %d", b.bytes, maxSpoolBytes)
+		return
+	}
+	// payloads are spooled as strings, one which is not valid JSON is still dead lettered when sent
+	spooled := make([]string, 0, len(b.payloads))
+	for _, payload := range b.payloads {
+		spooled = append(spooled, string(payload))
+	}
+	data, err := json.Marshal(spooled)
+	if err != nil {
+		b.logger.Warnf("Unable to spool the buffer: %v", err)
+		return
+	}
+	tmpFile := b.config.BufferSpoolFile + ".tmp"
+	err = os.MkdirAll(filepath.Dir(b.config.BufferSpoolFile), 0o700)
+	if err == nil {
+		err = os.WriteFile(tmpFile, data, 0o600)
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, b.config.BufferSpoolFile)
+	}
+	if err != nil {
+		b.logger.Warnf("Unable to spool the buffer: %v", err)
+		return
+	}
+	b.spooled = true
+}
+
+// recover buffers the payloads spooled by a previous extension process in this environment, they are as
+// old as the spool file
+func (b *telemetryBuffer) recover() {
+	if !b.config.BufferSpool {
+		return
+	}
+	info, err := os.Stat(b.config.BufferSpoolFile)
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(b.config.BufferSpoolFile)
+	if err != nil {
+		b.logger.Warnf("Unable to read the buffer spool: %v", err)
+		return
+	}
+	var payloads []string
+	if err := json.Unmarshal(data, &payloads); err != nil {
+		b.logger.Warnf("Dropping an unreadable buffer spool: %v", err)
+		_ = os.Remove(b.config.BufferSpoolFile)
+		return
+	}
+	for _, payload := range payloads {
+		b.addAt([]byte(payload), info.ModTime())
+	}
+	b.spooled = true
+	b.logger.Infof("Recovered %d buffered payloads from the spool", len(payloads))
+}
+
+// countRecords returns the number of records of a telemetry payload, a JSON array
+func countRecords(payload []byte) int {
+	var records []json.RawMessage
+	if err := json.Unmarshal(payload, &records); err != nil {
+		return 1
+	}
+	return len(records)
+}
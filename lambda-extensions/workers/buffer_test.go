@@ -0,0 +1,115 @@
+package workers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+)
+
+func newTestBufferConfig(t *testing.T) *cfg.LambdaExtensionConfig {
+	return &cfg.LambdaExtensionConfig{
+		MaxConcurrentRequests: 1,
+		BufferBytes:           1024,
+		BufferRecords:         5,
+		BufferMaxAge:          time.Minute,
+		BufferSpool:           true,
+		BufferSpoolFile:       filepath.Join(t.TempDir(), "spool.json"),
+	}
+}
+
+func TestTelemetryBufferTargets(t *testing.T) {
+	if newTelemetryBuffer(&cfg.LambdaExtensionConfig{BufferMaxAge: time.Minute}, newTestLogger()) != nil {
+		t.Fatal("buffering should be disabled without targets")
+	}
+	config := newTestBufferConfig(t)
+	now := time.Now()
+	buffer := newTelemetryBuffer(config, newTestLogger())
+	buffer.now = func() time.Time { return now }
+
+	buffer.add([]byte(`[{"type":"function","record":"a"},{"type":"function","record":"b"}]`))
+	if reason := buffer.due(); reason != "" {
+		t.Fatalf("buffer should wait for more records, got %s", reason)
+	}
+	buffer.add([]byte(`[{"type":"function","record":"c"},{"type":"function","record":"d"},{"type":"function","record":"e"}]`))
+	if reason := buffer.due(); reason != BufferFlushRecords {
+		t.Fatalf("expected the records target to be reached, got %q", reason)
+	}
+	if payloads := buffer.take(); len(payloads) != 2 || buffer.due() != "" {
+		t.Fatalf("take should return every payload and empty the buffer, got %d", len(payloads))
+	}
+
+	buffer.add(make([]byte, 2048))
+	if reason := buffer.due(); reason != BufferFlushBytes {
+		t.Fatalf("expected the bytes target to be reached, got %q", reason)
+	}
+	buffer.take()
+
+	buffer.add([]byte(`[{"type":"function","record":"a"}]`))
+	now = now.Add(time.Minute)
+	if reason := buffer.due(); reason != BufferFlushAge {
+		t.Fatalf("expected the max age to be reached, got %q", reason)
+	}
+}
+
+func TestTelemetryBufferSpool(t *testing.T) {
+	config := newTestBufferConfig(t)
+	buffer := newTelemetryBuffer(config, newTestLogger())
+	buffer.add([]byte(`[{"type":"function","record":"a"}]`), []byte(`not json`))
+	buffer.spool()
+
+	recovered := newTelemetryBuffer(config, newTestLogger())
+	if len(recovered.payloads) != 2 || string(recovered.payloads[1]) != "not json" || recovered.records != 2 {
+		t.Fatalf("spooled payloads should be recovered as they were, got %q", recovered.payloads)
+	}
+	recovered.take()
+	if _, err := os.Stat(config.BufferSpoolFile); !os.IsNotExist(err) {
+		t.Fatal("take should remove the spool")
+	}
+}
+
+func TestDrainQueueBuffersAcrossInvocations(t *testing.T) {
+	config := newTestBufferConfig(t)
+	sender := &countingSender{}
+	consumer := &sumoConsumer{
+		dataQueue:  make(chan []byte, 10),
+		logger:     newTestLogger(),
+		config:     config,
+		sumoclient: sender,
+		attempts:   newDeliveryAttempts(3),
+		buffer:     newTelemetryBuffer(config, newTestLogger()),
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		consumer.dataQueue <- []byte(`[{"type":"function","record":"a"},{"type":"platform.runtimeDone","record":{}}]`)
+		if consumer.DrainQueue(ctx) != 1 {
+			t.Fatal("runtimeDone should be reported while buffering")
+		}
+	}
+	if sender.sent.Load() != 0 {
+		t.Fatal("payloads under the targets should be buffered")
+	}
+	if _, err := os.Stat(config.BufferSpoolFile); err != nil {
+		t.Fatalf("buffered payloads should be spooled: %v", err)
+	}
+	consumer.dataQueue <- []byte(`[{"type":"function","record":"b"}]`)
+	consumer.DrainQueue(ctx)
+	if sender.sent.Load() != 3 {
+		t.Fatalf("reaching the records target should send every buffered payload, sent %d", sender.sent.Load())
+	}
+
+	consumer.dataQueue <- []byte(`[{"type":"function","record":"c"}]`)
+	lifecycle := NewLifecycle(&fakeProducer{rec: &recorder{}}, consumer, newTestLogger())
+	if err := lifecycle.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := lifecycle.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sender.sent.Load() != 4 {
+		t.Fatalf("shutdown should flush the buffer, sent %d", sender.sent.Load())
+	}
+}
@@ -1,12 +1,14 @@
 package workers
 
 import (
+	"bytes"
 	"context"
-	"strings"
 	"sync"
+	"time"
 
 	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
 	sumocli "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/sumoclient"
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
 
 	"github.com/sirupsen/logrus"
 )
@@ -30,6 +32,11 @@ type sumoConsumer struct {
 	logger     *logrus.Entry
 	config     *cfg.LambdaExtensionConfig
 	sumoclient sumocli.LogSender
+	attempts   *deliveryAttempts
+	// buffer is nil when payloads are sent on every invocation
+	buffer *telemetryBuffer
+	// held are payloads read from dataQueue while waiting for runtimeDone, drained before the queue
+	held [][]byte
 }
 
 // NewTaskConsumer returns a new consumer
@@ -38,14 +45,22 @@ func NewTaskConsumer(consumerQueue chan []byte, config *cfg.LambdaExtensionConfi
 		dataQueue:  consumerQueue,
 		logger:     logger,
 		sumoclient: sumocli.NewLogSenderClient(logger, config),
+		attempts:   newDeliveryAttempts(config.DeadLetterMaxAttempts),
 		config:     config,
+		buffer:     newTelemetryBuffer(config, logger),
 	}
 }
 
 // FlushDataQueue drains the dataqueue commpletely
+// dataQueue is left open, producers must be shut down before calling it so nothing is left behind.
 func (sc *sumoConsumer) FlushDataQueue(ctx context.Context) {
 	if sc.config.EnableFailover {
 		var rawMsgArr [][]byte
+		if sc.buffer != nil {
+			rawMsgArr = sc.buffer.take()
+		}
+		rawMsgArr = append(rawMsgArr, sc.held...)
+		sc.held = nil
 	Loop:
 		for {
 			//Receives block when the buffer is empty.
@@ -53,16 +68,17 @@ func (sc *sumoConsumer) FlushDataQueue(ctx context.Context) {
 			case rawmsg := <-sc.dataQueue:
 				rawMsgArr = append(rawMsgArr, rawmsg)
 			default:
-				err := sc.sumoclient.FlushAll(rawMsgArr)
-				if err != nil {
-					sc.logger.Errorln("Unable to flush DataQueue", err.Error())
-					// putting back all the msg to the queue in case of failure
-					for _, msg := range rawMsgArr {
-						sc.dataQueue <- msg
+				if len(rawMsgArr) > 0 {
+					err := sc.sumoclient.FlushAll(rawMsgArr)
+					if err != nil {
+						sc.logger.WithField(utils.LogFieldDelivery, true).Errorln("Unable to flush DataQueue", err.Error())
+						// putting back all the msg to the queue in case of failure
+						sc.requeue(ctx, rawMsgArr, err)
+						// TODO: raise alert if flush fails
+					} else {
+						sc.attempts.forget(rawMsgArr)
 					}
-					// TODO: raise alert if flush fails
 				}
-				close(sc.dataQueue)
 				sc.logger.Debugf("DataQueue completely drained")
 				break Loop
 			}
@@ -70,52 +86,139 @@ func (sc *sumoConsumer) FlushDataQueue(ctx context.Context) {
 	} else {
 		// calling drainqueue (during shutdown) if failover is not enabled
 		maxCallsNeededForCompleteDraining := (len(sc.dataQueue) / sc.config.MaxConcurrentRequests) + 1
-		for i := 0; i < maxCallsNeededForCompleteDraining; i++ {
-			sc.DrainQueue(ctx)
+		for i := 0; i < maxCallsNeededForCompleteDraining && ctx.Err() == nil; i++ {
+			sc.drain(ctx, true)
 		}
 	}
 
 }
 
+// HoldQueue reads dataQueue into memory until stop is closed, the payloads are sent by the next drain.
+// Standard mode has no consumer loop, this keeps producers from blocking on a full queue while they shut down.
+func (sc *sumoConsumer) HoldQueue(stop <-chan struct{}) {
+	for {
+		select {
+		case rawmsg := <-sc.dataQueue:
+			sc.held = append(sc.held, rawmsg)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// requeue puts messages back without blocking, messages failing too often are dead lettered
+func (sc *sumoConsumer) requeue(ctx context.Context, rawMsgArr [][]byte, err error) {
+	requeueOrDeadLetter(ctx, sc.dataQueue, rawMsgArr, sc.attempts, sc.sumoclient, sc.logger, err)
+}
+
 func (sc *sumoConsumer) consumeTask(ctx context.Context, wg *sync.WaitGroup, rawmsg []byte) {
 	defer wg.Done()
 	err := sc.sumoclient.SendLogs(ctx, rawmsg)
 	if err != nil {
-		sc.logger.Error("Error during Send Logs to Sumo Logic.", err.Error())
+		sc.logger.WithField(utils.LogFieldDelivery, true).Error("Error during Send Logs to Sumo Logic.", err.Error())
 		// putting back the msg to the queue in case of failure
-		sc.dataQueue <- rawmsg
+		sc.requeue(ctx, [][]byte{rawmsg}, err)
 		// TODO: raise alert if send logs fails
 	}
 }
 
+// DrainQueue sends the queued payloads, when buffering it only does so once a buffer target is reached
 func (sc *sumoConsumer) DrainQueue(ctx context.Context) int {
+	return sc.drain(ctx, false)
+}
+
+// FlushBuffer sends the queued and buffered payloads whatever the buffer targets, used on shutdown
+func (sc *sumoConsumer) FlushBuffer(ctx context.Context) {
+	sc.drain(ctx, true)
+}
+
+// BufferQueue moves the queued payloads to the buffer without sending them, it returns why the buffer
+// has to be flushed, empty when it can wait. Payloads are sent right away when nothing is buffered.
+func (sc *sumoConsumer) BufferQueue(ctx context.Context) string {
+	if sc.buffer == nil {
+		sc.drain(ctx, false)
+		return ""
+	}
+	rawMsgArr := sc.held
+	sc.held = nil
+Loop:
+	for {
+		select {
+		case rawmsg := <-sc.dataQueue:
+			rawMsgArr = append(rawMsgArr, rawmsg)
+		default:
+			break Loop
+		}
+	}
+	sc.buffer.add(rawMsgArr...)
+	// the environment may be frozen until the next invocation
+	sc.buffer.spool()
+	return sc.buffer.due()
+}
+
+// WaitRuntimeDone reads dataQueue until a payload holds the runtimeDone of an invocation, or until the
+// deadline. Payloads read are held for the next drain, it returns whether runtimeDone was received.
+func (sc *sumoConsumer) WaitRuntimeDone(ctx context.Context, deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case rawmsg := <-sc.dataQueue:
+			sc.held = append(sc.held, rawmsg)
+			if isRuntimeDone(rawmsg) {
+				return true
+			}
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (sc *sumoConsumer) drain(ctx context.Context, force bool) int {
 	//sc.logger.Debug("Consuming data from dataQueue")
 
-	var rawMsgArr [][]byte
-	var logsStr string
+	rawMsgArr := sc.held
+	sc.held = nil
 	var runtime_done = 0
+	for _, rawmsg := range rawMsgArr {
+		if isRuntimeDone(rawmsg) {
+			runtime_done = 1
+		}
+	}
 Loop:
 	for {
 		//Receives block when the buffer is empty.
 		select {
 		case rawmsg := <-sc.dataQueue:
 			rawMsgArr = append(rawMsgArr, rawmsg)
-			logsStr = string(rawmsg)
-			sc.logger.Debugf("DrainQueue: logsStr: %s", logsStr)
-			if strings.Contains(logsStr, string(RuntimeDone)) {
+			sc.logger.Debugf("DrainQueue: logsStr: %s", rawmsg)
+			if isRuntimeDone(rawmsg) {
 				runtime_done = 1
 			}
 
 		default:
+			if sc.buffer != nil {
+				sc.buffer.add(rawMsgArr...)
+				reason := sc.buffer.due()
+				if reason == "" && !force {
+					// the environment may be frozen until the next invocation
+					sc.buffer.spool()
+					sc.logger.Debugf("DrainQueue: Buffering %d records, %d bytes", sc.buffer.records, sc.buffer.bytes)
+					break Loop
+				}
+				sc.logger.Debugf("DrainQueue: Flushing %d buffered records, %d bytes, reason %s", sc.buffer.records, sc.buffer.bytes, reason)
+				rawMsgArr = sc.buffer.take()
+			}
 			err := sc.sumoclient.SendAllLogs(ctx, rawMsgArr)
 			if err != nil {
-				sc.logger.Errorln("Unable to flush DataQueue", err.Error())
+				sc.logger.WithField(utils.LogFieldDelivery, true).Errorln("Unable to flush DataQueue", err.Error())
 				// putting back all the msg to the queue in case of failure
-				for _, msg := range rawMsgArr {
-					sc.dataQueue <- msg
-				}
+				sc.requeue(ctx, rawMsgArr, err)
 				// TODO: raise alert if flush fails
 			} else {
+				sc.attempts.forget(rawMsgArr)
 				sc.logger.Debugf("DrainQueue: DataQueue completely drained")
 			}
 			break Loop
@@ -124,3 +227,8 @@ Loop:
 	sc.logger.Debugf("DrainQueue: Runtime done or not? %d", runtime_done)
 	return runtime_done
 }
+
+// isRuntimeDone returns whether a payload holds a platform.runtimeDone record
+func isRuntimeDone(rawmsg []byte) bool {
+	return bytes.Contains(rawmsg, []byte(RuntimeDone))
+}
@@ -0,0 +1,79 @@
+package workers
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"sync"
+
+	sumocli "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/sumoclient"
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// deliveryAttempts counts how often each queued payload failed to be sent, so a payload which keeps
+// failing is dead lettered instead of going around the queue forever
+type deliveryAttempts struct {
+	mu       sync.Mutex
+	failures map[[sha256.Size]byte]int
+	max      int
+}
+
+// newDeliveryAttempts returns a counter allowing max attempts per payload, 0 allows any number
+func newDeliveryAttempts(max int) *deliveryAttempts {
+	return &deliveryAttempts{failures: make(map[[sha256.Size]byte]int), max: max}
+}
+
+// fail records a failed attempt and reports whether the payload is out of attempts
+func (d *deliveryAttempts) fail(msg []byte) bool {
+	key := sha256.Sum256(msg)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures[key]++
+	if d.max > 0 && d.failures[key] >= d.max {
+		delete(d.failures, key)
+		return true
+	}
+	return false
+}
+
+// forget drops the count of payloads which were delivered or dropped
+func (d *deliveryAttempts) forget(msgs [][]byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// nothing has failed, which is the common case, skip hashing
+	if len(d.failures) == 0 {
+		return
+	}
+	for _, msg := range msgs {
+		delete(d.failures, sha256.Sum256(msg))
+	}
+}
+
+// requeueOrDeadLetter puts failed payloads back without blocking, the queue may already be full again.
+// Payloads out of attempts are handed to the dead letter target instead and never queued again.
+// Nothing is put back when the sender kept the failed chunks itself, the delivered ones would be duplicated.
+func requeueOrDeadLetter(ctx context.Context, dataQueue chan []byte, rawMsgArr [][]byte, attempts *deliveryAttempts, sender sumocli.LogSender, logger *logrus.Entry, cause error) {
+	logger = logger.WithField(utils.LogFieldDelivery, true)
+	var chunkErr *sumocli.ChunkDeliveryError
+	if errors.As(cause, &chunkErr) {
+		logger.Debugf("%d of %d chunks are kept by the sender for retry, not requeueing", chunkErr.Failed, chunkErr.Total)
+		attempts.forget(rawMsgArr)
+		return
+	}
+	for _, msg := range rawMsgArr {
+		if attempts.fail(msg) {
+			if err := sender.DeadLetter(ctx, msg, sumocli.DeadLetterReasonMaxAttempts, cause); err != nil {
+				logger.Errorf("Dropping payload of %d bytes after %d attempts: %v", len(msg), attempts.max, err)
+			}
+			continue
+		}
+		select {
+		case dataQueue <- msg:
+		default:
+			logger.Warn("Failed to requeue message, queue full")
+			attempts.forget([][]byte{msg})
+		}
+	}
+}
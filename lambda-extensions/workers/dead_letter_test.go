@@ -0,0 +1,101 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+	sumocli "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/sumoclient"
+)
+
+// failingSender fails every send, like an unreachable or rejecting endpoint
+type failingSender struct {
+	countingSender
+}
+
+func (s *failingSender) SendAllLogs(context.Context, [][]byte) error {
+	return errors.New("statuscode 400")
+}
+
+func TestDeliveryAttempts(t *testing.T) {
+	attempts := newDeliveryAttempts(3)
+	msg := []byte(`[{"type":"function"}]`)
+	if attempts.fail(msg) || attempts.fail(msg) {
+		t.Fatal("payload should have attempts left")
+	}
+	if !attempts.fail(msg) {
+		t.Fatal("payload should be out of attempts after the third failure")
+	}
+	// the count starts over once the payload was handed off
+	if attempts.fail(msg) {
+		t.Fatal("count should have been reset")
+	}
+	attempts.forget([][]byte{msg})
+	if len(attempts.failures) != 0 {
+		t.Fatalf("expected no tracked payloads, got %d", len(attempts.failures))
+	}
+
+	unlimited := newDeliveryAttempts(0)
+	for i := 0; i < 100; i++ {
+		if unlimited.fail(msg) {
+			t.Fatal("payload should never be out of attempts")
+		}
+	}
+}
+
+func TestDrainQueueDeadLettersPoisonMessage(t *testing.T) {
+	sender := &failingSender{}
+	consumer := &sumoConsumer{
+		dataQueue:  make(chan []byte, 10),
+		logger:     newTestLogger(),
+		config:     &cfg.LambdaExtensionConfig{MaxConcurrentRequests: 1},
+		sumoclient: sender,
+		attempts:   newDeliveryAttempts(3),
+	}
+	consumer.dataQueue <- []byte(`[{"type":"function","record":"poison"}]`)
+
+	for i := 1; i <= 3; i++ {
+		consumer.DrainQueue(context.Background())
+		wantQueued := 1
+		if i == 3 {
+			wantQueued = 0
+		}
+		if len(consumer.dataQueue) != wantQueued {
+			t.Fatalf("attempt %d: expected %d queued payloads, got %d", i, wantQueued, len(consumer.dataQueue))
+		}
+	}
+	if got := sender.deadLettered.Load(); got != 1 {
+		t.Fatalf("expected the payload to be dead lettered once, got %d", got)
+	}
+	consumer.DrainQueue(context.Background())
+	if got := sender.deadLettered.Load(); got != 1 || len(consumer.dataQueue) != 0 {
+		t.Fatal("dead lettered payload should not come back")
+	}
+}
+
+// partialSender keeps the failed chunks itself, like the Sumo Logic client
+type partialSender struct {
+	countingSender
+}
+
+func (s *partialSender) SendAllLogs(context.Context, [][]byte) error {
+	return fmt.Errorf("SendAllLogs: %w", &sumocli.ChunkDeliveryError{Failed: 1, Total: 2})
+}
+
+func TestDrainQueueDoesNotRequeueKeptChunks(t *testing.T) {
+	sender := &partialSender{}
+	consumer := &sumoConsumer{
+		dataQueue:  make(chan []byte, 10),
+		logger:     newTestLogger(),
+		config:     &cfg.LambdaExtensionConfig{MaxConcurrentRequests: 1},
+		sumoclient: sender,
+		attempts:   newDeliveryAttempts(3),
+	}
+	consumer.dataQueue <- []byte(`[{"type":"function","record":"a"},{"type":"function","record":"b"}]`)
+	consumer.DrainQueue(context.Background())
+	if len(consumer.dataQueue) != 0 {
+		t.Fatal("payload should not be requeued when the sender kept the failed chunks")
+	}
+}
@@ -0,0 +1,110 @@
+package workers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ExtensionLogType is the type of the records forwarding the extension's own logs
+	ExtensionLogType = "sumo.extension"
+	// maxForwardedPerMinute caps the entries forwarded, a burst of errors is summarised past it
+	maxForwardedPerMinute = 60
+)
+
+// extensionLogHook queues the extension's own log entries as records, next to the telemetry it forwards
+type extensionLogHook struct {
+	dataQueue chan []byte
+	levels    []logrus.Level
+	mu        sync.Mutex
+	// window is when the current minute of forwarding started
+	window    time.Time
+	forwarded int
+	dropped   int
+}
+
+// NewExtensionLogHook returns a hook queueing entries at level or more severe. Entries are dropped
+// when dataQueue is full, logging never waits for the queue. Entries about delivery, marked with
+// utils.LogFieldDelivery, are not forwarded, and at most maxForwardedPerMinute entries are.
+func NewExtensionLogHook(dataQueue chan []byte, level logrus.Level) logrus.Hook {
+	var levels []logrus.Level
+	for _, l := range logrus.AllLevels {
+		if l <= level {
+			levels = append(levels, l)
+		}
+	}
+	return &extensionLogHook{dataQueue: dataQueue, levels: levels}
+}
+
+// Levels is part of logrus.Hook
+func (h *extensionLogHook) Levels() []logrus.Level {
+	return h.levels
+}
+
+// Fire is part of logrus.Hook, it must not log as it runs while the logger is locked
+func (h *extensionLogHook) Fire(entry *logrus.Entry) error {
+	if _, ok := entry.Data[utils.LogFieldDelivery]; ok {
+		return nil
+	}
+	dropped, ok := h.admit(entry.Time)
+	if !ok {
+		return nil
+	}
+	if dropped > 0 {
+		h.queue(entry.Time, map[string]interface{}{
+			"level":   logrus.WarnLevel.String(),
+			"message": fmt.Sprintf("%d extension log entries were not forwarded, over %d per minute", dropped, maxForwardedPerMinute),
+		})
+	}
+	record := make(map[string]interface{}, len(entry.Data)+2)
+	for key, value := range entry.Data {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		record[key] = value
+	}
+	record["level"] = entry.Level.String()
+	record["message"] = entry.Message
+	return h.queue(entry.Time, record)
+}
+
+// admit tells whether an entry logged at now is under the cap, with the entries dropped in the
+// previous minute when it starts a new one
+func (h *extensionLogHook) admit(now time.Time) (int, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	dropped := 0
+	if now.Sub(h.window) >= time.Minute {
+		dropped = h.dropped
+		h.window, h.forwarded, h.dropped = now, 0, 0
+	}
+	if h.forwarded >= maxForwardedPerMinute {
+		h.dropped++
+		return 0, false
+	}
+	h.forwarded++
+	return dropped, true
+}
+
+// queue puts a record on dataQueue without waiting
+func (h *extensionLogHook) queue(at time.Time, record map[string]interface{}) error {
+	payload, err := json.Marshal([]map[string]interface{}{{
+		"time":   at.UTC().Format(time.RFC3339Nano),
+		"type":   ExtensionLogType,
+		"record": record,
+	}})
+	if err != nil {
+		return err
+	}
+	select {
+	case h.dataQueue <- payload:
+	default:
+	}
+	return nil
+}
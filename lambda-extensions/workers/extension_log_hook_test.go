@@ -0,0 +1,68 @@
+package workers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestExtensionLogHook(t *testing.T) {
+	dataQueue := make(chan []byte, 1)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.AddHook(NewExtensionLogHook(dataQueue, logrus.WarnLevel))
+	entry := logger.WithField("component", "consumer")
+
+	entry.Info("below the forwarded level")
+	if len(dataQueue) != 0 {
+		t.Fatal("info entries should not be forwarded")
+	}
+
+	entry.WithError(errors.New("statuscode 503")).Warn("post failed")
+	if len(dataQueue) != 1 {
+		t.Fatalf("expected 1 queued payload, got %d", len(dataQueue))
+	}
+	// the queue is full, logging must not block
+	entry.Error("dropped")
+
+	var records []struct {
+		Type   string                 `json:"type"`
+		Time   string                 `json:"time"`
+		Record map[string]interface{} `json:"record"`
+	}
+	if err := json.Unmarshal(<-dataQueue, &records); err != nil {
+		t.Fatalf("forwarded payload is not a JSON array: %v", err)
+	}
+	if len(records) != 1 || records[0].Type != ExtensionLogType || records[0].Time == "" {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	record := records[0].Record
+	for key, expected := range map[string]string{"component": "consumer", "level": "warning", "message": "post failed", "error": "statuscode 503"} {
+		if record[key] != expected {
+			t.Errorf("record[%q] = %v, expected %q", key, record[key], expected)
+		}
+	}
+}
+
+func TestExtensionLogHookSkipsDeliveryAndCaps(t *testing.T) {
+	dataQueue := make(chan []byte, 2*maxForwardedPerMinute)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.AddHook(NewExtensionLogHook(dataQueue, logrus.WarnLevel))
+
+	logger.WithField(utils.LogFieldDelivery, true).Warn("chunk not delivered")
+	if len(dataQueue) != 0 {
+		t.Fatal("delivery entries should not be forwarded")
+	}
+	for i := 0; i < maxForwardedPerMinute+10; i++ {
+		logger.Warn("repeated")
+	}
+	if len(dataQueue) != maxForwardedPerMinute {
+		t.Fatalf("expected %d forwarded entries, got %d", maxForwardedPerMinute, len(dataQueue))
+	}
+}
@@ -0,0 +1,143 @@
+package workers
+
+import (
+	"context"
+	"time"
+
+	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// deferringConsumer buffers payloads after an invocation and sends them later
+type deferringConsumer interface {
+	BufferQueue(context.Context) string
+	FlushBuffer(context.Context)
+}
+
+// runtimeDoneWaiter waits for the telemetry of an invocation to be received
+type runtimeDoneWaiter interface {
+	WaitRuntimeDone(context.Context, time.Time) bool
+}
+
+// FlushScheduler sends the telemetry of invocations in standard mode following SUMO_FLUSH_MODE. Lambda
+// bills an invocation until every extension asks for the next event, the time BeforeNext takes is the
+// latency the extension adds to the invocation and is logged with each flush.
+type FlushScheduler struct {
+	consumer TaskConsumer
+	config   *cfg.LambdaExtensionConfig
+	logger   *logrus.Entry
+	mode     string
+	// deadline of the running invocation, zero when none runs
+	deadline time.Time
+	// due is why the buffer has to be sent during the next invocation, empty when it can wait
+	due string
+	// background is closed once the flush running during an invocation is done, nil when none runs
+	background chan struct{}
+}
+
+// NewFlushScheduler returns a scheduler for the configured flush mode, consumers which can not
+// defer or wait for runtimeDone are flushed in FlushModeSync
+func NewFlushScheduler(consumer TaskConsumer, config *cfg.LambdaExtensionConfig, logger *logrus.Entry) *FlushScheduler {
+	mode := config.FlushMode
+	switch mode {
+	case cfg.FlushModeDeferred:
+		if _, ok := consumer.(deferringConsumer); !ok {
+			mode = cfg.FlushModeSync
+		}
+	case cfg.FlushModePostInvoke:
+		if _, ok := consumer.(runtimeDoneWaiter); !ok {
+			mode = cfg.FlushModeSync
+		}
+	default:
+		mode = cfg.FlushModeSync
+	}
+	return &FlushScheduler{consumer: consumer, config: config, logger: logger, mode: mode}
+}
+
+// Invoked is called on INVOKE events with the deadline of the invocation. Deferred telemetry which is
+// due is sent while the function runs, so it only adds latency when the function ends first.
+func (f *FlushScheduler) Invoked(ctx context.Context, deadlineMs int64) {
+	f.deadline = time.UnixMilli(deadlineMs)
+	if f.due == "" {
+		return
+	}
+	reason := f.due
+	f.due = ""
+	done := make(chan struct{})
+	f.background = done
+	go func() {
+		defer close(done)
+		start := time.Now()
+		f.consumer.(deferringConsumer).FlushBuffer(ctx)
+		f.logger.WithFields(logrus.Fields{
+			"mode":    f.mode,
+			"reason":  reason,
+			"flushMs": time.Since(start).Milliseconds(),
+		}).Info("Sent deferred telemetry during the invocation")
+	}()
+}
+
+// BeforeNext is called before asking for the next event, once the function is done
+func (f *FlushScheduler) BeforeNext(ctx context.Context) {
+	start := time.Now()
+	fields := logrus.Fields{"mode": f.mode}
+	switch f.mode {
+	case cfg.FlushModeDeferred:
+		if f.background != nil {
+			// the flush started with the invocation outlasted the function
+			f.Wait()
+			fields["waitMs"] = time.Since(start).Milliseconds()
+		}
+		f.due = f.consumer.(deferringConsumer).BufferQueue(ctx)
+		if f.due != "" {
+			fields["flushDue"] = f.due
+		}
+	case cfg.FlushModePostInvoke:
+		if !f.deadline.IsZero() {
+			// waiting longer than the function would add to its billed duration, what comes later is sent
+			// after the next invocation
+			waitDeadline := start.Add(f.config.PostInvokeWait)
+			if f.deadline.Before(waitDeadline) {
+				waitDeadline = f.deadline
+			}
+			if !f.consumer.(runtimeDoneWaiter).WaitRuntimeDone(ctx, waitDeadline) {
+				f.logger.Debugf("RuntimeDone was not received within %v, flushing what was", f.config.PostInvokeWait)
+			}
+			fields["waitMs"] = time.Since(start).Milliseconds()
+		}
+		f.flush(ctx, fields)
+	default:
+		f.flush(ctx, fields)
+	}
+	f.deadline = time.Time{}
+	fields["addedLatencyMs"] = time.Since(start).Milliseconds()
+	f.logger.WithFields(fields).Info("Flushed after invocation")
+}
+
+// flush drains the queue, buffer targets still apply
+func (f *FlushScheduler) flush(ctx context.Context, fields logrus.Fields) {
+	start := time.Now()
+	if f.consumer.DrainQueue(ctx) == 1 {
+		f.logger.Debug("Flushed the telemetry of a finished invocation")
+	}
+	fields["flushMs"] = time.Since(start).Milliseconds()
+}
+
+// RuntimeDoneUnavailable flushes in FlushModeSync instead of FlushModePostInvoke, used when the subscribed
+// schema does not send runtimeDone and every invocation would wait for nothing
+func (f *FlushScheduler) RuntimeDoneUnavailable(reason string) {
+	if f.mode != cfg.FlushModePostInvoke {
+		return
+	}
+	f.logger.Warnf("Flushing in %s mode instead of %s: %s", cfg.FlushModeSync, f.mode, reason)
+	f.mode = cfg.FlushModeSync
+}
+
+// Wait waits for the flush running during an invocation, it has to be done before shutting down
+func (f *FlushScheduler) Wait() {
+	if f.background != nil {
+		<-f.background
+		f.background = nil
+	}
+}
@@ -0,0 +1,97 @@
+package workers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+)
+
+func newTestFlushConsumer(config *cfg.LambdaExtensionConfig) (*sumoConsumer, *countingSender) {
+	sender := &countingSender{}
+	return &sumoConsumer{
+		dataQueue:  make(chan []byte, 10),
+		logger:     newTestLogger(),
+		config:     config,
+		sumoclient: sender,
+		attempts:   newDeliveryAttempts(3),
+		buffer:     newTelemetryBuffer(config, newTestLogger()),
+	}, sender
+}
+
+func TestFlushSchedulerDeferred(t *testing.T) {
+	config := newTestBufferConfig(t)
+	config.FlushMode = cfg.FlushModeDeferred
+	consumer, sender := newTestFlushConsumer(config)
+	scheduler := NewFlushScheduler(consumer, config, newTestLogger())
+	ctx := context.Background()
+
+	consumer.dataQueue <- []byte(`[{"type":"function","record":"a"},{"type":"platform.runtimeDone","record":{}}]`)
+	scheduler.BeforeNext(ctx)
+	scheduler.Invoked(ctx, time.Now().Add(time.Second).UnixMilli())
+	if scheduler.background != nil || sender.sent.Load() != 0 {
+		t.Fatal("telemetry under the buffer targets should wait")
+	}
+
+	consumer.dataQueue <- []byte(`[{"type":"function","record":"b"},{"type":"function","record":"c"},{"type":"function","record":"d"}]`)
+	scheduler.BeforeNext(ctx)
+	if sender.sent.Load() != 0 || scheduler.due != BufferFlushRecords {
+		t.Fatalf("a due buffer should be sent during the next invocation, due %q", scheduler.due)
+	}
+	scheduler.Invoked(ctx, time.Now().Add(time.Second).UnixMilli())
+	scheduler.Wait()
+	if sender.sent.Load() != 2 {
+		t.Fatalf("the buffer should be sent when the invocation starts, sent %d", sender.sent.Load())
+	}
+}
+
+func TestFlushSchedulerPostInvoke(t *testing.T) {
+	config := &cfg.LambdaExtensionConfig{MaxConcurrentRequests: 1, FlushMode: cfg.FlushModePostInvoke, PostInvokeWait: 100 * time.Millisecond}
+	consumer, sender := newTestFlushConsumer(config)
+	scheduler := NewFlushScheduler(consumer, config, newTestLogger())
+	ctx := context.Background()
+
+	scheduler.Invoked(ctx, time.Now().Add(time.Second).UnixMilli())
+	consumer.dataQueue <- []byte(`[{"type":"function","record":"a"}]`)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		consumer.dataQueue <- []byte(`[{"type":"platform.runtimeDone","record":{}}]`)
+	}()
+	start := time.Now()
+	scheduler.BeforeNext(ctx)
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("the flush should not wait past runtimeDone")
+	}
+	if sender.sent.Load() != 2 || len(consumer.held) != 0 {
+		t.Fatalf("the telemetry received until runtimeDone should be sent, sent %d", sender.sent.Load())
+	}
+
+	// runtimeDone of an invocation which timed out may never come
+	scheduler.Invoked(ctx, time.Now().UnixMilli())
+	consumer.dataQueue <- []byte(`[{"type":"function","record":"b"}]`)
+	scheduler.BeforeNext(ctx)
+	if sender.sent.Load() != 3 {
+		t.Fatalf("the telemetry received by the deadline should be sent, sent %d", sender.sent.Load())
+	}
+
+	// a function running longer than the wait has its telemetry sent after the next invocation
+	scheduler.Invoked(ctx, time.Now().Add(time.Minute).UnixMilli())
+	start = time.Now()
+	scheduler.BeforeNext(ctx)
+	if waited := time.Since(start); waited < 100*time.Millisecond || waited > time.Second {
+		t.Fatalf("the wait should be bounded by PostInvokeWait, waited %v", waited)
+	}
+
+	scheduler.RuntimeDoneUnavailable("no runtimeDone")
+	if scheduler.mode != cfg.FlushModeSync {
+		t.Fatal("post_invoke should fall back to sync without runtimeDone")
+	}
+}
+
+func TestFlushSchedulerFallsBackToSync(t *testing.T) {
+	config := &cfg.LambdaExtensionConfig{FlushMode: cfg.FlushModePostInvoke}
+	if scheduler := NewFlushScheduler(&countingConsumer{}, config, newTestLogger()); scheduler.mode != cfg.FlushModeSync {
+		t.Fatalf("consumers unable to wait for runtimeDone should be flushed in sync mode, got %s", scheduler.mode)
+	}
+}
@@ -0,0 +1,129 @@
+package workers
+
+import (
+	"sync"
+	"time"
+)
+
+// FlushReason tells the managed instance consumer why a flush was requested
+type FlushReason string
+
+const (
+	// FlushQueueThreshold is requested by the producer when dataQueue reaches queueThresholdPercent
+	FlushQueueThreshold FlushReason = "queue_threshold"
+	// FlushPlatformReport is requested by the producer when an invocation reported
+	FlushPlatformReport FlushReason = "platform.report"
+	// FlushRecordAge is requested when the oldest queued record is older than the configured max age
+	FlushRecordAge FlushReason = "record_age"
+	// FlushInterval is requested periodically so quiet instances do not hold logs
+	FlushInterval FlushReason = "interval"
+)
+
+// FlushPriority orders flush signals, a pending signal is replaced by one of higher priority
+type FlushPriority int
+
+const (
+	// FlushPriorityLow flushes are skipped when there is nothing queued
+	FlushPriorityLow FlushPriority = iota
+	// FlushPriorityNormal flushes are triggered by invocation progress
+	FlushPriorityNormal
+	// FlushPriorityHigh flushes are triggered by the queue filling up
+	FlushPriorityHigh
+)
+
+// FlushSignal is a request to drain the queue
+type FlushSignal struct {
+	Reason   FlushReason
+	Priority FlushPriority
+}
+
+// flushPriorities maps each reason to the priority it is signalled with
+var flushPriorities = map[FlushReason]FlushPriority{
+	FlushQueueThreshold: FlushPriorityHigh,
+	FlushRecordAge:      FlushPriorityNormal,
+	FlushPlatformReport: FlushPriorityNormal,
+	FlushInterval:       FlushPriorityLow,
+}
+
+// NewFlushSignal returns a signal for reason with its priority
+func NewFlushSignal(reason FlushReason) FlushSignal {
+	return FlushSignal{Reason: reason, Priority: flushPriorities[reason]}
+}
+
+// FlushSignaler carries flush signals from the producer to the consumer. Signals sent while one is
+// pending are coalesced into it, so a burst of platform.report events results in a single flush and
+// no signal is dropped. It also tracks when the oldest record not yet drained was queued.
+type FlushSignaler struct {
+	mu        sync.Mutex
+	pending   *FlushSignal
+	coalesced int
+	oldest    time.Time
+	ready     chan struct{}
+}
+
+// NewFlushSignaler returns a signaler with no pending signal
+func NewFlushSignaler() *FlushSignaler {
+	return &FlushSignaler{ready: make(chan struct{}, 1)}
+}
+
+// Send requests a flush, it never blocks
+func (fs *FlushSignaler) Send(signal FlushSignal) {
+	fs.mu.Lock()
+	if fs.pending == nil {
+		fs.pending = &signal
+	} else {
+		fs.coalesced++
+		if signal.Priority > fs.pending.Priority {
+			fs.pending = &signal
+		}
+	}
+	fs.mu.Unlock()
+	select {
+	case fs.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready is notified when a signal is pending
+func (fs *FlushSignaler) Ready() <-chan struct{} {
+	return fs.ready
+}
+
+// Take returns the pending signal and how many signals were coalesced into it
+func (fs *FlushSignaler) Take() (FlushSignal, int, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.pending == nil {
+		return FlushSignal{}, 0, false
+	}
+	signal, coalesced := *fs.pending, fs.coalesced
+	fs.pending = nil
+	fs.coalesced = 0
+	return signal, coalesced, true
+}
+
+// MarkQueued records that a record was queued at t, only the oldest time is kept
+func (fs *FlushSignaler) MarkQueued(t time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.oldest.IsZero() || t.Before(fs.oldest) {
+		fs.oldest = t
+	}
+}
+
+// MarkDrained is called before the queue is drained, records queued afterwards start a new age. It
+// returns when the oldest drained record was queued, to be marked again if the drain fails to send it.
+func (fs *FlushSignaler) MarkDrained() time.Time {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	oldest := fs.oldest
+	fs.oldest = time.Time{}
+	return oldest
+}
+
+// OldestQueued returns when the oldest record not yet drained was queued, zero if none
+func (fs *FlushSignaler) OldestQueued() time.Time {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.oldest
+}
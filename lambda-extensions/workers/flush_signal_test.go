@@ -0,0 +1,156 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+)
+
+func TestFlushSignalerCoalesces(t *testing.T) {
+	signaler := NewFlushSignaler()
+	signaler.Send(NewFlushSignal(FlushPlatformReport))
+	signaler.Send(NewFlushSignal(FlushInterval))
+	signaler.Send(NewFlushSignal(FlushQueueThreshold))
+	signaler.Send(NewFlushSignal(FlushPlatformReport))
+
+	select {
+	case <-signaler.Ready():
+	default:
+		t.Fatal("signaler should be ready")
+	}
+	signal, coalesced, ok := signaler.Take()
+	if !ok {
+		t.Fatal("a signal should be pending")
+	}
+	if signal.Reason != FlushQueueThreshold || signal.Priority != FlushPriorityHigh {
+		t.Errorf("expected the highest priority signal to be kept, got %v", signal)
+	}
+	if coalesced != 3 {
+		t.Errorf("expected 3 coalesced signals, got %d", coalesced)
+	}
+	if _, _, ok := signaler.Take(); ok {
+		t.Error("no signal should be pending after Take")
+	}
+}
+
+func TestFlushSignalerRecordAge(t *testing.T) {
+	signaler := NewFlushSignaler()
+	first := time.Now()
+	signaler.MarkQueued(first)
+	signaler.MarkQueued(first.Add(time.Second))
+	if !signaler.OldestQueued().Equal(first) {
+		t.Errorf("expected oldest record to be kept, got %v", signaler.OldestQueued())
+	}
+	signaler.MarkDrained()
+	if !signaler.OldestQueued().IsZero() {
+		t.Error("expected no oldest record after drain")
+	}
+}
+
+// countingSender counts the payloads sent to Sumo Logic
+type countingSender struct {
+	sent         atomic.Int64
+	deadLettered atomic.Int64
+}
+
+func (s *countingSender) SendLogs(context.Context, []byte) error {
+	s.sent.Add(1)
+	return nil
+}
+
+func (s *countingSender) SendAllLogs(_ context.Context, msgs [][]byte) error {
+	s.sent.Add(int64(len(msgs)))
+	return nil
+}
+
+func (s *countingSender) FlushAll(msgs [][]byte) error {
+	s.sent.Add(int64(len(msgs)))
+	return nil
+}
+
+func (s *countingSender) DeadLetter(context.Context, []byte, string, error) error {
+	s.deadLettered.Add(1)
+	return nil
+}
+
+func newTestManagedConsumer(config *cfg.LambdaExtensionConfig) (*managedInstanceSumoConsumer, *countingSender) {
+	sender := &countingSender{}
+	return &managedInstanceSumoConsumer{
+		dataQueue:   make(chan []byte, 10),
+		flushSignal: NewFlushSignaler(),
+		tracker:     NewRequestTracker(0),
+		logger:      newTestLogger(),
+		config:      config,
+		sumoclient:  sender,
+		attempts:    newDeliveryAttempts(config.DeadLetterMaxAttempts),
+		stopped:     make(chan struct{}),
+	}, sender
+}
+
+func waitForSent(t *testing.T, sender *countingSender, want int64, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for sender.sent.Load() < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d payloads sent within %v, got %d", want, timeout, sender.sent.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestManagedConsumerFlushesOnRecordAge(t *testing.T) {
+	consumer, sender := newTestManagedConsumer(&cfg.LambdaExtensionConfig{MaxRecordAge: 100 * time.Millisecond})
+	consumer.Start(context.Background())
+	defer consumer.Stop()
+
+	consumer.dataQueue <- []byte(`[]`)
+	consumer.flushSignal.MarkQueued(time.Now())
+	waitForSent(t, sender, 1, time.Second)
+}
+
+func TestManagedConsumerFlushesOnInterval(t *testing.T) {
+	consumer, sender := newTestManagedConsumer(&cfg.LambdaExtensionConfig{FlushInterval: 50 * time.Millisecond})
+	consumer.Start(context.Background())
+	defer consumer.Stop()
+
+	consumer.dataQueue <- []byte(`[]`)
+	waitForSent(t, sender, 1, time.Second)
+}
+
+func TestManagedConsumerFlushesOnSignal(t *testing.T) {
+	consumer, sender := newTestManagedConsumer(&cfg.LambdaExtensionConfig{})
+	consumer.Start(context.Background())
+	defer consumer.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			consumer.dataQueue <- []byte(`[]`)
+			consumer.flushSignal.Send(NewFlushSignal(FlushPlatformReport))
+		}()
+	}
+	wg.Wait()
+	waitForSent(t, sender, 5, time.Second)
+}
+
+func TestManagedConsumerKeepsRecordAgeOnFailedDrain(t *testing.T) {
+	consumer, _ := newTestManagedConsumer(&cfg.LambdaExtensionConfig{DeadLetterMaxAttempts: 5})
+	consumer.sumoclient = &failingSender{}
+	queued := time.Now().Add(-time.Minute)
+	consumer.dataQueue <- []byte(`[]`)
+	consumer.flushSignal.MarkQueued(queued)
+
+	consumer.DrainQueue(context.Background())
+	if len(consumer.dataQueue) != 1 {
+		t.Fatalf("the payload should be requeued, queue has %d", len(consumer.dataQueue))
+	}
+	if !consumer.flushSignal.OldestQueued().Equal(queued) {
+		t.Errorf("requeued records should keep their age, oldest queued %v", consumer.flushSignal.OldestQueued())
+	}
+}
@@ -0,0 +1,88 @@
+package workers
+
+import (
+	"context"
+	"sync"
+)
+
+// inflightHandlers tracks the handlers of a producer still enqueueing to dataQueue, so none outlive
+// its shutdown. The HTTP and TCP producers stop the same way: no handler is tracked once closed,
+// tracked ones are waited for until the shutdown context is done, then the ones blocked on a full
+// dataQueue give up.
+type inflightHandlers struct {
+	// stopped is closed once shutdown stops waiting, handlers blocked on a full dataQueue give up
+	stopped  chan struct{}
+	stopOnce sync.Once
+	mu       sync.Mutex
+	closed   bool
+	handlers sync.WaitGroup
+}
+
+func newInflightHandlers() *inflightHandlers {
+	return &inflightHandlers{stopped: make(chan struct{})}
+}
+
+// track registers a handler, it fails once closed. register, when not nil, runs under the same lock
+// as the function given to close.
+func (h *inflightHandlers) track(register func()) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return false
+	}
+	if register != nil {
+		register()
+	}
+	h.handlers.Add(1)
+	return true
+}
+
+// done is called by a tracked handler when it returns, unregister, when not nil, runs under the lock
+func (h *inflightHandlers) done(unregister func()) {
+	if unregister != nil {
+		h.mu.Lock()
+		unregister()
+		h.mu.Unlock()
+	}
+	h.handlers.Done()
+}
+
+// enqueue sends the payload to dataQueue, blocking while it is full unless shutdown stopped waiting
+func (h *inflightHandlers) enqueue(dataQueue chan []byte, payload []byte) bool {
+	select {
+	case dataQueue <- payload:
+		return true
+	case <-h.stopped:
+		return false
+	}
+}
+
+// close stops new handlers from being tracked. stop, when not nil, runs under the lock so it sees
+// every handler registered so far and none registered later.
+func (h *inflightHandlers) close(stop func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	if stop != nil {
+		stop()
+	}
+}
+
+// wait waits for the tracked handlers until ctx is done, then makes the ones blocked on dataQueue
+// give up and waits for them to return. It returns the error of ctx when the handlers outlived it.
+func (h *inflightHandlers) wait(ctx context.Context) error {
+	var err error
+	handlersDone := make(chan struct{})
+	go func() {
+		h.handlers.Wait()
+		close(handlersDone)
+	}()
+	select {
+	case <-handlersDone:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	h.stopOnce.Do(func() { close(h.stopped) })
+	<-handlersDone
+	return err
+}
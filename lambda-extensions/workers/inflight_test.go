@@ -0,0 +1,36 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInflightHandlersReleaseBlockedHandlers(t *testing.T) {
+	handlers := newInflightHandlers()
+	dataQueue := make(chan []byte, 1)
+	dataQueue <- []byte("[]")
+	if !handlers.track(nil) {
+		t.Fatal("handlers should be tracked before close")
+	}
+	enqueued := make(chan bool, 1)
+	go func() {
+		defer handlers.done(nil)
+		enqueued <- handlers.enqueue(dataQueue, []byte("[]"))
+	}()
+
+	registered := false
+	handlers.close(func() { registered = true })
+	if !registered || handlers.track(nil) {
+		t.Fatal("no handler should be tracked once closed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := handlers.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("a handler outliving ctx should be reported, got %v", err)
+	}
+	if <-enqueued {
+		t.Error("a handler blocked on a full dataQueue should give up")
+	}
+}
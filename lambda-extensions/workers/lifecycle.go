@@ -0,0 +1,148 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// producerShutdownShare is the share of the shutdown budget given to draining in-flight telemetry,
+// the rest is left for flushing the queue
+const producerShutdownShare = 0.5
+
+// queueFlusher is implemented by both standard and managed instance consumers
+type queueFlusher interface {
+	FlushDataQueue(context.Context)
+	DrainQueue(context.Context) int
+}
+
+// bufferedConsumer holds payloads across invocations, they are sent on shutdown whatever its targets
+type bufferedConsumer interface {
+	FlushBuffer(context.Context)
+}
+
+// queueHolder is a consumer which can read the queue while the producer shuts down, without sending
+type queueHolder interface {
+	HoldQueue(stop <-chan struct{})
+}
+
+// backgroundConsumer is a consumer with its own processing loop
+type backgroundConsumer interface {
+	Start(context.Context)
+	Stop()
+}
+
+// Lifecycle starts the telemetry pipeline in order and stops it in reverse order. On shutdown it
+// stops accepting telemetry, drains in-flight requests, then flushes the queue within the deadline.
+type Lifecycle struct {
+	producer   TaskProducer
+	consumer   queueFlusher
+	background backgroundConsumer
+	logger     *logrus.Entry
+
+	mu       sync.Mutex
+	started  bool
+	stopOnce sync.Once
+	stopErr  error
+}
+
+// NewLifecycle returns a lifecycle for standard mode, where the queue is drained from the main loop
+func NewLifecycle(producer TaskProducer, consumer TaskConsumer, logger *logrus.Entry) *Lifecycle {
+	return &Lifecycle{producer: producer, consumer: consumer, logger: logger}
+}
+
+// NewManagedInstanceLifecycle returns a lifecycle for managed instance mode, where the consumer runs its own loop
+func NewManagedInstanceLifecycle(producer ManagedInstanceTaskProducer, consumer ManagedInstanceTaskConsumer, logger *logrus.Entry) *Lifecycle {
+	return &Lifecycle{producer: producer, consumer: consumer, background: consumer, logger: logger}
+}
+
+// Start starts the consumer loop, if any, before the producer so the queue is read as soon as it is filled.
+// It returns once the producer is listening, which has to happen before subscribing to the Telemetry API.
+func (l *Lifecycle) Start(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.started {
+		return errors.New("lifecycle already started")
+	}
+	if l.background != nil {
+		l.background.Start(ctx)
+	}
+	if err := l.producer.Start(); err != nil {
+		if l.background != nil {
+			l.background.Stop()
+		}
+		return fmt.Errorf("failed to start producer: %w", err)
+	}
+	l.started = true
+	l.logger.Debug("Lifecycle: producer and consumer started")
+	return nil
+}
+
+// Shutdown stops the pipeline once, later calls return the result of the first one. The ctx deadline
+// bounds the whole sequence, it should be derived from the SHUTDOWN event deadline.
+func (l *Lifecycle) Shutdown(ctx context.Context) error {
+	l.stopOnce.Do(func() {
+		l.mu.Lock()
+		started := l.started
+		l.mu.Unlock()
+		if !started {
+			return
+		}
+		l.stopErr = l.shutdown(ctx)
+	})
+	return l.stopErr
+}
+
+func (l *Lifecycle) shutdown(ctx context.Context) error {
+	start := time.Now()
+	var errs []error
+
+	// without a consumer loop nothing reads the queue, it is held while in-flight requests are queued
+	stopHolding := make(chan struct{})
+	holdingDone := make(chan struct{})
+	if holder, ok := l.consumer.(queueHolder); ok && l.background == nil {
+		go func() {
+			defer close(holdingDone)
+			holder.HoldQueue(stopHolding)
+		}()
+	} else {
+		close(holdingDone)
+	}
+
+	// stop accepting telemetry and wait for in-flight requests to be queued
+	producerCtx, cancel := ctx, context.CancelFunc(func() {})
+	if deadline, ok := ctx.Deadline(); ok {
+		producerBudget := time.Duration(float64(time.Until(deadline)) * producerShutdownShare)
+		producerCtx, cancel = context.WithTimeout(ctx, producerBudget)
+	}
+	if err := l.producer.Shutdown(producerCtx); err != nil {
+		l.logger.Warnf("Lifecycle: producer did not drain in-flight telemetry: %v", err)
+		errs = append(errs, fmt.Errorf("producer shutdown: %w", err))
+	}
+	cancel()
+	close(stopHolding)
+	<-holdingDone
+	l.logger.Debugf("Lifecycle: producer stopped after %v", time.Since(start))
+
+	// nothing is sent to the queue anymore, stop the consumer loop so the flush below is the only reader
+	if l.background != nil {
+		l.background.Stop()
+	}
+
+	// send to Sumo Logic first, whatever could not be sent is handed to FlushDataQueue
+	if buffered, ok := l.consumer.(bufferedConsumer); ok {
+		buffered.FlushBuffer(ctx)
+	} else {
+		l.consumer.DrainQueue(ctx)
+	}
+	l.consumer.FlushDataQueue(ctx)
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("queue flush: %w", err))
+	}
+	l.logger.Infof("Lifecycle: shutdown completed in %v", time.Since(start))
+	return errors.Join(errs...)
+}
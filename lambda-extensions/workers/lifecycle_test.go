@@ -0,0 +1,352 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+)
+
+// recorder keeps the order in which lifecycle steps happen
+type recorder struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+func (r *recorder) record(step string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.steps = append(r.steps, step)
+}
+
+func (r *recorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.steps...)
+}
+
+type fakeProducer struct {
+	rec *recorder
+}
+
+func (p *fakeProducer) Start() error {
+	p.rec.record("producer.Start")
+	return nil
+}
+
+func (p *fakeProducer) Shutdown(context.Context) error {
+	p.rec.record("producer.Shutdown")
+	return nil
+}
+
+// countingConsumer reads everything from the queue and counts the payloads
+type countingConsumer struct {
+	rec       *recorder
+	dataQueue chan []byte
+	received  atomic.Int64
+}
+
+func (c *countingConsumer) drain() {
+	for {
+		select {
+		case <-c.dataQueue:
+			c.received.Add(1)
+		default:
+			return
+		}
+	}
+}
+
+func (c *countingConsumer) DrainQueue(context.Context) int {
+	if c.rec != nil {
+		c.rec.record("consumer.DrainQueue")
+	}
+	c.drain()
+	return 0
+}
+
+func (c *countingConsumer) FlushDataQueue(context.Context) {
+	if c.rec != nil {
+		c.rec.record("consumer.FlushDataQueue")
+	}
+	c.drain()
+}
+
+// holdingConsumer reads the queue while the producer shuts down, like the standard mode consumer
+type holdingConsumer struct {
+	countingConsumer
+}
+
+func (c *holdingConsumer) HoldQueue(stop <-chan struct{}) {
+	for {
+		select {
+		case <-c.dataQueue:
+			c.received.Add(1)
+		case <-stop:
+			return
+		}
+	}
+}
+
+type fakeBackgroundConsumer struct {
+	countingConsumer
+}
+
+func (c *fakeBackgroundConsumer) Start(context.Context) {
+	c.rec.record("consumer.Start")
+}
+
+func (c *fakeBackgroundConsumer) Stop() {
+	c.rec.record("consumer.Stop")
+}
+
+func assertSteps(t *testing.T, got []string, want []string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("unexpected lifecycle steps\n got: %v\nwant: %v", got, want)
+	}
+}
+
+func TestLifecycleOrdering(t *testing.T) {
+	rec := &recorder{}
+	consumer := &fakeBackgroundConsumer{countingConsumer{rec: rec, dataQueue: make(chan []byte, 1)}}
+	lifecycle := &Lifecycle{producer: &fakeProducer{rec: rec}, consumer: consumer, background: consumer, logger: newTestLogger()}
+
+	if err := lifecycle.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := lifecycle.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	// a second shutdown is a no-op
+	if err := lifecycle.Shutdown(ctx); err != nil {
+		t.Fatalf("second Shutdown failed: %v", err)
+	}
+
+	assertSteps(t, rec.get(), []string{
+		"consumer.Start", "producer.Start",
+		"producer.Shutdown", "consumer.Stop", "consumer.DrainQueue", "consumer.FlushDataQueue",
+	})
+}
+
+func TestLifecycleShutdownWithoutStart(t *testing.T) {
+	rec := &recorder{}
+	lifecycle := NewLifecycle(&fakeProducer{rec: rec}, &countingConsumer{rec: rec, dataQueue: make(chan []byte, 1)}, newTestLogger())
+	if err := lifecycle.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	assertSteps(t, rec.get(), nil)
+}
+
+func newTestHTTPServer(dataQueue chan []byte) *httpServer {
+	config := &cfg.LambdaExtensionConfig{TelemetryProtocol: "HTTP", TelemetryReceiverPort: 0}
+	return NewTaskProducer(dataQueue, config, newTestLogger()).(*httpServer)
+}
+
+func post(client *http.Client, url string) (int, error) {
+	response, err := client.Post(url, "application/json", bytes.NewBufferString(`[{"type":"function","record":"line"}]`))
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	return response.StatusCode, nil
+}
+
+// TestLifecycleShutdownUnderLoad posts telemetry from many goroutines while shutting down. Every request
+// acknowledged with 200 must reach the consumer and nothing may be queued once Shutdown has returned.
+func TestLifecycleShutdownUnderLoad(t *testing.T) {
+	dataQueue := make(chan []byte, 5)
+	server := newTestHTTPServer(dataQueue)
+	consumer := &countingConsumer{dataQueue: dataQueue}
+	lifecycle := NewLifecycle(server, consumer, newTestLogger())
+	if err := lifecycle.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	url := fmt.Sprintf("http://%s/", server.listener.Addr().String())
+
+	stopConsuming := make(chan struct{})
+	consumerDone := make(chan struct{})
+	go func() {
+		defer close(consumerDone)
+		for {
+			select {
+			case <-stopConsuming:
+				return
+			default:
+				consumer.drain()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	var acked atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := &http.Client{Timeout: 2 * time.Second}
+			for j := 0; j < 50; j++ {
+				status, err := post(client, url)
+				if err != nil {
+					return
+				}
+				if status == http.StatusOK {
+					acked.Add(1)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(stopConsuming)
+	<-consumerDone
+
+	// handlers blocked on the full queue may outlive the producer budget, they are answered with 503
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := lifecycle.Shutdown(ctx); err != nil {
+		t.Logf("Shutdown reported: %v", err)
+	}
+	wg.Wait()
+
+	// producer is stopped, nothing may reach the queue anymore
+	time.Sleep(20 * time.Millisecond)
+	if len(dataQueue) != 0 {
+		t.Errorf("%d payloads queued after Shutdown returned", len(dataQueue))
+	}
+	if consumer.received.Load() != acked.Load() {
+		t.Errorf("acknowledged %d payloads but consumer received %d", acked.Load(), consumer.received.Load())
+	}
+}
+
+// TestLifecycleShutdownWithFullQueue checks that handlers blocked on a full queue do not hold Shutdown past its deadline
+func TestLifecycleShutdownWithFullQueue(t *testing.T) {
+	dataQueue := make(chan []byte, 1)
+	server := newTestHTTPServer(dataQueue)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	url := fmt.Sprintf("http://%s/", server.listener.Addr().String())
+
+	statuses := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			status, _ := post(&http.Client{Timeout: 2 * time.Second}, url)
+			statuses <- status
+		}()
+	}
+	// wait for the queue to fill so the other handlers are blocked
+	for len(dataQueue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := server.Shutdown(ctx); err == nil {
+		t.Error("Shutdown should report in-flight requests were not drained")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown took %v", elapsed)
+	}
+
+	counts := map[int]int{}
+	for i := 0; i < 3; i++ {
+		counts[<-statuses]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusServiceUnavailable] != 2 {
+		t.Errorf("unexpected response statuses: %v", counts)
+	}
+}
+
+// TestLifecycleHoldsFullQueueInStandardMode checks that requests blocked on a full queue are queued
+// while the producer shuts down, as standard mode has no consumer loop to read it
+func TestLifecycleHoldsFullQueueInStandardMode(t *testing.T) {
+	dataQueue := make(chan []byte, 1)
+	server := newTestHTTPServer(dataQueue)
+	consumer := &holdingConsumer{countingConsumer{dataQueue: dataQueue}}
+	lifecycle := NewLifecycle(server, consumer, newTestLogger())
+	if err := lifecycle.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	url := fmt.Sprintf("http://%s/", server.listener.Addr().String())
+
+	statuses := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			status, _ := post(&http.Client{Timeout: 2 * time.Second}, url)
+			statuses <- status
+		}()
+	}
+	// wait for the queue to fill so the other handlers are blocked
+	for len(dataQueue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := lifecycle.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown should drain in-flight requests: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if status := <-statuses; status != http.StatusOK {
+			t.Errorf("request blocked on the full queue answered with %d", status)
+		}
+	}
+	if consumer.received.Load() != 3 {
+		t.Errorf("expected 3 payloads to be consumed, got %d", consumer.received.Load())
+	}
+}
+
+func TestTCPServerShutdownUnderLoad(t *testing.T) {
+	dataQueue := make(chan []byte, 100)
+	config := &cfg.LambdaExtensionConfig{TelemetryProtocol: "TCP", TelemetryReceiverPort: 0, TelemetryMaxItems: 1000, TelemetryMaxBytes: 262144}
+	server := NewTaskProducer(dataQueue, config, newTestLogger()).(*tcpServer)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := dialTCP(server.listener.Addr().String())
+			if err != nil {
+				return
+			}
+			defer func() {
+				_ = conn.Close()
+			}()
+			for {
+				if _, err := conn.Write([]byte(`{"type":"function","record":"line"}` + "\n")); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = server.Shutdown(ctx)
+	queued := len(dataQueue)
+	wg.Wait()
+	time.Sleep(20 * time.Millisecond)
+	if len(dataQueue) != queued {
+		t.Errorf("payloads queued after Shutdown returned: %d before, %d after", queued, len(dataQueue))
+	}
+}
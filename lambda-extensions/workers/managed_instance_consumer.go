@@ -2,9 +2,12 @@ package workers
 
 import (
 	"context"
+	"encoding/json"
+	"time"
 
 	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
 	sumocli "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/sumoclient"
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/utils"
 
 	"github.com/sirupsen/logrus"
 )
@@ -12,6 +15,8 @@ import (
 // ManagedInstanceTaskConsumer exposes methods for consuming tasks in managed instance mode
 type ManagedInstanceTaskConsumer interface {
 	Start(context.Context)
+	// Stop ends the flush signal loop started by Start and waits for an ongoing drain to finish
+	Stop()
 	FlushDataQueue(context.Context)
 	DrainQueue(context.Context) int
 }
@@ -19,65 +24,156 @@ type ManagedInstanceTaskConsumer interface {
 // managedInstanceSumoConsumer drains log from dataQueue in managed instance mode
 type managedInstanceSumoConsumer struct {
 	dataQueue   chan []byte
-	flushSignal chan string
+	flushSignal *FlushSignaler
+	tracker     *RequestTracker
 	logger      *logrus.Entry
 	config      *cfg.LambdaExtensionConfig
 	sumoclient  sumocli.LogSender
+	attempts    *deliveryAttempts
+	cancel      context.CancelFunc
+	stopped     chan struct{}
 }
 
 // NewManagedInstanceTaskConsumer returns a new managed instance consumer
-// flushSignal channel is used to receive signals from producer to trigger flushing
-func NewManagedInstanceTaskConsumer(consumerQueue chan []byte, flushSignal chan string, config *cfg.LambdaExtensionConfig, logger *logrus.Entry) ManagedInstanceTaskConsumer {
+// flushSignal is used to receive signals from producer to trigger flushing
+// tracker is swept periodically to report requests that never received a platform.report
+func NewManagedInstanceTaskConsumer(consumerQueue chan []byte, flushSignal *FlushSignaler, tracker *RequestTracker, config *cfg.LambdaExtensionConfig, logger *logrus.Entry) ManagedInstanceTaskConsumer {
 	return &managedInstanceSumoConsumer{
 		dataQueue:   consumerQueue,
 		flushSignal: flushSignal,
+		tracker:     tracker,
 		logger:      logger,
 		sumoclient:  sumocli.NewLogSenderClient(logger, config),
+		attempts:    newDeliveryAttempts(config.DeadLetterMaxAttempts),
 		config:      config,
+		stopped:     make(chan struct{}),
 	}
 }
 
 // Start starts the managed instance consumer in a goroutine to listen for flush signals independently
 func (esc *managedInstanceSumoConsumer) Start(ctx context.Context) {
 	esc.logger.Info("Starting Managed Instance Consumer")
-	go esc.processFlushSignals(ctx)
+	ctx, esc.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(esc.stopped)
+		esc.processFlushSignals(ctx)
+	}()
+}
+
+// Stop stops listening for flush signals, remaining data is flushed by FlushDataQueue
+func (esc *managedInstanceSumoConsumer) Stop() {
+	if esc.cancel == nil {
+		return
+	}
+	esc.cancel()
+	<-esc.stopped
 }
 
 // processFlushSignals continuously listens for flush signals and triggers queue draining
-// This runs independently without needing callbacks from main thread
+// This runs independently without needing callbacks from main thread. Besides the producer signals,
+// the queue is flushed every FlushInterval and as soon as the oldest queued record is older than MaxRecordAge.
 func (esc *managedInstanceSumoConsumer) processFlushSignals(ctx context.Context) {
 	esc.logger.Info("Managed Instance Consumer: Started listening for flush signals")
 
+	var intervalTick, ageTick <-chan time.Time
+	if esc.config.FlushInterval > 0 {
+		ticker := time.NewTicker(esc.config.FlushInterval)
+		defer ticker.Stop()
+		intervalTick = ticker.C
+	}
+	if esc.config.MaxRecordAge > 0 {
+		ticker := time.NewTicker(recordAgeCheckInterval(esc.config.MaxRecordAge))
+		defer ticker.Stop()
+		ageTick = ticker.C
+	}
+	sweepTicker := time.NewTicker(requestSweepInterval)
+	defer sweepTicker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
-			esc.logger.Info("Managed Instance Consumer: Context cancelled, flushing remaining data")
-			esc.FlushDataQueue(ctx)
+			esc.logger.Info("Managed Instance Consumer: Stopped listening for flush signals")
 			return
 
-		case signal := <-esc.flushSignal:
-			esc.logger.Infof("Managed Instance Consumer: Received flush signal: %s", signal)
+		case <-esc.flushSignal.Ready():
+			signal, coalesced, ok := esc.flushSignal.Take()
+			if !ok {
+				continue
+			}
+			esc.logger.Infof("Managed Instance Consumer: Received flush signal: %s (%d coalesced)", signal.Reason, coalesced)
+			esc.flush(ctx, signal)
 
-			switch signal {
-			case "queue_threshold":
-				esc.logger.Info("Managed Instance Consumer: Draining queue due to 80% threshold")
-				esc.DrainQueue(ctx)
+		case <-intervalTick:
+			esc.flush(ctx, NewFlushSignal(FlushInterval))
 
-			case "platform.report":
-				esc.logger.Info("Managed Instance Consumer: Draining queue due to platform.report event")
-				esc.DrainQueue(ctx)
+		case <-sweepTicker.C:
+			if gaps := esc.tracker.Expire(); len(gaps) > 0 {
+				esc.logger.Warnf("Managed Instance Consumer: %d requests never reported", len(gaps))
+				esc.queueGapEvents(ctx, gaps)
+				esc.flush(ctx, NewFlushSignal(FlushPlatformReport))
+			}
 
-			default:
-				esc.logger.Warnf("Managed Instance Consumer: Unknown flush signal received: %s", signal)
+		case now := <-ageTick:
+			oldest := esc.flushSignal.OldestQueued()
+			if !oldest.IsZero() && now.Sub(oldest) >= esc.config.MaxRecordAge {
+				esc.logger.Infof("Managed Instance Consumer: Oldest record queued %v ago", now.Sub(oldest))
+				esc.flush(ctx, NewFlushSignal(FlushRecordAge))
 			}
 		}
 	}
 }
 
+// requestSweepInterval is how often in-flight requests are checked for a missing platform.report
+const requestSweepInterval = time.Second
+
+// queueGapEvents queues synthetic platform.report events, sending them straight away when the queue is full
+func (esc *managedInstanceSumoConsumer) queueGapEvents(ctx context.Context, gaps []map[string]interface{}) {
+	for _, gap := range gaps {
+		if record, ok := gap["record"].(map[string]interface{}); ok {
+			esc.logger.WithField(utils.LogFieldRequestID, record["requestId"]).Debugf("Managed Instance Consumer: Request missing its report, reason: %v", record["reason"])
+		}
+	}
+	payload, err := json.Marshal(gaps)
+	if err != nil {
+		esc.logger.Errorf("Managed Instance Consumer: Unable to marshal gap events: %v", err)
+		return
+	}
+	select {
+	case esc.dataQueue <- payload:
+		esc.flushSignal.MarkQueued(time.Now())
+	default:
+		if err := esc.sumoclient.SendLogs(ctx, payload); err != nil {
+			esc.logger.WithField(utils.LogFieldDelivery, true).Errorf("Managed Instance Consumer: Unable to send gap events: %v", err)
+		}
+	}
+}
+
+// recordAgeCheckInterval checks the record age often enough to flush close to MaxRecordAge
+func recordAgeCheckInterval(maxRecordAge time.Duration) time.Duration {
+	return max(maxRecordAge/4, 100*time.Millisecond)
+}
+
+// flush drains the queue for signal, low priority signals are skipped when nothing is queued
+func (esc *managedInstanceSumoConsumer) flush(ctx context.Context, signal FlushSignal) {
+	if signal.Priority == FlushPriorityLow && len(esc.dataQueue) == 0 {
+		esc.logger.Debugf("Managed Instance Consumer: Nothing queued, skipping %s flush", signal.Reason)
+		return
+	}
+	esc.logger.Infof("Managed Instance Consumer: Draining queue due to %s", signal.Reason)
+	esc.DrainQueue(ctx)
+}
+
 // FlushDataQueue drains the dataqueue completely (called during shutdown)
+// dataQueue is left open, producers must be shut down before calling it so nothing is left behind.
 func (esc *managedInstanceSumoConsumer) FlushDataQueue(ctx context.Context) {
 	esc.logger.Info("Managed Instance Consumer: Flushing DataQueue")
 
+	// requests still in flight will not report anymore
+	if gaps := esc.tracker.ExpireAll(); len(gaps) > 0 {
+		esc.logger.Warnf("Managed Instance Consumer: %d requests in flight at shutdown", len(gaps))
+		esc.queueGapEvents(ctx, gaps)
+	}
+
 	if esc.config.EnableFailover {
 		var rawMsgArr [][]byte
 	Loop:
@@ -89,28 +185,22 @@ func (esc *managedInstanceSumoConsumer) FlushDataQueue(ctx context.Context) {
 				if len(rawMsgArr) > 0 {
 					err := esc.sumoclient.FlushAll(rawMsgArr)
 					if err != nil {
-						esc.logger.Errorln("Managed Instance Consumer: Unable to flush DataQueue", err.Error())
+						esc.logger.WithField(utils.LogFieldDelivery, true).Errorln("Managed Instance Consumer: Unable to flush DataQueue", err.Error())
 						// putting back all the msg to the queue in case of failure
-						for _, msg := range rawMsgArr {
-							select {
-							case esc.dataQueue <- msg:
-							default:
-								esc.logger.Warnf("Managed Instance Consumer: Failed to requeue message, queue full")
-							}
-						}
+						requeueOrDeadLetter(ctx, esc.dataQueue, rawMsgArr, esc.attempts, esc.sumoclient, esc.logger, err)
 					} else {
+						esc.attempts.forget(rawMsgArr)
 						esc.logger.Infof("Managed Instance Consumer: Successfully flushed %d messages", len(rawMsgArr))
 					}
 				}
-				close(esc.dataQueue)
-				esc.logger.Debugf("Managed Instance Consumer: DataQueue completely drained and closed")
+				esc.logger.Debugf("Managed Instance Consumer: DataQueue completely drained")
 				break Loop
 			}
 		}
 	} else {
 		// calling drainqueue (during shutdown) if failover is not enabled
 		maxCallsNeededForCompleteDraining := (len(esc.dataQueue) / esc.config.MaxConcurrentRequests) + 1
-		for i := 0; i < maxCallsNeededForCompleteDraining; i++ {
+		for i := 0; i < maxCallsNeededForCompleteDraining && ctx.Err() == nil; i++ {
 			esc.DrainQueue(ctx)
 		}
 		esc.logger.Info("Managed Instance Consumer: DataQueue drained without failover")
@@ -120,10 +210,13 @@ func (esc *managedInstanceSumoConsumer) FlushDataQueue(ctx context.Context) {
 // DrainQueue drains the current contents of the queue
 func (esc *managedInstanceSumoConsumer) DrainQueue(ctx context.Context) int {
 	esc.logger.Debug("Managed Instance Consumer: Draining data from dataQueue")
+	// records queued from now on are not guaranteed to be part of this drain
+	oldest := esc.flushSignal.MarkDrained()
 
 	var rawMsgArr [][]byte
 	var logsStr string
-	var runtime_done = 0
+	// requests finished since the previous drain, their logs are part of this one
+	var runtime_done = esc.tracker.TakeRuntimeDone()
 
 	// Collect all available messages from the queue
 Loop:
@@ -140,16 +233,15 @@ Loop:
 				esc.logger.Infof("Managed Instance Consumer: Sending %d messages to Sumo Logic", len(rawMsgArr))
 				err := esc.sumoclient.SendAllLogs(ctx, rawMsgArr)
 				if err != nil {
-					esc.logger.Errorln("Managed Instance Consumer: Unable to send logs to Sumo Logic", err.Error())
+					esc.logger.WithField(utils.LogFieldDelivery, true).Errorln("Managed Instance Consumer: Unable to send logs to Sumo Logic", err.Error())
 					// putting back all the msg to the queue in case of failure
-					for _, msg := range rawMsgArr {
-						select {
-						case esc.dataQueue <- msg:
-						default:
-							esc.logger.Warn("Managed Instance Consumer: Failed to requeue message, queue full")
-						}
+					requeueOrDeadLetter(ctx, esc.dataQueue, rawMsgArr, esc.attempts, esc.sumoclient, esc.logger, err)
+					if !oldest.IsZero() {
+						// requeued or kept by the sender, the records are as old as before the drain
+						esc.flushSignal.MarkQueued(oldest)
 					}
 				} else {
+					esc.attempts.forget(rawMsgArr)
 					esc.logger.Infof("Managed Instance Consumer: Successfully sent %d messages", len(rawMsgArr))
 				}
 			} else {
@@ -1,32 +1,37 @@
 package workers
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	ioutil "io"
 	"net/http"
+	"time"
+
+	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
 
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	// managedReceiverIP is Web Server Constants for managed instance mode
-	managedReceiverIP = "0.0.0.0"
-	// managedReceiverPort is Web Server Constants for managed instance mode
-	managedReceiverPort = 4243
 	// queueThresholdPercent is the threshold percentage for triggering flush
 	queueThresholdPercent = 0.8
 )
 
 // ManagedInstanceTaskProducer exposes methods for producing tasks in managed instance mode
 type ManagedInstanceTaskProducer interface {
+	// Start starts listening and returns once telemetry can be received
 	Start() error
+	// Shutdown stops accepting telemetry and waits for in-flight requests until ctx is done
+	Shutdown(context.Context) error
 }
 
 type managedInstanceHttpServer struct {
+	*receiver
 	dataQueue   chan []byte
 	logger      *logrus.Entry
-	flushSignal chan string // Signal channel to notify consumer to flush
+	flushSignal *FlushSignaler // Signals the consumer to flush
+	tracker     *RequestTracker
+	port        int
 }
 
 type Event struct {
@@ -36,27 +41,35 @@ type Event struct {
 }
 
 // NewManagedInstanceTaskProducer returns a new managed instance producer object
-// flushSignal channel is used to signal consumer when queue is 80% full or platform.report is received
-func NewManagedInstanceTaskProducer(consumerQueue chan []byte, flushSignal chan string, logger *logrus.Entry) ManagedInstanceTaskProducer {
+// flushSignal is used to signal consumer when queue is 80% full or platform.report is received
+// tracker follows the state of each request from the received events
+func NewManagedInstanceTaskProducer(consumerQueue chan []byte, flushSignal *FlushSignaler, tracker *RequestTracker, config *cfg.LambdaExtensionConfig, logger *logrus.Entry) ManagedInstanceTaskProducer {
 	return &managedInstanceHttpServer{
+		receiver:    newReceiver(logger),
 		dataQueue:   consumerQueue,
 		logger:      logger,
 		flushSignal: flushSignal,
+		tracker:     tracker,
+		port:        config.TelemetryReceiverPort,
 	}
 }
 
 // Start starts the HTTP Server for managed instance mode
 func (mhs *managedInstanceHttpServer) Start() error {
-	http.HandleFunc("/", mhs.logsHandler)
-	mhs.logger.Info("Starting Managed Instance HTTP Server on port ", managedReceiverPort)
-	err := http.ListenAndServe(fmt.Sprintf("%s:%d", managedReceiverIP, managedReceiverPort), nil)
+	mhs.logger.Info("Starting Managed Instance HTTP Server on port ", mhs.port)
+	err := mhs.start(mhs.port, mhs.logsHandler)
 	if err != nil {
 		mhs.logger.Errorf("Managed Instance HTTP server failed to start: %v", err)
-		panic(err)
 	}
 	return err
 }
 
+// Shutdown stops the HTTP Server for managed instance mode
+func (mhs *managedInstanceHttpServer) Shutdown(ctx context.Context) error {
+	mhs.logger.Info("Stopping Managed Instance HTTP Server")
+	return mhs.shutdown(ctx)
+}
+
 // checkQueueThreshold checks if dataQueue has reached 80% capacity and signals consumer
 func (mhs *managedInstanceHttpServer) checkQueueThreshold() {
 	queueLen := len(mhs.dataQueue)
@@ -68,13 +81,9 @@ func (mhs *managedInstanceHttpServer) checkQueueThreshold() {
 	if queueLen >= threshold {
 		mhs.logger.Infof("Managed Instance Producer: Queue reached %d%% capacity (%d/%d), signaling consumer to flush",
 			int(queueThresholdPercent*100), queueLen, queueCap)
-		// Send flush signal to consumer (non-blocking)
-		select {
-		case mhs.flushSignal <- "queue_threshold":
-			mhs.logger.Debugf("Managed Instance Producer: Sent queue_threshold signal to consumer")
-		default:
-			mhs.logger.Warnf("Managed Instance Producer: Flush signal channel full, signal dropped")
-		}
+		// Send flush signal to consumer (non-blocking, coalesced with a pending one)
+		mhs.flushSignal.Send(NewFlushSignal(FlushQueueThreshold))
+		mhs.logger.Debugf("Managed Instance Producer: Sent queue_threshold signal to consumer")
 	}
 }
 
@@ -105,6 +114,7 @@ func (mhs *managedInstanceHttpServer) logsHandler(writer http.ResponseWriter, re
 		// Send payload to dataQueue (non-blocking to prevent deadlock)
 		select {
 		case mhs.dataQueue <- payload:
+			mhs.flushSignal.MarkQueued(time.Now())
 			mhs.logger.Debugf("Managed Instance Producer: Successfully queued data")
 		default:
 			mhs.logger.Warnf("Managed Instance Producer: dataQueue is full, dropping message")
@@ -121,17 +131,19 @@ func (mhs *managedInstanceHttpServer) logsHandler(writer http.ResponseWriter, re
 		} else {
 			mhs.logger.Debugf("Managed Instance Producer: Parsed %d events from telemetry payload\n", len(events))
 
+			for _, stats := range mhs.tracker.Observe(events) {
+				mhs.logger.Debugf("Managed Instance Producer: Request %s reported with %d log records, %d bytes",
+					stats.RequestID, stats.LogRecords, stats.LogBytes)
+			}
+			mhs.logger.Debugf("Managed Instance Producer: %d requests in flight", mhs.tracker.InFlight())
+
 			// Check for platform.report type
 			for _, event := range events {
 				if event.Type == "platform.report" {
 					mhs.logger.Infof("Managed Instance Producer: Found platform.report event at time: %s\n", event.Time)
-					// Send platform.report signal to consumer (non-blocking)
-					select {
-					case mhs.flushSignal <- "platform.report":
-						mhs.logger.Debugf("Managed Instance Producer: Sent platform.report signal to consumer")
-					default:
-						mhs.logger.Warnf("Managed Instance Producer: Flush signal channel full, signal dropped")
-					}
+					// Send platform.report signal to consumer (non-blocking, coalesced with a pending one)
+					mhs.flushSignal.Send(NewFlushSignal(FlushPlatformReport))
+					mhs.logger.Debugf("Managed Instance Producer: Sent platform.report signal to consumer")
 				}
 			}
 		}
@@ -1,43 +1,47 @@
 package workers
 
 import (
-	"fmt"
+	"context"
 	ioutil "io"
 	"net/http"
 
-	"github.com/sirupsen/logrus"
-)
+	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+	"github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/lambdaapi"
 
-const (
-	// receiverIP is Web Server Constants
-	receiverIP = "0.0.0.0"
-	// receiverPort is Web Server Constants
-	receiverPort = 4243
+	"github.com/sirupsen/logrus"
 )
 
 // TaskProducer exposes methods for producing tasks
 type TaskProducer interface {
+	// Start starts listening and returns once telemetry can be received
 	Start() error
+	// Shutdown stops accepting telemetry and waits for in-flight requests until ctx is done
+	Shutdown(context.Context) error
 }
 
 type httpServer struct {
+	*receiver
 	dataQueue chan []byte
 	logger    *logrus.Entry
+	port      int
 }
 
-// NewTaskProducer is to return a new object
-func NewTaskProducer(consumerQueue chan []byte, logger *logrus.Entry) TaskProducer {
-	return &httpServer{dataQueue: consumerQueue, logger: logger}
+// NewTaskProducer is to return a new object, listening with the protocol the Telemetry API is subscribed with
+func NewTaskProducer(consumerQueue chan []byte, config *cfg.LambdaExtensionConfig, logger *logrus.Entry) TaskProducer {
+	if config.TelemetryProtocol == lambdaapi.TCPProtocol {
+		return newTCPServer(consumerQueue, config, logger)
+	}
+	return &httpServer{receiver: newReceiver(logger), dataQueue: consumerQueue, logger: logger, port: config.TelemetryReceiverPort}
 }
 
 // Start is to start the HTTP Server
 func (httpServer *httpServer) Start() error {
-	http.HandleFunc("/", httpServer.logsHandler)
-	err := http.ListenAndServe(fmt.Sprintf("%s:%d", receiverIP, receiverPort), nil)
-	if err != nil {
-		panic(err)
-	}
-	return err
+	return httpServer.start(httpServer.port, httpServer.logsHandler)
+}
+
+// Shutdown is to stop the HTTP Server
+func (httpServer *httpServer) Shutdown(ctx context.Context) error {
+	return httpServer.shutdown(ctx)
 }
 
 // logsHandler is Server Implementation to get Logs from logs API.
@@ -62,7 +66,11 @@ func (httpServer *httpServer) logsHandler(writer http.ResponseWriter, request *h
 		httpServer.logger.Debugf("Producing data into dataQueue - %d \n", len(reqBody))
 		payload := []byte(reqBody)
 		// Sends to a buffered channel block only when the buffer is full
-		httpServer.dataQueue <- payload
+		if !httpServer.enqueue(httpServer.dataQueue, payload) {
+			httpServer.logger.Warnf("Dropping %d bytes received during shutdown as dataQueue is full", len(payload))
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 		writer.WriteHeader(http.StatusOK)
 	}
 }
@@ -0,0 +1,73 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// receiverIP is Web Server Constants
+	receiverIP = "0.0.0.0"
+)
+
+// receiver runs the HTTP server on its own mux so it can be started and shut down independently of
+// any other server in the process, and tracks handlers still enqueueing so none outlive Shutdown.
+type receiver struct {
+	server   *http.Server
+	listener net.Listener
+	logger   *logrus.Entry
+	inflight *inflightHandlers
+}
+
+func newReceiver(logger *logrus.Entry) *receiver {
+	return &receiver{logger: logger, inflight: newInflightHandlers()}
+}
+
+// start binds the listener and serves in the background, so a port in use is reported to the caller
+func (r *receiver) start(port int, handler http.HandlerFunc) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", receiverIP, port))
+	if err != nil {
+		return fmt.Errorf("failed to start HTTP server: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
+		if !r.inflight.track(nil) {
+			http.Error(writer, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		defer r.inflight.done(nil)
+		handler(writer, request)
+	})
+	r.listener = listener
+	r.server = &http.Server{Handler: mux}
+	go func() {
+		if err := r.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			r.logger.Errorf("HTTP server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// enqueue sends the payload to dataQueue, blocking while it is full unless the receiver is stopped
+func (r *receiver) enqueue(dataQueue chan []byte, payload []byte) bool {
+	return r.inflight.enqueue(dataQueue, payload)
+}
+
+// shutdown stops accepting connections and waits for in-flight requests until ctx is done.
+// When it returns no handler is sending to dataQueue anymore.
+func (r *receiver) shutdown(ctx context.Context) error {
+	var err error
+	if r.server != nil {
+		err = r.server.Shutdown(ctx)
+	}
+	r.inflight.close(nil)
+	if waitErr := r.inflight.wait(ctx); err == nil {
+		err = waitErr
+	}
+	return err
+}
@@ -0,0 +1,233 @@
+package workers
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	sumocli "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/sumoclient"
+)
+
+const (
+	// platformStart is sent when an invocation starts
+	platformStart = "platform.start"
+	// platformReport is sent once an invocation and its extensions are done
+	platformReport = "platform.report"
+	// reportAfterRuntimeDoneTimeout is how long a report may lag behind platform.runtimeDone
+	reportAfterRuntimeDoneTimeout = 10 * time.Second
+	// completedRetention is how long logs of a reported request are still recognised as late, they
+	// commonly arrive in the batch after the report
+	completedRetention = time.Minute
+)
+
+const (
+	// GapReasonNoRuntimeDone flags a request that neither finished nor reported, it crashed or timed out
+	GapReasonNoRuntimeDone = "no_runtime_done"
+	// GapReasonNoReport flags a request that finished without a report following
+	GapReasonNoReport = "no_report"
+	// GapReasonShutdown flags a request still in flight when the environment shut down
+	GapReasonShutdown = "shutdown"
+)
+
+// RequestStats is what is known about a request until its platform.report is received
+type RequestStats struct {
+	RequestID         string
+	Started           time.Time
+	RuntimeDone       time.Time
+	RuntimeDoneStatus string
+	LogRecords        int
+	LogBytes          int
+}
+
+// eventRecord holds the fields shared by platform records and JSON formatted function logs
+type eventRecord struct {
+	RequestID string `json:"requestId"`
+	Status    string `json:"status"`
+}
+
+// RequestTracker follows each request of a multi-concurrency environment from platform.start through
+// platform.runtimeDone to platform.report, and flags the requests that never reported.
+type RequestTracker struct {
+	mu       sync.Mutex
+	requests map[string]*RequestStats
+	// completed holds when recently reported requests were reported, their late logs are not counted
+	completed     map[string]time.Time
+	reportTimeout time.Duration
+	runtimeDone   int
+	now           func() time.Time
+}
+
+// NewRequestTracker returns a tracker flagging requests without a report after reportTimeout
+func NewRequestTracker(reportTimeout time.Duration) *RequestTracker {
+	return &RequestTracker{
+		requests:      make(map[string]*RequestStats),
+		completed:     make(map[string]time.Time),
+		reportTimeout: reportTimeout,
+		now:           time.Now,
+	}
+}
+
+// Observe updates request state from a batch of events and returns the requests completed by it.
+// Only platform events start tracking a request. Function and extension logs are attributed to a tracked
+// request from the requestId of JSON records or the prefix of text lines, other logs are not counted:
+// late logs of reported requests, and JSON logs whose own requestId field is not a Lambda request.
+func (rt *RequestTracker) Observe(events []Event) []RequestStats {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	var completed []RequestStats
+	for _, event := range events {
+		switch event.Type {
+		case platformStart, string(RuntimeDone), platformReport:
+			var record eventRecord
+			if json.Unmarshal(event.Record, &record) != nil || record.RequestID == "" {
+				continue
+			}
+			if _, done := rt.completed[record.RequestID]; done {
+				// a late event must not track the request again, it would be flagged as never reported
+				continue
+			}
+			stats := rt.get(record.RequestID)
+			switch event.Type {
+			case platformStart:
+				stats.Started = rt.now()
+			case string(RuntimeDone):
+				stats.RuntimeDone = rt.now()
+				stats.RuntimeDoneStatus = record.Status
+				rt.runtimeDone++
+			case platformReport:
+				completed = append(completed, *stats)
+				rt.complete(record.RequestID)
+			}
+		case "function", "extension":
+			if stats, ok := rt.requests[logRequestID(event.Record)]; ok {
+				stats.LogRecords++
+				stats.LogBytes += len(event.Record)
+			}
+		}
+	}
+	return completed
+}
+
+// logRequestID returns the request id of a function or extension record, or ""
+func logRequestID(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	switch raw[0] {
+	case '{':
+		var record eventRecord
+		if json.Unmarshal(raw, &record) == nil {
+			return record.RequestID
+		}
+	case '"':
+		var line string
+		if json.Unmarshal(raw, &line) == nil {
+			return sumocli.TextLogRequestID(line)
+		}
+	}
+	return ""
+}
+
+// complete stops tracking a request, it is remembered until Expire finds it older than completedRetention
+func (rt *RequestTracker) complete(requestID string) {
+	delete(rt.requests, requestID)
+	rt.completed[requestID] = rt.now()
+}
+
+func (rt *RequestTracker) get(requestID string) *RequestStats {
+	stats, ok := rt.requests[requestID]
+	if !ok {
+		// requests started before the subscription are tracked from their first platform event
+		stats = &RequestStats{RequestID: requestID, Started: rt.now()}
+		rt.requests[requestID] = stats
+	}
+	return stats
+}
+
+// InFlight returns the number of requests without a report yet
+func (rt *RequestTracker) InFlight() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return len(rt.requests)
+}
+
+// Stats returns the state of an in-flight request
+func (rt *RequestTracker) Stats(requestID string) (RequestStats, bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	stats, ok := rt.requests[requestID]
+	if !ok {
+		return RequestStats{}, false
+	}
+	return *stats, true
+}
+
+// TakeRuntimeDone returns how many requests finished since the previous call
+func (rt *RequestTracker) TakeRuntimeDone() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	count := rt.runtimeDone
+	rt.runtimeDone = 0
+	return count
+}
+
+// Expire stops tracking requests that should have reported by now and returns a gap event for each
+func (rt *RequestTracker) Expire() []map[string]interface{} {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	now := rt.now()
+	for requestID, at := range rt.completed {
+		if now.Sub(at) >= completedRetention {
+			delete(rt.completed, requestID)
+		}
+	}
+	var gaps []map[string]interface{}
+	for requestID, stats := range rt.requests {
+		reason := ""
+		if !stats.RuntimeDone.IsZero() && now.Sub(stats.RuntimeDone) >= reportAfterRuntimeDoneTimeout {
+			reason = GapReasonNoReport
+		} else if stats.RuntimeDone.IsZero() && rt.reportTimeout > 0 && now.Sub(stats.Started) >= rt.reportTimeout {
+			reason = GapReasonNoRuntimeDone
+		}
+		if reason != "" {
+			gaps = append(gaps, gapEvent(stats, reason, now))
+			rt.complete(requestID)
+		}
+	}
+	return gaps
+}
+
+// ExpireAll stops tracking every request, used when the environment shuts down
+func (rt *RequestTracker) ExpireAll() []map[string]interface{} {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	now := rt.now()
+	var gaps []map[string]interface{}
+	for requestID, stats := range rt.requests {
+		gaps = append(gaps, gapEvent(stats, GapReasonShutdown, now))
+		delete(rt.requests, requestID)
+	}
+	return gaps
+}
+
+// gapEvent is a synthetic platform.report for a request that never reported. It has no metrics so it
+// is not mistaken for a real report, the CloudWatch REPORT line is only built from real metrics.
+func gapEvent(stats *RequestStats, reason string, now time.Time) map[string]interface{} {
+	record := map[string]interface{}{
+		"requestId":  stats.RequestID,
+		"status":     "missing",
+		"reason":     reason,
+		"synthetic":  true,
+		"elapsedMs":  now.Sub(stats.Started).Milliseconds(),
+		"logRecords": stats.LogRecords,
+		"logBytes":   stats.LogBytes,
+	}
+	if stats.RuntimeDoneStatus != "" {
+		record["runtimeDoneStatus"] = stats.RuntimeDoneStatus
+	}
+	return map[string]interface{}{
+		"time":   now.UTC().Format(time.RFC3339Nano),
+		"type":   platformReport,
+		"record": record,
+	}
+}
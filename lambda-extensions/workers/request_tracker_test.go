@@ -0,0 +1,133 @@
+package workers
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func parseEvents(t *testing.T, payload string) []Event {
+	t.Helper()
+	var events []Event
+	if err := json.Unmarshal([]byte(payload), &events); err != nil {
+		t.Fatalf("invalid test payload: %v", err)
+	}
+	return events
+}
+
+func newTestTracker(reportTimeout time.Duration) (*RequestTracker, *time.Time) {
+	now := time.Date(2025, 1, 29, 10, 0, 0, 0, time.UTC)
+	tracker := NewRequestTracker(reportTimeout)
+	tracker.now = func() time.Time { return now }
+	return tracker, &now
+}
+
+func TestRequestTrackerLifecycle(t *testing.T) {
+	tracker, _ := newTestTracker(time.Minute)
+	tracker.Observe(parseEvents(t, `[
+		{"time":"2025-01-29T10:00:00.000Z","type":"platform.start","record":{"requestId":"a"}},
+		{"time":"2025-01-29T10:00:00.000Z","type":"platform.start","record":{"requestId":"b"}},
+		{"time":"2025-01-29T10:00:00.010Z","type":"function","record":{"requestId":"a","message":"hello"}},
+		{"time":"2025-01-29T10:00:00.010Z","type":"function","record":"text logs cannot be attributed"},
+		{"time":"2025-01-29T10:00:00.020Z","type":"platform.runtimeDone","record":{"requestId":"a","status":"success"}}
+	]`))
+
+	if tracker.InFlight() != 2 {
+		t.Errorf("expected 2 requests in flight, got %d", tracker.InFlight())
+	}
+	stats, ok := tracker.Stats("a")
+	if !ok || stats.LogRecords != 1 || stats.LogBytes != len(`{"requestId":"a","message":"hello"}`) || stats.RuntimeDoneStatus != "success" {
+		t.Errorf("unexpected stats for request a: %+v", stats)
+	}
+	if tracker.TakeRuntimeDone() != 1 || tracker.TakeRuntimeDone() != 0 {
+		t.Error("expected one runtimeDone to be taken once")
+	}
+
+	completed := tracker.Observe(parseEvents(t, `[{"type":"platform.report","record":{"requestId":"a","metrics":{"durationMs":20}}}]`))
+	if len(completed) != 1 || completed[0].RequestID != "a" || completed[0].LogRecords != 1 {
+		t.Errorf("unexpected completed requests: %+v", completed)
+	}
+	if tracker.InFlight() != 1 {
+		t.Errorf("expected 1 request in flight, got %d", tracker.InFlight())
+	}
+}
+
+func TestRequestTrackerAttributesOnlyTrackedRequests(t *testing.T) {
+	tracker, now := newTestTracker(time.Minute)
+	id := "3f1c2d4e-5b6a-4c7d-8e9f-0a1b2c3d4e5f"
+	tracker.Observe(parseEvents(t, `[
+		{"type":"platform.start","record":{"requestId":"`+id+`"}},
+		{"type":"function","record":"2025-01-29T10:00:00.010Z\t`+id+`\tINFO\thello"},
+		{"type":"function","record":{"requestId":"order-42","message":"a requestId of the application"}}
+	]`))
+	if tracker.InFlight() != 1 {
+		t.Fatalf("logs should not start tracking a request, %d in flight", tracker.InFlight())
+	}
+	if stats, _ := tracker.Stats(id); stats.LogRecords != 1 {
+		t.Errorf("text logs should be attributed from their prefix, got %+v", stats)
+	}
+
+	tracker.Observe(parseEvents(t, `[{"type":"platform.report","record":{"requestId":"`+id+`"}}]`))
+	tracker.Observe(parseEvents(t, `[
+		{"type":"function","record":{"requestId":"`+id+`","message":"late"}},
+		{"type":"platform.runtimeDone","record":{"requestId":"`+id+`","status":"success"}}
+	]`))
+	if tracker.InFlight() != 0 {
+		t.Errorf("late events of a reported request should not track it again, %d in flight", tracker.InFlight())
+	}
+	*now = now.Add(time.Hour)
+	if gaps := tracker.Expire(); len(gaps) != 0 {
+		t.Errorf("healthy requests should not be flagged, got %v", gaps)
+	}
+	if len(tracker.completed) != 0 {
+		t.Errorf("reported requests should be forgotten after %v", completedRetention)
+	}
+}
+
+func TestRequestTrackerExpire(t *testing.T) {
+	tracker, now := newTestTracker(time.Minute)
+	tracker.Observe(parseEvents(t, `[
+		{"type":"platform.start","record":{"requestId":"crashed"}},
+		{"type":"platform.start","record":{"requestId":"unreported"}},
+		{"type":"platform.runtimeDone","record":{"requestId":"unreported","status":"timeout"}}
+	]`))
+
+	if gaps := tracker.Expire(); len(gaps) != 0 {
+		t.Errorf("expected no gaps yet, got %v", gaps)
+	}
+
+	*now = now.Add(reportAfterRuntimeDoneTimeout)
+	gaps := tracker.Expire()
+	if len(gaps) != 1 {
+		t.Fatalf("expected 1 gap, got %v", gaps)
+	}
+	record := gaps[0]["record"].(map[string]interface{})
+	if gaps[0]["type"] != "platform.report" || record["requestId"] != "unreported" || record["reason"] != GapReasonNoReport || record["runtimeDoneStatus"] != "timeout" {
+		t.Errorf("unexpected gap event: %v", gaps[0])
+	}
+
+	*now = now.Add(time.Minute)
+	gaps = tracker.Expire()
+	if len(gaps) != 1 || gaps[0]["record"].(map[string]interface{})["reason"] != GapReasonNoRuntimeDone {
+		t.Errorf("expected crashed request to be flagged, got %v", gaps)
+	}
+	if tracker.InFlight() != 0 {
+		t.Errorf("expected no request in flight, got %d", tracker.InFlight())
+	}
+}
+
+func TestRequestTrackerExpireAll(t *testing.T) {
+	tracker, _ := newTestTracker(0)
+	tracker.Observe(parseEvents(t, `[{"type":"platform.start","record":{"requestId":"a"}}]`))
+	if gaps := tracker.Expire(); len(gaps) != 0 {
+		t.Errorf("expected no gaps with the report timeout disabled, got %v", gaps)
+	}
+	gaps := tracker.ExpireAll()
+	if len(gaps) != 1 || gaps[0]["record"].(map[string]interface{})["reason"] != GapReasonShutdown {
+		t.Errorf("expected in-flight request to be flagged at shutdown, got %v", gaps)
+	}
+	// gap events must survive the trip through the pipeline
+	if _, err := json.Marshal(gaps); err != nil {
+		t.Errorf("gap events should marshal: %v", err)
+	}
+}
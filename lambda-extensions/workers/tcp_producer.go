@@ -0,0 +1,177 @@
+package workers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// tcpReadBufferSize is the initial size of the per connection read buffer
+	tcpReadBufferSize = 256 * 1024
+	// tcpDrainTimeout is how long open connections keep being read after Shutdown is called
+	tcpDrainTimeout = 100 * time.Millisecond
+)
+
+// tcpServer receives newline delimited JSON events from the Telemetry API TCP destination
+// and frames them back into JSON arrays, the same shape the HTTP destination posts.
+type tcpServer struct {
+	dataQueue chan []byte
+	logger    *logrus.Entry
+	port      int
+	maxItems  int
+	maxBytes  int
+	listener  net.Listener
+	inflight  *inflightHandlers
+	// conns are the open connections, only accessed under the lock of inflight
+	conns map[net.Conn]struct{}
+}
+
+func newTCPServer(consumerQueue chan []byte, config *cfg.LambdaExtensionConfig, logger *logrus.Entry) *tcpServer {
+	return &tcpServer{
+		dataQueue: consumerQueue,
+		logger:    logger,
+		port:      config.TelemetryReceiverPort,
+		maxItems:  config.TelemetryMaxItems,
+		maxBytes:  int(config.TelemetryMaxBytes),
+		inflight:  newInflightHandlers(),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Start is to start the TCP listener, connections from the Telemetry API are accepted in the background
+func (ts *tcpServer) Start() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", receiverIP, ts.port))
+	if err != nil {
+		return fmt.Errorf("failed to start TCP listener: %w", err)
+	}
+	ts.logger.Info("Starting TCP Server on port ", ts.port)
+	ts.listener = listener
+	go func() {
+		if err := ts.serve(listener); err != nil {
+			ts.logger.Errorf("TCP server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops accepting connections, reads what open connections still deliver for a short while
+// and waits for their handlers until ctx is done. When it returns no handler is sending to dataQueue anymore.
+func (ts *tcpServer) Shutdown(ctx context.Context) error {
+	var err error
+	if ts.listener != nil {
+		err = ts.listener.Close()
+	}
+	drainDeadline := time.Now().Add(tcpDrainTimeout)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(drainDeadline) {
+		drainDeadline = deadline
+	}
+	ts.inflight.close(func() {
+		for conn := range ts.conns {
+			_ = conn.SetReadDeadline(drainDeadline)
+		}
+	})
+	if waitErr := ts.inflight.wait(ctx); err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+func (ts *tcpServer) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to accept TCP connection: %w", err)
+		}
+		if !ts.track(conn) {
+			_ = conn.Close()
+			continue
+		}
+		go ts.handleConnection(conn)
+	}
+}
+
+// track registers a connection as in flight, it fails once Shutdown has been called
+func (ts *tcpServer) track(conn net.Conn) bool {
+	return ts.inflight.track(func() { ts.conns[conn] = struct{}{} })
+}
+
+func (ts *tcpServer) untrack(conn net.Conn) {
+	ts.inflight.done(func() { delete(ts.conns, conn) })
+}
+
+// handleConnection reads events one line at a time and queues them in batches. A batch is handed over
+// once it reaches the buffering limits or once no more bytes are waiting to be read, so a burst sent by
+// the platform is queued as one payload. Sends to dataQueue block when it is full which stops reading
+// from the socket and pushes back on the platform, like the HTTP handler does by not responding.
+func (ts *tcpServer) handleConnection(conn net.Conn) {
+	defer ts.untrack(conn)
+	defer func() {
+		if err := conn.Close(); err != nil {
+			ts.logger.Debugf("failed to close TCP connection: %v", err)
+		}
+	}()
+	reader := bufio.NewReaderSize(conn, tcpReadBufferSize)
+	var batch bytes.Buffer
+	var batchItems int
+	flush := func() {
+		if batchItems == 0 {
+			return
+		}
+		batch.WriteByte(']')
+		payload := make([]byte, batch.Len())
+		copy(payload, batch.Bytes())
+		ts.logger.Debugf("Producing data into dataQueue - %d \n", len(payload))
+		if !ts.inflight.enqueue(ts.dataQueue, payload) {
+			ts.logger.Warnf("Dropping %d bytes received during shutdown as dataQueue is full", len(payload))
+		}
+		batch.Reset()
+		batchItems = 0
+	}
+	for {
+		line, err := reader.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+		var netErr net.Error
+		timedOut := errors.As(err, &netErr) && netErr.Timeout()
+		if len(line) > 0 {
+			// events are JSON objects, other JSON values would not be read as events downstream
+			if line[0] == '{' && json.Valid(line) {
+				if batchItems == 0 {
+					batch.WriteByte('[')
+				} else {
+					batch.WriteByte(',')
+				}
+				batch.Write(line)
+				batchItems++
+			} else if timedOut {
+				// the drain deadline of Shutdown cut the event off while it was being sent
+				ts.logger.Debugf("Dropping %d bytes of an event cut off by shutdown", len(line))
+			} else {
+				ts.logger.Errorf("Dropping invalid JSON event from Telemetry API: %s", string(line))
+			}
+		}
+		if err != nil {
+			flush()
+			if err != io.EOF && !timedOut {
+				ts.logger.Error("Read from Telemetry API failed: ", err.Error())
+			}
+			return
+		}
+		if batchItems >= ts.maxItems || batch.Len() >= ts.maxBytes || reader.Buffered() == 0 {
+			flush()
+		}
+	}
+}
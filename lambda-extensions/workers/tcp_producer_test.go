@@ -0,0 +1,141 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	cfg "github.com/SumoLogic/sumologic-lambda-extensions/lambda-extensions/config"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func newTestLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger.WithField("Name", "sumologic-extension")
+}
+
+func receivePayload(t *testing.T, dataQueue chan []byte) []map[string]interface{} {
+	t.Helper()
+	select {
+	case payload := <-dataQueue:
+		var events []map[string]interface{}
+		if err := json.Unmarshal(payload, &events); err != nil {
+			t.Fatalf("payload is not a JSON array: %v %s", err, string(payload))
+		}
+		return events
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for payload")
+	}
+	return nil
+}
+
+func TestTCPServerFramesNDJSON(t *testing.T) {
+	dataQueue := make(chan []byte, 10)
+	server := newTCPServer(dataQueue, &cfg.LambdaExtensionConfig{TelemetryMaxItems: 2, TelemetryMaxBytes: 262144}, newTestLogger())
+
+	client, conn := net.Pipe()
+	if !server.track(conn) {
+		t.Fatal("connection should be tracked before shutdown")
+	}
+	go server.handleConnection(conn)
+
+	events := []string{
+		`{"time":"2020-10-27T15:36:14.133Z","type":"platform.start","record":{"requestId":"7313c951"}}`,
+		`{"time":"2020-10-27T15:36:14.283Z","type":"function","record":"hello\n"}`,
+		`not json`,
+		`"a string"`,
+		`42`,
+		`{"time":"2020-10-27T15:36:14.302Z","type":"function","record":"world\n"}`,
+	}
+	go func() {
+		_, _ = client.Write([]byte(strings.Join(events, "\n") + "\n"))
+		_ = client.Close()
+	}()
+
+	var received []map[string]interface{}
+	for len(received) < 3 {
+		batch := receivePayload(t, dataQueue)
+		if len(batch) > 2 {
+			t.Errorf("batch of %d events exceeds max items", len(batch))
+		}
+		received = append(received, batch...)
+	}
+	if received[0]["type"] != "platform.start" || received[2]["record"] != "world\n" {
+		t.Errorf("unexpected events received: %v", received)
+	}
+}
+
+func TestTCPServerFlushesPartialLineOnClose(t *testing.T) {
+	dataQueue := make(chan []byte, 10)
+	server := newTCPServer(dataQueue, &cfg.LambdaExtensionConfig{TelemetryMaxItems: 1000, TelemetryMaxBytes: 262144}, newTestLogger())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		_ = server.serve(listener)
+	}()
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	_, _ = conn.Write([]byte(`{"type":"function","record":"no trailing newline"}`))
+	_ = conn.Close()
+
+	events := receivePayload(t, dataQueue)
+	if len(events) != 1 || events[0]["record"] != "no trailing newline" {
+		t.Errorf("unexpected events received: %v", events)
+	}
+}
+
+func TestTCPServerDropsEventCutOffByShutdown(t *testing.T) {
+	dataQueue := make(chan []byte, 10)
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	server := newTCPServer(dataQueue, &cfg.LambdaExtensionConfig{TelemetryMaxItems: 1000, TelemetryMaxBytes: 262144}, logger.WithField("Name", "sumologic-extension"))
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	if !server.track(conn) {
+		t.Fatal("connection should be tracked before shutdown")
+	}
+	go server.handleConnection(conn)
+	if _, err := client.Write([]byte(`{"type":"function","record":"cut`)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown should wait for the handler: %v", err)
+	}
+	cutOff := false
+	for _, entry := range hook.AllEntries() {
+		if entry.Level <= logrus.ErrorLevel {
+			t.Errorf("an event cut off by shutdown should not be logged as an error: %s", entry.Message)
+		}
+		cutOff = cutOff || strings.Contains(entry.Message, "cut off")
+	}
+	if !cutOff {
+		t.Error("the cut off event should be logged at debug level")
+	}
+	if len(dataQueue) != 0 {
+		t.Errorf("the cut off event should be dropped, %d payloads queued", len(dataQueue))
+	}
+}
+
+func dialTCP(address string) (net.Conn, error) {
+	return net.DialTimeout("tcp", address, time.Second)
+}